@@ -8,11 +8,31 @@ type AutoscopeDB interface {
 	Connect(*Config) error
 	PerformMigration([]MigrationStep) error
 	CurrentSchema() (map[string]Table, error)
+	AutoscopeQueryer
+	//Begin a transaction. Queries performed through the returned
+	// transaction take effect only once it is committed.
+	Begin() (AutoscopeTx, error)
+	/*pseudoJoinWhere(map[string]Table, Formula) (bool, error)*/
+}
+
+//Queries which can be performed either directly on a database or within
+// a transaction
+type AutoscopeQueryer interface {
 	Delete(map[string]Table, map[string]RelationPath, SelectQuery) (ModificationResult, error)
 	Update(map[string]Table, map[string]RelationPath, UpdateQuery) (ModificationResult, error)
 	Select(map[string]Table, map[string]RelationPath, SelectQuery) (RetrievalResult, error)
 	Insert(map[string]Table, InsertQuery) (ModificationResult, error)
-	/*pseudoJoinWhere(map[string]Table, Formula) (bool, error)*/
+	//Insert several rows, returning their ids in order
+	InsertBatch(map[string]Table, BatchInsertQuery) ([]int64, error)
+	//Atomically insert a row or update the row with the same key. The
+	// prefixes resolve relational fields of the query's restriction.
+	Upsert(map[string]Table, map[string]RelationPath, UpsertQuery) (ModificationResult, error)
+}
+
+type AutoscopeTx interface {
+	AutoscopeQueryer
+	Commit() error
+	Rollback() error
 }
 
 type RetrievalResult interface {
@@ -31,6 +51,24 @@ func GetRow (res RetrievalResult) (map[string]interface{}, error) {
 	return res.Get()
 }
 
+//Return the first row of `res`, if there is one. The remaining rows are
+// read and discarded, so that the result releases its connection.
+func FirstRow(res RetrievalResult) (map[string]interface{}, bool, error) {
+	var row map[string]interface{}
+	found := false
+	for res.Next() {
+		if found { continue }
+		found = true
+		var err error
+		row, err = res.Get()
+		if err != nil {
+			for res.Next() {}
+			return nil, false, err
+		}
+	}
+	return row, found, nil
+}
+
 type EmptyModificationResult struct {
 }
 func (r EmptyModificationResult) LastInsertId() (int64, error){
@@ -48,3 +86,30 @@ func (r EmptyRetrievalResult) Next() (bool){
 func (r EmptyRetrievalResult) Get() (map[string]interface{}, error){
 	return nil, nil
 }
+
+//A retrieval result whose rows have already been read into memory
+type BufferedRetrievalResult struct {
+	Rows []map[string]interface{}
+	CurrentIndex int
+}
+
+//Read every row of `res` into memory
+func BufferRetrievalResult(res RetrievalResult) (*BufferedRetrievalResult, error) {
+	r := BufferedRetrievalResult{ CurrentIndex: -1, Rows: make([]map[string]interface{}, 0) }
+	for res.Next() {
+		row, err := res.Get()
+		if err != nil { return nil, err }
+		r.Rows = append(r.Rows, row)
+	}
+	return &r, nil
+}
+func (r *BufferedRetrievalResult) Next() (bool){
+	r.CurrentIndex += 1
+	return r.CurrentIndex < len(r.Rows)
+}
+func (r *BufferedRetrievalResult) Get() (map[string]interface{}, error){
+	if r.CurrentIndex < 0 || r.CurrentIndex >= len(r.Rows) {
+		return nil, errors.New("No row to retrieve")
+	}
+	return r.Rows[r.CurrentIndex], nil
+}
@@ -2,7 +2,7 @@ package engine
 
 import (
 	"errors"
-	_ "strconv"
+	"strconv"
 	"log"
 	"strings"
 	"sync"
@@ -30,11 +30,67 @@ type Config struct {
 	DB_HOST string `yaml:"db_host"`
 	DB_NAME string `yaml:"db_name"`
 	DB_PASSWORD string `yaml:"db_password"`
+	//Prefix prepended to the names of all tables, internal tables included.
+	// Allows several autoscope instances to share one database. Instances
+	// sharing a schema must use prefixes which don't overlap, e.g. a_ and
+	// a_b_ overlap, and the empty prefix overlaps every other.
 	DB_PREFIX string `yaml:"db_prefix"`
+	//Postgres schema in which tables are created. Defaults to public.
+	DB_SCHEMA string `yaml:"db_schema"`
+	DB_PORT string `yaml:"db_port"`
+	//Full connection string or URL (postgres://...). When given, it is used
+	// instead of the individual DB_* connection settings.
+	DB_URL string `yaml:"db_url"`
+	//SSL mode (disable, require, verify-ca, verify-full). Defaults to disable.
+	DB_SSLMODE string `yaml:"db_sslmode"`
+	DB_SSLCERT string `yaml:"db_sslcert"`
+	DB_SSLKEY string `yaml:"db_sslkey"`
+	DB_SSLROOTCERT string `yaml:"db_sslrootcert"`
+	//Seconds to wait for a connection to be established
+	DB_CONNECT_TIMEOUT int64 `yaml:"db_connect_timeout"`
+	DB_APPLICATION_NAME string `yaml:"db_application_name"`
+	DB_SEARCH_PATH string `yaml:"db_search_path"`
+	//Connection pool limits. Zero leaves the database/sql defaults in place.
+	DB_MAX_OPEN_CONNS int64 `yaml:"db_max_open_conns"`
+	DB_MAX_IDLE_CONNS int64 `yaml:"db_max_idle_conns"`
+	//Maximum lifetime and idle time of pooled connections, in seconds
+	DB_CONN_MAX_LIFETIME int64 `yaml:"db_conn_max_lifetime"`
+	DB_CONN_MAX_IDLE_TIME int64 `yaml:"db_conn_max_idle_time"`
+	//Number of times to retry the startup ping, and the initial delay between
+	// attempts in seconds. The delay doubles after every failed attempt.
+	DB_CONNECT_RETRIES int64 `yaml:"db_connect_retries"`
+	DB_CONNECT_RETRY_INTERVAL int64 `yaml:"db_connect_retry_interval"`
 	DatabaseType string `yaml:"database_type"`
 	NewTableRowsThreshhold int64 `yaml:"new_table_rows_threshhold"`
 	NewFieldThreshhold int64 `yaml:"new_field_threshhold"`
+	//Number of inserts referencing the same table after which a field is
+	// declared a foreign key. Zero disables automatic declaration.
+	ForeignKeyThreshhold int64 `yaml:"foreign_key_threshhold"`
+	//On-delete behaviour of automatically declared foreign keys
+	ForeignKeyOnDelete string `yaml:"foreign_key_on_delete"`
+	//Explicitly declared foreign keys: table -> column -> foreign key
+	Relations map[string]map[string]ForeignKey `yaml:"relations"`
+	//Reject selections on unknown fields or relations, and comparisons
+	// between incompatible types. See validation.go.
+	ProductionMode bool `yaml:"production_mode"`
+	//Group whose members have the admin role. Defaults to "admin".
+	AdminGroup string `yaml:"admin_group"`
+	//Usernames of users who always have the admin role, so that a fresh
+	// instance can be administered
+	AdminUsers []string `yaml:"admin_users"`
+	//Additional roles, mapped to their capabilities. See roles.go.
+	Roles map[string][]string `yaml:"roles"`
+	//Seconds between checks for changes to groups made by other nodes.
+	// Defaults to 5. See group_cache.go.
+	GroupCacheInterval int64 `yaml:"group_cache_interval"`
 	AutoMigrate bool `yaml:"auto_migrate"`
+	//Directory in which the memdb backend keeps its snapshot and
+	// append-only log. Persistence is disabled when empty.
+	MemDBDataDir string `yaml:"memdb_data_dir"`
+	//Seconds between compacted memdb snapshots. Zero disables periodic snapshots.
+	MemDBSnapshotInterval int64 `yaml:"memdb_snapshot_interval"`
+	//If true, the memdb log is fsynced after every write
+	MemDBSyncWrites bool `yaml:"memdb_sync_writes"`
 }
 
 //Main data structure for an instance of the Autoscope Engine
@@ -48,7 +104,13 @@ type Engine struct {
 	LocalStats map[string]TableQueryStats
 	LocalStatsLock sync.RWMutex
 	Permissions map[string]ObjectPermissions
+	//Owner of each table, i.e. the user who created it
+	TableOwners map[string]int64
+	//Permissions of individual fields: table -> field -> permissions
+	FieldPermissions map[string]map[string]ObjectPermissions
 	PermissionsLock sync.RWMutex
+	//Groups of users and tables. See group_cache.go.
+	GroupCache *GroupCache
 }
 
 // In order to accurately aggregate our local stats into the database
@@ -116,6 +178,8 @@ func (e *Engine) Init(config *Config) (error){
 
 	//Initialize permissions
 	e.Permissions = make(map[string]ObjectPermissions, 0)
+	e.TableOwners = make(map[string]int64, 0)
+	e.FieldPermissions = make(map[string]map[string]ObjectPermissions, 0)
 	
 	//Load default schema
 	defTables, err := AutoscopeTableSchemas()
@@ -135,6 +199,14 @@ func (e *Engine) Init(config *Config) (error){
 	//Perform migration
 	err = e.DB.PerformMigration(migration)
 	if err != nil { return err }
+	err = e.LoadSchema()
+	if err != nil { return err }
+
+	//Load table permissions
+	err = e.initPermissions()
+	if err != nil { return err }
+	err = e.initGroupCache()
+	if err != nil { return err }
 
 	//Start automigration thread
 	go e.autoMigrate()
@@ -143,8 +215,8 @@ func (e *Engine) Init(config *Config) (error){
 }
 
 //Use current stats to produce any necessary migration steps
-// For now, this will include only object field promotion
-// and table creation
+// For now, this will include only object field promotion,
+// table creation and foreign key declaration
 func (e *Engine) MigrationFromStats() ([]MigrationStep, error){
 	var steps []MigrationStep
 	e.GlobalStatsLock.Lock()
@@ -204,7 +276,10 @@ func (e *Engine) MigrationFromStats() ([]MigrationStep, error){
 			}
 		}
 	}
-	
+
+	//Declare any foreign keys
+	steps = append(steps, ForeignKeyMigrationSteps(e.Config, e.Schema, e.GlobalStats)...)
+
 	return steps, nil
 }
 
@@ -218,6 +293,28 @@ func (e *Engine) LoadSchema() error {
 	return err
 }
 
+//Immediately perform the migration suggested by the current stats,
+// rather than waiting for the next automatic migration.
+// Returns a description of each step performed.
+func (e *Engine) Migrate() ([]string, error){
+	err := e.flushStatsToDB()
+	if err != nil { return nil, err }
+	err = e.loadGlobalStats()
+	if err != nil { return nil, err }
+	err = e.LoadSchema()
+	if err != nil { return nil, err }
+	migration, err := e.MigrationFromStats()
+	if err != nil { return nil, err }
+	steps := make([]string, 0, len(migration))
+	for _, step := range migration {
+		steps = append(steps, step.ToString())
+	}
+	if len(migration) == 0 { return steps, nil }
+	err = e.DB.PerformMigration(migration)
+	if err != nil { return nil, err }
+	return steps, e.LoadSchema()
+}
+
 //Automatically create and perform migrations as stats update over time
 func (e *Engine) autoMigrate(){
 	//Reload schema directly, in case it's been changed by other nodes
@@ -238,6 +335,12 @@ func (e *Engine) autoMigrate(){
 	e.loadGlobalStats()
 	log.Println("Loaded global stats: ")
 	log.Println(e.GlobalStats)
+
+	//Refresh permissions
+	err = e.loadPermissions()
+	if err != nil { log.Println("Error loading permissions: " + err.Error()) }
+	err = e.refreshGroupCache()
+	if err != nil { log.Println("Error refreshing group cache: " + err.Error()) }
 	
 	//TODO: Make interval customizable
 	time.Sleep(30 * time.Second)
@@ -250,9 +353,32 @@ type RelationPath struct {
 	FromTable string
 	FromTablePrefix string
 	FromField string
+	//How FromTable references Table: RelationForward (FromField holds the
+	// id of a row in Table), RelationThrough (rows are linked by ThroughTable)
+	// or RelationReverse (ReverseField of Table holds the id of a row in FromTable)
+	Kind string
+	ThroughTable string
+	ReverseField string
 }
 
+const (
+	RelationForward = ""
+	RelationThrough = "through"
+	RelationReverse = "reverse"
+)
+
+//Returns the name of the through table linking `table` to the rows
+// of its many-to-many field `field`
+func throughTableName(table string, field string) string {
+	return "autoscope_m2m_" + table + "__" + field
+}
+
+//Perform a select query without checking permissions or logging stats
 func (e *Engine) RawSelect(query SelectQuery) (RetrievalResult, map[string]RelationPath, error){
+	return e.rawSelectOn(e.DB, query)
+}
+
+func (e *Engine) rawSelectOn(db AutoscopeQueryer, query SelectQuery) (RetrievalResult, map[string]RelationPath, error){
 	e.SchemaLock.RLock()
 	defer e.SchemaLock.RUnlock()
 
@@ -261,14 +387,21 @@ func (e *Engine) RawSelect(query SelectQuery) (RetrievalResult, map[string]Relat
 	e.GlobalStatsLock.RUnlock()
 	if err != nil { return nil, prefixes, err }
 
-	r, err := e.DB.Select(e.Schema, prefixes, query)
+	r, err := db.Select(e.Schema, prefixes, query)
 	return r, prefixes, err
 }
 
 //Perform a Select query using the engine
 func (e *Engine) Select(userId int64, query SelectQuery) (RetrievalResult, error){
+	return e.selectOn(e.DB, userId, query)
+}
+
+func (e *Engine) selectOn(db AutoscopeQueryer, userId int64, query SelectQuery) (RetrievalResult, error){
+	err := e.ValidateSelection(query.Table, query.Selection)
+	if err != nil { return nil, err }
+
 	//Modify query to encapsulate necessary permissions
-	perms, ok := e.GetTablePermissions(query.Table)
+	perms, ok := e.tablePermissionsOn(db, query.Table)
 	
 	//Use default permissions if no permissions exist
 	//if !ok { return nil, errors.New("No permissions for table "+query.Table) }
@@ -276,6 +409,8 @@ func (e *Engine) Select(userId int64, query SelectQuery) (RetrievalResult, error
 
 	groups, err := UserGroups(e, userId)
 	if err != nil { return nil, err }
+	query.Selection, err = e.restrictFieldSelection(query.Table, query.Selection, userId, groups)
+	if err != nil { return nil, err }
 	sel, allow := AddPermissionsToSelection(query.Selection,
 		perms, userId, groups, ReadAction)
 	if !allow {
@@ -285,33 +420,42 @@ func (e *Engine) Select(userId int64, query SelectQuery) (RetrievalResult, error
 	query.Selection = sel
 
 	//Perform query
-	r, prefixes, err := e.RawSelect(query)
+	r, prefixes, err := e.rawSelectOn(db, query)
+	if err == nil {
+		r = e.filterFields(query.Table, userId, groups, r)
+	}
 
 	//Update global stats
 	e.LocalStatsLock.Lock()
-	stats := e.LocalStats[query.Table]
+	local := e.statsFor(db)
+	stats := tableStats(local, query.Table)
 	//Update UpdateQueries stats
 	stats.SelectQueries += 1
 	//Update restriction stats
 	for _, prefix := range prefixes {
-		tstats, ok := e.LocalStats[prefix.FromTable]
-		if !ok {
-			tstats = defStats()
-		}
+		tstats := tableStats(local, prefix.FromTable)
 
 		if _, ok := tstats.Restrictions[prefix.FromField]; !ok {
 			tstats.Restrictions[prefix.FromField] = 0
 		}
 		tstats.Restrictions[prefix.FromField] += 1
-		e.LocalStats[prefix.FromTable] = tstats
+		local[prefix.FromTable] = tstats
 	}
-	e.LocalStats[query.Table] = stats
+	local[query.Table] = stats
 	e.LocalStatsLock.Unlock()
 
+	if err == nil && len(query.Expand) > 0 {
+		return e.expandRelations(db, userId, query, r)
+	}
 	return r, err
 }
 
+//Perform a delete query without checking permissions or logging stats
 func (e *Engine) RawDelete(query SelectQuery) (ModificationResult, map[string]RelationPath, error){
+	return e.rawDeleteOn(e.DB, query)
+}
+
+func (e *Engine) rawDeleteOn(db AutoscopeQueryer, query SelectQuery) (ModificationResult, map[string]RelationPath, error){
 	e.SchemaLock.RLock()
 	defer e.SchemaLock.RUnlock()
 
@@ -320,15 +464,22 @@ func (e *Engine) RawDelete(query SelectQuery) (ModificationResult, map[string]Re
 	e.GlobalStatsLock.RUnlock()
 	if err != nil { return nil, prefixes, err }
 
-	r, err := e.DB.Delete(e.Schema, prefixes, query)
+	r, err := db.Delete(e.Schema, prefixes, query)
 	return r, prefixes, err
 }
 
 
 //Perform a DELETE query using the engine
 func (e *Engine) Delete(userId int64, query SelectQuery) (ModificationResult, error){
+	return e.deleteOn(e.DB, userId, query)
+}
+
+func (e *Engine) deleteOn(db AutoscopeQueryer, userId int64, query SelectQuery) (ModificationResult, error){
+	err := e.ValidateSelection(query.Table, query.Selection)
+	if err != nil { return nil, err }
+
 	//Modify query to encapsulate necessary permissions
-	perms, ok := e.GetTablePermissions(query.Table)
+	perms, ok := e.tablePermissionsOn(db, query.Table)
 	
 	//Use default permissions if no permissions exist
 	//if !ok { return nil, errors.New("No permissions for table "+query.Table) }
@@ -336,8 +487,10 @@ func (e *Engine) Delete(userId int64, query SelectQuery) (ModificationResult, er
 
 	groups, err := UserGroups(e, userId)
 	if err != nil { return nil, err }
+	query.Selection, err = e.restrictFieldSelection(query.Table, query.Selection, userId, groups)
+	if err != nil { return nil, err }
 	sel, allow := AddPermissionsToSelection(query.Selection,
-		perms, userId, groups, UpdateAction)
+		perms, userId, groups, DeleteAction)
 	if !allow {
 		log.Println("Denying DELETE query due to restrictive permissions")
 		return EmptyModificationResult{}, nil
@@ -345,27 +498,25 @@ func (e *Engine) Delete(userId int64, query SelectQuery) (ModificationResult, er
 	query.Selection = sel
 
 	//Perform query
-	r, prefixes, err := e.RawDelete(query)
+	r, prefixes, err := e.rawDeleteOn(db, query)
 
 	//Update global stats
 	e.LocalStatsLock.Lock()
-	stats := e.LocalStats[query.Table]
+	local := e.statsFor(db)
+	stats := tableStats(local, query.Table)
 	//Update UpdateQueries stats
 	stats.DeleteQueries += 1
 	//Update restriction stats
 	for _, prefix := range prefixes {
-		tstats, ok := e.LocalStats[prefix.FromTable]
-		if !ok {
-			tstats = defStats()
-		}
+		tstats := tableStats(local, prefix.FromTable)
 
 		if _, ok := tstats.Restrictions[prefix.FromField]; !ok {
 			tstats.Restrictions[prefix.FromField] = 0
 		}
 		tstats.Restrictions[prefix.FromField] += 1
-		e.LocalStats[prefix.FromTable] = tstats
+		local[prefix.FromTable] = tstats
 	}
-	e.LocalStats[query.Table] = stats
+	local[query.Table] = stats
 	e.LocalStatsLock.Unlock()
 
 	return r, err
@@ -380,6 +531,10 @@ func (e *Engine) GetTablePermissions(tableName string) (ObjectPermissions, bool)
 
 //Perform an update query without checking authentication or logging stats
 func (e *Engine) RawUpdate(query UpdateQuery) (ModificationResult, map[string]RelationPath, error){
+	return e.rawUpdateOn(e.DB, query)
+}
+
+func (e *Engine) rawUpdateOn(db AutoscopeQueryer, query UpdateQuery) (ModificationResult, map[string]RelationPath, error){
 	e.SchemaLock.RLock()
 	defer e.SchemaLock.RUnlock()
 	
@@ -388,14 +543,27 @@ func (e *Engine) RawUpdate(query UpdateQuery) (ModificationResult, map[string]Re
 	e.GlobalStatsLock.RUnlock()
 	if err != nil { return nil, nil, err }	
 	
-	r, err := e.DB.Update(e.Schema, prefixes, query)
+	r, err := db.Update(e.Schema, prefixes, query)
 	return r, prefixes, err
 }
 
 //Perform an Update query using the engine
 func (e *Engine) Update(userId int64, query UpdateQuery) (ModificationResult, error){
+	return e.updateOn(e.DB, userId, query)
+}
+
+func (e *Engine) updateOn(db AutoscopeQueryer, userId int64, query UpdateQuery) (ModificationResult, error){
+	err := e.ValidateSelection(query.Table, query.Selection)
+	if err != nil { return nil, err }
+	if _, ok := query.Data["autoscope_uid"]; ok {
+		return nil, errors.New("The owner of rows may only be changed by Chown.")
+	}
+	if _, ok := query.Data["autoscope_gid"]; ok {
+		return nil, errors.New("The group of rows may only be changed by Chown.")
+	}
+
 	//Modify query to include security checks
-	perms, ok := e.GetTablePermissions(query.Table)
+	perms, ok := e.tablePermissionsOn(db, query.Table)
 
 	//Use default permissions if no permissions exist
 	//if !ok { return nil, errors.New("No permissions for table "+query.Table) }
@@ -403,6 +571,15 @@ func (e *Engine) Update(userId int64, query UpdateQuery) (ModificationResult, er
 
 	groups, err := UserGroups(e, userId)
 	if err != nil { return nil, err }
+	query.Selection, err = e.restrictFieldSelection(query.Table, query.Selection, userId, groups)
+	if err != nil { return nil, err }
+	fieldRestriction, err := e.restrictFieldUpdates(query.Table, query.Data, userId, groups)
+	if err != nil { return nil, err }
+	if fieldRestriction != nil && query.Selection == nil {
+		query.Selection = fieldRestriction
+	} else if fieldRestriction != nil {
+		query.Selection = And{ A: query.Selection, B: fieldRestriction }
+	}
 	sel, allow := AddPermissionsToSelection(query.Selection,
 		perms, userId, groups, UpdateAction)
 	if !allow {
@@ -410,11 +587,12 @@ func (e *Engine) Update(userId int64, query UpdateQuery) (ModificationResult, er
 	}
 	
 	query.Selection = sel
-	r, prefixes, err := e.RawUpdate(query)
+	r, prefixes, err := e.rawUpdateOn(db, query)
 
 	//Update global stats
 	e.LocalStatsLock.Lock()
-	stats := e.LocalStats[query.Table]
+	local := e.statsFor(db)
+	stats := tableStats(local, query.Table)
 	//Update UpdateQueries stats
 	stats.UpdateQueries += 1
 	//Update foreign key stats
@@ -429,18 +607,85 @@ func (e *Engine) Update(userId int64, query UpdateQuery) (ModificationResult, er
 	}
 	//Update restriction stats
 	for _, prefix := range prefixes {
-		tstats, ok := e.LocalStats[prefix.FromTable]
-		if !ok {
-			tstats = defStats()
-		}
+		tstats := tableStats(local, prefix.FromTable)
 
 		if _, ok := tstats.Restrictions[prefix.FromField]; !ok {
 			tstats.Restrictions[prefix.FromField] = 0
 		}
 		tstats.Restrictions[prefix.FromField] += 1
-		e.LocalStats[prefix.FromTable] = tstats
+		local[prefix.FromTable] = tstats
 	}
-	e.LocalStats[query.Table] = stats
+	local[query.Table] = stats
+	e.LocalStatsLock.Unlock()
+	return r, err
+}
+
+//Change the owner and/or group of rows using the engine. Only the owner of
+// a row may change them, given update permissions on the row, and rows may
+// only be given to groups the user is a member of. Admins may change the
+// owner and group of any row.
+func (e *Engine) Chown(userId int64, query ChownQuery) (ModificationResult, error){
+	return e.chownOn(e.DB, userId, query)
+}
+
+func (e *Engine) chownOn(db AutoscopeQueryer, userId int64, query ChownQuery) (ModificationResult, error){
+	if query.Owner == nil && query.Group == nil {
+		return nil, errors.New("No owner or group given.")
+	}
+	err := e.ValidateSelection(query.Table, query.Selection)
+	if err != nil { return nil, err }
+
+	admin, err := IsAdmin(e, userId)
+	if err != nil { return nil, err }
+	groups, err := UserGroups(e, userId)
+	if err != nil { return nil, err }
+
+	data := make(map[string]interface{}, 2)
+	if query.Owner != nil {
+		//The rows must be released before updating on the same queryer
+		res, _, err := e.rawSelectOn(db, Filter("autoscope_users", map[string]interface{}{
+			"id": *query.Owner,
+		}))
+		if err != nil { return nil, err }
+		_, ok, err := FirstRow(res)
+		if err != nil { return nil, err }
+		if !ok {
+			return nil, errors.New("No user with ID " + strconv.FormatInt(*query.Owner, 10) + ".")
+		}
+		data["autoscope_uid"] = *query.Owner
+	}
+	if query.Group != nil {
+		if !admin && !listContainsInt64(groups, *query.Group) {
+			return nil, errors.New("User is not a member of group " + strconv.FormatInt(*query.Group, 10) + ".")
+		}
+		data["autoscope_gid"] = *query.Group
+	}
+
+	selection := query.Selection
+	if !admin {
+		perms, ok := e.tablePermissionsOn(db, query.Table)
+		if !ok { perms = DefaultPermissions() }
+		selection, err = e.restrictFieldSelection(query.Table, selection, userId, groups)
+		if err != nil { return nil, err }
+		sel, allow := AddPermissionsToSelection(selection,
+			perms, userId, groups, UpdateAction)
+		if !allow {
+			return EmptyModificationResult{}, nil
+		}
+		selection = And{ A: sel, B: ValueSelection{ Attr: "autoscope_uid", Value: userId, Op: "=" } }
+	}
+
+	r, _, err := e.rawUpdateOn(db, UpdateQuery{
+		Table: query.Table,
+		Selection: selection,
+		Data: data,
+	})
+
+	e.LocalStatsLock.Lock()
+	local := e.statsFor(db)
+	stats := tableStats(local, query.Table)
+	stats.UpdateQueries += 1
+	local[query.Table] = stats
 	e.LocalStatsLock.Unlock()
 	return r, err
 }
@@ -452,18 +697,62 @@ func (e *Engine) RawInsert(query InsertQuery) (ModificationResult, error){
 
 //Perform an Insert query using the engine
 func (e *Engine) Insert(userId int64, query InsertQuery) (ModificationResult, error){
+	return e.insertOn(e.DB, userId, query)
+}
+
+func (e *Engine) insertOn(db AutoscopeQueryer, userId int64, query InsertQuery) (ModificationResult, error){
+	//Nested objects and many-to-many fields are inserted into their related
+	// tables, in the same transaction as the object referencing them
+	manyToMany := e.manyToManyFields(query)
+	if !hasNestedObjects(query.Data) && len(manyToMany) == 0 {
+		return e.insertRowOn(db, userId, query)
+	}
+	if _, ok := db.(AutoscopeTx); !ok {
+		//Through tables can't be created within a transaction,
+		// so create them beforehand
+		err := e.createThroughTables(query.Table, manyToMany)
+		if err != nil { return nil, err }
+
+		tx, err := e.DB.Begin()
+		if err != nil { return nil, err }
+		r, err := e.insertOn(tx, userId, query)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		return r, tx.Commit()
+	}
+	//Within a transaction, they must already exist
+	err := e.checkThroughTables(query.Table, manyToMany)
+	if err != nil { return nil, err }
+
+	foreignKeys := make(map[string]string, len(query.ForeignKeys))
+	for k, v := range query.ForeignKeys {
+		foreignKeys[k] = v
+	}
+	query.ForeignKeys = foreignKeys
+	err = e.insertNestedObjects(db, userId, &query)
+	if err != nil { return nil, err }
+	links, err := e.resolveManyToMany(db, userId, &query, manyToMany)
+	if err != nil { return nil, err }
+
+	r, err := e.insertRowOn(db, userId, query)
+	if err != nil { return r, err }
+	err = e.insertLinks(db, userId, query.Table, r, links)
+	return r, err
+}
+
+//Insert a single row, after nested objects have been handled
+func (e *Engine) insertRowOn(db AutoscopeQueryer, userId int64, query InsertQuery) (ModificationResult, error){
 	e.SchemaLock.RLock()
 	defer e.SchemaLock.RUnlock()
 
 	//If no permissions exist for table, setup default permissions
-	e.PermissionsLock.Lock()
-	_, ok := e.Permissions[query.Table]; if !ok {
-		e.Permissions[query.Table] = DefaultPermissions()
-	}
-	e.PermissionsLock.Unlock()
+	err := e.claimTable(db, query.Table, userId)
+	if err != nil { return nil, err }
 	
 	//Check permissions before inserting
-	perms, err := HasInsertPermissions(e, query.Table, userId)
+	perms, err := hasInsertPermissionsOn(e, db, query.Table, userId)
 	if err != nil { return nil, err }
 	if !perms {
 		log.Println("PERM ERRORS")
@@ -472,14 +761,21 @@ func (e *Engine) Insert(userId int64, query InsertQuery) (ModificationResult, er
 		log.Println(userId)
 		return nil, errors.New("User does not have permissions to insert into this table.")
 	}
+	groups, err := UserGroups(e, userId)
+	if err != nil { return nil, err }
+	err = e.setRowGroup(query.Table, query.Group, groups, query.Data)
+	if err != nil { return nil, err }
+	err = e.checkFieldInserts(query.Table, query.Data, userId, groups)
+	if err != nil { return nil, err }
 
 	//Set row owner to current user
 	query.Data["autoscope_uid"] = userId
 	
-	r, err := e.RawInsert(query)
+	r, err := db.Insert(e.Schema, query)
 
 	e.LocalStatsLock.Lock()
-	stats := e.LocalStats[query.Table]
+	local := e.statsFor(db)
+	stats := tableStats(local, query.Table)
 	//Update InsertQueries stats
 	stats.InsertQueries += 1
 	//Update foreign key stats
@@ -492,7 +788,416 @@ func (e *Engine) Insert(userId int64, query InsertQuery) (ModificationResult, er
 		ty := TypeFromValue(v)
 		stats.ObjectFieldCount = incrementCountMap(stats.ObjectFieldCount, k, ty)
 	}
-	e.LocalStats[query.Table] = stats
+	local[query.Table] = stats
+	e.LocalStatsLock.Unlock()
+
+	return r, err
+}
+
+//Set the group of a row to be inserted into `tableName`: `group` if given,
+// which must be one of the user's `groups`, and otherwise the table's
+// default group. Rows of tables without groups have no group.
+func (e *Engine) setRowGroup(tableName string, group *int64, groups []int64, data map[string]interface{}) error {
+	if group != nil {
+		if !listContainsInt64(groups, *group) {
+			return errors.New("User is not a member of group " + strconv.FormatInt(*group, 10) + ".")
+		}
+		data["autoscope_gid"] = *group
+		return nil
+	}
+	gid, ok, err := DefaultTableGroup(e, tableName)
+	if err != nil { return err }
+	if ok {
+		data["autoscope_gid"] = gid
+	} else {
+		delete(data, "autoscope_gid")
+	}
+	return nil
+}
+
+//Whether any value in `data` is a nested object
+func hasNestedObjects(data map[string]interface{}) bool {
+	for _, val := range data {
+		if _, ok := val.(map[string]interface{}); ok { return true }
+	}
+	return false
+}
+
+//Insert each nested object of `query` into its related table, replacing it
+// with the new row's id. Objects whose table can't be determined from
+// query.ForeignKeys or the foreign key stats are kept as JSON values.
+func (e *Engine) insertNestedObjects(db AutoscopeQueryer, userId int64, query *InsertQuery) error {
+	for field, val := range query.Data {
+		obj, ok := val.(map[string]interface{})
+		if !ok { continue }
+		table, ok := e.relatedTable(query.Table, query.ForeignKeys, field)
+		if !ok { continue }
+
+		id, err := e.insertRelated(db, userId, table, obj, query.LookupKeys[field])
+		if err != nil { return err }
+		query.Data[field] = id
+		if query.ForeignKeys == nil {
+			query.ForeignKeys = make(map[string]string, 0)
+		}
+		query.ForeignKeys[field] = table
+	}
+	return nil
+}
+
+//Determine which table `field` of `tableName` refers to: the one given
+// in foreignKeys, or otherwise the one it most often refers to
+func (e *Engine) relatedTable(tableName string, foreignKeys map[string]string, field string) (string, bool) {
+	if table, ok := foreignKeys[field]; ok {
+		return table, true
+	}
+	e.GlobalStatsLock.RLock()
+	defer e.GlobalStatsLock.RUnlock()
+	table := ""
+	var maxCount int64
+	for t, count := range e.GlobalStats[tableName].ForeignKeyCount[field] {
+		if count > maxCount || (count == maxCount && t < table) {
+			table = t
+			maxCount = count
+		}
+	}
+	return table, table != ""
+}
+
+//Return the elements of `val` if it is a list
+func listValues(val interface{}) ([]interface{}, bool) {
+	switch v := val.(type) {
+	case []interface{}:
+		return v, true
+	case []int64:
+		l := make([]interface{}, len(v))
+		for i, x := range v { l[i] = x }
+		return l, true
+	case []map[string]interface{}:
+		l := make([]interface{}, len(v))
+		for i, x := range v { l[i] = x }
+		return l, true
+	}
+	return nil, false
+}
+
+//Convert an id given as any numeric type to an int64
+func idValue(val interface{}) (int64, bool) {
+	switch v := val.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case float64:
+		return int64(v), float64(int64(v)) == v
+	}
+	return 0, false
+}
+
+//Return the many-to-many fields of `query` mapped to the tables they
+// reference. A many-to-many field holds a list of objects and/or ids of
+// another table, given by query.ForeignKeys or by the stats of its through
+// table. Lists for which no table is known are stored as JSON values.
+func (e *Engine) manyToManyFields(query InsertQuery) map[string]string {
+	fields := make(map[string]string, 0)
+	for field, val := range query.Data {
+		elements, ok := listValues(val)
+		if !ok { continue }
+		valid := true
+		for _, el := range elements {
+			_, isObject := el.(map[string]interface{})
+			_, isId := idValue(el)
+			if !isObject && !isId { valid = false }
+		}
+		if !valid { continue }
+
+		table, ok := query.ForeignKeys[field]
+		if !ok {
+			e.GlobalStatsLock.RLock()
+			table = maxKey(e.GlobalStats[throughTableName(query.Table, field)].ForeignKeyCount["to_id"])
+			e.GlobalStatsLock.RUnlock()
+		}
+		if table != "" {
+			fields[field] = table
+		}
+	}
+	return fields
+}
+
+//Create any missing through tables for the given many-to-many fields
+func (e *Engine) createThroughTables(tableName string, fields map[string]string) error {
+	steps := make([]MigrationStep, 0)
+	e.SchemaLock.RLock()
+	for field, _ := range fields {
+		through := throughTableName(tableName, field)
+		if _, ok := e.Schema[through]; ok { continue }
+		steps = append(steps, MigrationStepCreateTable{
+			tableName: through,
+			table: AddDefaultFields(Table{
+				Name: through,
+				Columns: map[string]string{ "from_id": "bigint", "to_id": "bigint" },
+			}),
+		})
+	}
+	e.SchemaLock.RUnlock()
+	if len(steps) == 0 { return nil }
+
+	err := e.DB.PerformMigration(steps)
+	if err != nil { return err }
+	return e.LoadSchema()
+}
+
+//Return an error if the through table of any of the given many-to-many
+// fields doesn't exist yet
+func (e *Engine) checkThroughTables(tableName string, fields map[string]string) error {
+	e.SchemaLock.RLock()
+	defer e.SchemaLock.RUnlock()
+	for field, _ := range fields {
+		through := throughTableName(tableName, field)
+		if _, ok := e.Schema[through]; !ok {
+			return errors.New("Many-to-many field " + field + " of " + tableName +
+				" can't be used for the first time within a transaction, since its through table " +
+				through + " doesn't exist yet.")
+		}
+	}
+	return nil
+}
+
+//Rows of a many-to-many field to be linked to a newly inserted row
+type manyToManyLink struct {
+	Table string
+	Ids []int64
+}
+
+//Insert the objects of each many-to-many field into its table, and remove
+// the field from the query. Returns the ids to link the new row to.
+func (e *Engine) resolveManyToMany(db AutoscopeQueryer, userId int64, query *InsertQuery, fields map[string]string) (map[string]manyToManyLink, error) {
+	links := make(map[string]manyToManyLink, len(fields))
+	for field, table := range fields {
+		elements, _ := listValues(query.Data[field])
+		link := manyToManyLink{ Table: table, Ids: make([]int64, 0, len(elements)) }
+		for _, el := range elements {
+			if obj, ok := el.(map[string]interface{}); ok {
+				id, err := e.insertRelated(db, userId, table, obj, query.LookupKeys[field])
+				if err != nil { return nil, err }
+				link.Ids = append(link.Ids, id)
+			} else {
+				id, _ := idValue(el)
+				link.Ids = append(link.Ids, id)
+			}
+		}
+		links[field] = link
+		delete(query.Data, field)
+		delete(query.ForeignKeys, field)
+	}
+	return links, nil
+}
+
+//Link a newly inserted row to the rows of its many-to-many fields.
+// Through tables are bookkeeping: permission to insert the row is
+// permission to link it, so links are inserted without permission checks
+// and through tables are never claimed by whoever first links a row.
+func (e *Engine) insertLinks(db AutoscopeQueryer, userId int64, tableName string, r ModificationResult, links map[string]manyToManyLink) error {
+	if len(links) == 0 { return nil }
+	fromId, err := r.LastInsertId()
+	if err != nil { return err }
+	e.SchemaLock.RLock()
+	defer e.SchemaLock.RUnlock()
+	for field, link := range links {
+		if len(link.Ids) == 0 { continue }
+		rows := make([]map[string]interface{}, 0, len(link.Ids))
+		for _, toId := range link.Ids {
+			rows = append(rows, map[string]interface{}{
+				"from_id": fromId,
+				"to_id": toId,
+				"autoscope_uid": userId,
+			})
+		}
+		query := BatchInsertQuery{
+			Table: throughTableName(tableName, field),
+			Data: rows,
+			ForeignKeys: map[string]string{ "from_id": tableName, "to_id": link.Table },
+		}
+		_, err := db.InsertBatch(e.Schema, query)
+		if err != nil { return err }
+		e.recordBatchStats(db, query)
+	}
+	return nil
+}
+
+//Insert a related object, or if lookup keys are given, find the existing
+// object with the same key values and only insert it if there is none.
+// Returns the object's id.
+func (e *Engine) insertRelated(db AutoscopeQueryer, userId int64, table string, obj map[string]interface{}, keys []string) (int64, error) {
+	if len(keys) == 0 {
+		r, err := e.insertOn(db, userId, InsertQuery{ Table: table, Data: obj })
+		if err != nil { return -1, err }
+		return r.LastInsertId()
+	}
+
+	//Never update an existing object: only create it if it doesn't exist
+	query := UpsertQuery{
+		Table: table,
+		Keys: keys,
+		Data: obj,
+		Restriction: Not{ A: Tautology{} },
+	}
+	r, err := e.upsertOn(db, userId, query)
+	if err != nil { return -1, err }
+	if n, err := r.RowsAffected(); err == nil && n > 0 {
+		return r.LastInsertId()
+	}
+	res, err := e.selectOn(db, userId, SelectQuery{
+		Table: table,
+		Selection: upsertKeySelection(query),
+	})
+	if err != nil { return -1, err }
+	row, err := GetRow(res)
+	if err != nil {
+		return -1, errors.New("Unable to find existing " + table + " object")
+	}
+	return row["id"].(int64), nil
+}
+
+//Insert many rows into a table at once. Returns the ids of the inserted
+// rows, in the same order as query.Data.
+func (e *Engine) InsertBatch(userId int64, query BatchInsertQuery) ([]int64, error){
+	return e.insertBatchOn(e.DB, userId, query)
+}
+
+func (e *Engine) insertBatchOn(db AutoscopeQueryer, userId int64, query BatchInsertQuery) ([]int64, error){
+	e.SchemaLock.RLock()
+	defer e.SchemaLock.RUnlock()
+
+	//If no permissions exist for table, setup default permissions
+	err := e.claimTable(db, query.Table, userId)
+	if err != nil { return nil, err }
+
+	//Check permissions once for the whole batch
+	perms, err := hasInsertPermissionsOn(e, db, query.Table, userId)
+	if err != nil { return nil, err }
+	if !perms {
+		return nil, errors.New("User does not have permissions to insert into this table.")
+	}
+	groups, err := UserGroups(e, userId)
+	if err != nil { return nil, err }
+	for _, row := range query.Data {
+		err = e.setRowGroup(query.Table, query.Group, groups, row)
+		if err != nil { return nil, err }
+		err = e.checkFieldInserts(query.Table, row, userId, groups)
+		if err != nil { return nil, err }
+	}
+
+	//Set row owner to current user
+	for _, row := range query.Data {
+		row["autoscope_uid"] = userId
+	}
+
+	ids, err := db.InsertBatch(e.Schema, query)
+	e.recordBatchStats(db, query)
+	return ids, err
+}
+
+//Record the stats of a batch of rows inserted into query.Table.
+// Stats for the whole batch are aggregated under a single lock.
+func (e *Engine) recordBatchStats(db AutoscopeQueryer, query BatchInsertQuery) {
+	e.LocalStatsLock.Lock()
+	local := e.statsFor(db)
+	stats := tableStats(local, query.Table)
+	stats.InsertQueries += int64(len(query.Data))
+	for _, row := range query.Data {
+		for field, table := range query.ForeignKeys {
+			if _, ok := row[field]; ok {
+				stats.ForeignKeyCount = incrementCountMap(stats.ForeignKeyCount, field, table)
+			}
+		}
+		for k, v := range row {
+			ty := TypeFromValue(v)
+			stats.ObjectFieldCount = incrementCountMap(stats.ObjectFieldCount, k, ty)
+		}
+	}
+	local[query.Table] = stats
+	e.LocalStatsLock.Unlock()
+}
+
+//Insert a row, or update the existing row with the same values in its key
+// fields. Requires insert permissions on the table; an existing row is
+// only updated if the user has permission to update it.
+func (e *Engine) Upsert(userId int64, query UpsertQuery) (ModificationResult, error){
+	return e.upsertOn(e.DB, userId, query)
+}
+
+func (e *Engine) upsertOn(db AutoscopeQueryer, userId int64, query UpsertQuery) (ModificationResult, error){
+	groups, err := UserGroups(e, userId)
+	if err != nil { return nil, err }
+
+	e.SchemaLock.RLock()
+	defer e.SchemaLock.RUnlock()
+
+	//If no permissions exist for table, setup default permissions
+	err = e.claimTable(db, query.Table, userId)
+	if err != nil { return nil, err }
+	perms, _ := e.tablePermissionsOn(db, query.Table)
+
+	allowed, err := hasInsertPermissionsOn(e, db, query.Table, userId)
+	if err != nil { return nil, err }
+	if !allowed {
+		return nil, errors.New("User does not have permissions to insert into this table.")
+	}
+	err = e.setRowGroup(query.Table, query.Group, groups, query.Data)
+	if err != nil { return nil, err }
+	err = e.checkFieldInserts(query.Table, query.Data, userId, groups)
+	if err != nil { return nil, err }
+	restriction, allow := AddPermissionsToSelection(Tautology{},
+		perms, userId, groups, UpdateAction)
+	//Existing rows may only be updated if their fields may be too
+	updated := make(map[string]interface{}, len(query.Data) + len(query.Increments))
+	for k, v := range query.Data {
+		if !listContains(query.Keys, k) { updated[k] = v }
+	}
+	for k, v := range query.Increments {
+		updated[k] = v
+	}
+	fieldRestriction, fieldErr := e.restrictFieldUpdates(query.Table, updated, userId, groups)
+	if !allow || fieldErr != nil {
+		//No existing row may be updated
+		restriction = Not{ A: Tautology{} }
+	} else if fieldRestriction != nil {
+		restriction = And{ A: restriction, B: fieldRestriction }
+	}
+	if query.Restriction != nil {
+		restriction = And{ A: query.Restriction, B: restriction }
+	}
+	query.Restriction = restriction
+	//Rules may make the restriction relational, e.g. venue__owner = $uid
+	e.GlobalStatsLock.RLock()
+	prefixes, err := genPrefixes(e.Schema, e.GlobalStats, query.Table, query.Restriction)
+	e.GlobalStatsLock.RUnlock()
+	if err != nil { return nil, err }
+
+	//Set row owner to current user. This only applies to inserted rows.
+	query.Data["autoscope_uid"] = userId
+
+	r, err := db.Upsert(e.Schema, prefixes, query)
+
+	e.LocalStatsLock.Lock()
+	local := e.statsFor(db)
+	stats := tableStats(local, query.Table)
+	stats.InsertQueries += 1
+	for field, table := range query.ForeignKeys {
+		stats.ForeignKeyCount = incrementCountMap(stats.ForeignKeyCount, field, table)
+	}
+	for k, v := range query.Data {
+		ty := TypeFromValue(v)
+		stats.ObjectFieldCount = incrementCountMap(stats.ObjectFieldCount, k, ty)
+	}
+	//Keys are used to look up rows, just like restrictions
+	if stats.Restrictions == nil { stats.Restrictions = make(map[string]int64, 0) }
+	for _, key := range query.Keys {
+		stats.Restrictions[key] += 1
+	}
+	local[query.Table] = stats
 	e.LocalStatsLock.Unlock()
 
 	return r, err
@@ -510,6 +1215,72 @@ func defStats() TableQueryStats {
 	}
 }
 
+//Return the field of `table` referencing `target`, or "" if there is none.
+// Declared foreign keys take precedence, as in genPrefixes; otherwise the
+// field most often seen referencing `target` is used.
+func reverseForeignKey(schema map[string]Table, stats map[string]TableQueryStats, table string, target string) string {
+	field := ""
+	for f, fk := range schema[table].ForeignKeys {
+		if fk.Table == target && (field == "" || f < field) {
+			field = f
+		}
+	}
+	if field != "" { return field }
+	count := int64(0)
+	for f, tables := range stats[table].ForeignKeyCount {
+		c := tables[target]
+		if c > count || (c == count && c > 0 && f < field) {
+			field = f
+			count = c
+		}
+	}
+	return field
+}
+
+//Return the stats to which queries on `db` are recorded: those of the
+// transaction if `db` is one, so that they only count once it commits,
+// or LocalStats otherwise. Callers must hold LocalStatsLock.
+func (e *Engine) statsFor(db AutoscopeQueryer) map[string]TableQueryStats {
+	if tx, ok := db.(*engineTx); ok { return tx.stats }
+	return e.LocalStats
+}
+
+//Merge the stats recorded within a committed transaction into LocalStats
+func (e *Engine) mergeStats(tx *engineTx) {
+	e.LocalStatsLock.Lock()
+	defer e.LocalStatsLock.Unlock()
+	for table, txStats := range tx.stats {
+		stats := tableStats(e.LocalStats, table)
+		stats.InsertQueries += txStats.InsertQueries
+		stats.SelectQueries += txStats.SelectQueries
+		stats.UpdateQueries += txStats.UpdateQueries
+		stats.DeleteQueries += txStats.DeleteQueries
+		for field, n := range txStats.Restrictions {
+			stats.Restrictions[field] += n
+		}
+		addCountMap(stats.ObjectFieldCount, txStats.ObjectFieldCount)
+		addCountMap(stats.ForeignKeyCount, txStats.ForeignKeyCount)
+		e.LocalStats[table] = stats
+	}
+}
+
+//Return the stats of `table` in `m`, with every map initialized.
+// Callers must hold LocalStatsLock.
+func tableStats(m map[string]TableQueryStats, table string) TableQueryStats {
+	stats, ok := m[table]
+	if !ok { return defStats() }
+	if stats.Restrictions == nil {
+		stats.Restrictions = make(map[string]int64, 0)
+	}
+	if stats.ObjectFieldCount == nil {
+		stats.ObjectFieldCount = make(map[string]map[string]int64, 0)
+	}
+	if stats.ForeignKeyCount == nil {
+		stats.ForeignKeyCount = make(map[string]map[string]int64, 0)
+	}
+	return stats
+}
+
 func (e *Engine) loadGlobalStats() error {
 	e.GlobalStatsLock.Lock()
 	defer e.GlobalStatsLock.Unlock()
@@ -670,57 +1441,19 @@ func (e *Engine) flushStatsToDB() error {
 // If no row is present, incrementColumns will insert the appropriate row with 1 values
 // in counter columns.
 func (e *Engine) IncrementColumns(tableName string, restrictions map[string]interface{}, columns map[string]int64) error {
-	//TODO: Obtain inter-node lock on this table + restriction hash
-	// For databases offering transactions, those could be used instead
-
-	//Convert restriction map type
-	selection := MapToAnds(restrictions)
-	query := SelectQuery{
-		Table: tableName,
-		Selection: selection,
-	}
-	//Pull out the appropriate row
-	res, err := e.DB.Select(e.Schema, nil, query)
-	if err != nil {	return err }
-
-	if res.Next() {
-		//Row exists: Increment relevant columns and update
-		row, err := res.Get()
-		if err != nil { return err }
-		for k, v := range row {
-			if quantity, ok := columns[k]; ok {
-				//Ensure that the internal type of this column is int64
-				switch v.(type) {
-				case int64:
-					break
-				default:
-					return errors.New("Cannot increment column unless it's an integer ("+tableName+"."+k+")")
-				}
-				//Increment the value
-				row[k] = v.(int64) + quantity
-			}
-		}
-		query := UpdateQuery{
-			Table: tableName,
-			Selection: selection,
-			Data: row,
-		}
-		_, err = e.DB.Update(e.Schema, nil, query)
-		if err != nil { return err }
-
-	} else {
-		//Insert a new row with the given restrictions, initializing all values to 1
-		for col, quantity := range columns {
-			restrictions[col] = quantity
-		}
-		query := InsertQuery {
-			Table: tableName,
-			Data: restrictions,
-		}
-		_, err = e.DB.Insert(e.Schema, query)
-		if err != nil { return err }
+	keys := make([]string, 0, len(restrictions))
+	for k, _ := range restrictions {
+		keys = append(keys, k)
 	}
-	return nil
+	e.SchemaLock.RLock()
+	defer e.SchemaLock.RUnlock()
+	_, err := e.DB.Upsert(e.Schema, nil, UpsertQuery{
+		Table: tableName,
+		Keys: keys,
+		Data: restrictions,
+		Increments: columns,
+	})
+	return err
 }
 
 // Update the stats regarding how often certain fields are used as foriegn keys
@@ -826,8 +1559,36 @@ func genPrefixes(schema map[string]Table, stats map[string]TableQueryStats, tabl
 					startTable = prefixes[startPrefix].Table
 				}
 
-				//Determine which table is next using tableStats
+				//Determine which table is next, using the declared
+				// foreign key if there is one, or tableStats otherwise
 				nextTable := maxKey(stats[startTable].ForeignKeyCount[startField])
+				if fk, ok := schema[startTable].ForeignKeys[startField]; ok {
+					nextTable = fk.Table
+				}
+
+				//If the field isn't a foreign key, it may be a
+				// many-to-many field linked through a through table
+				kind := RelationForward
+				throughTable := ""
+				if nextTable == "" {
+					through := throughTableName(startTable, startField)
+					if target := maxKey(stats[through].ForeignKeyCount["to_id"]); target != "" {
+						nextTable = target
+						kind = RelationThrough
+						throughTable = through
+					}
+				}
+
+				//Otherwise the field may name a table referencing this one,
+				// e.g. venue.events for events.venue
+				reverseField := ""
+				if nextTable == "" {
+					reverseField = reverseForeignKey(schema, stats, startField, startTable)
+					if reverseField != "" {
+						nextTable = startField
+						kind = RelationReverse
+					}
+				}
 
 				//Determine the prefix of the table we're referenced from
 				fromTablePrefix := startPrefix
@@ -840,6 +1601,9 @@ func genPrefixes(schema map[string]Table, stats map[string]TableQueryStats, tabl
 					FromTable: startTable,
 					FromTablePrefix: fromTablePrefix,
 					FromField: startField,
+					Kind: kind,
+					ThroughTable: throughTable,
+					ReverseField: reverseField,
 				}
 			}
 		}
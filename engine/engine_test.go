@@ -321,3 +321,410 @@ func TestMigration(t *testing.T){
 	}
 
 }
+
+func TestInsertBatch(t *testing.T){
+	var e Engine
+	config := Config{
+		DatabaseType: "memdb",
+	}
+	err := e.Init(&config)
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "batchUser", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	rows := make([]map[string]interface{}, 0)
+	for i := 0; i < 5; i++ {
+		rows = append(rows, map[string]interface{}{ "intcol": i, "fkcol": 0 })
+	}
+	ids, err := e.InsertBatch(uid, BatchInsertQuery{
+		Table: "batch_table",
+		Data: rows,
+		ForeignKeys: map[string]string{ "fkcol": "other_table" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if len(ids) != 5 { t.Fatal("Incorrect number of ids returned") }
+
+	//Ids must be returned in the order rows were given
+	for i, id := range ids {
+		res, err := e.Select(uid, Filter("batch_table", map[string]interface{}{ "id": id }))
+		if err != nil { t.Fatal(err.Error()) }
+		row, err := GetRow(res)
+		if err != nil { t.Fatal(err.Error()) }
+		if row["intcol"].(int64) != int64(i) { t.Fatal("Ids returned out of order") }
+	}
+
+	stats := e.LocalStats["batch_table"]
+	if stats.InsertQueries != 5 ||
+		stats.ObjectFieldCount["intcol"]["int"] != 5 ||
+		stats.ForeignKeyCount["fkcol"]["other_table"] != 5 {
+		t.Fatal("Incorrect stats for batch insert")
+	}
+}
+
+func TestUpsert(t *testing.T){
+	var e Engine
+	config := Config{
+		DatabaseType: "memdb",
+	}
+	err := e.Init(&config)
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "upsertUser", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	var firstId int64
+	for i := 0; i < 3; i++ {
+		res, err := e.Upsert(uid, UpsertQuery{
+			Table: "upsert_table",
+			Keys: []string{"name"},
+			Data: map[string]interface{}{ "name": "counter", "label": i },
+			Increments: map[string]int64{ "count": 2 },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+		id, _ := res.LastInsertId()
+		if i == 0 { firstId = id }
+		if id != firstId { t.Fatal("Upsert did not update the existing row") }
+	}
+
+	res, err := e.Select(uid, Filter("upsert_table", map[string]interface{}{ "name": "counter" }))
+	if err != nil { t.Fatal(err.Error()) }
+	row, err := GetRow(res)
+	if err != nil { t.Fatal(err.Error()) }
+	if res.Next() { t.Fatal("Upsert created duplicate rows") }
+	if row["count"].(int64) != 6 || row["label"].(int64) != 2 {
+		t.Fatal("Incorrect values after upsert")
+	}
+
+	//Rows the user may not update are left untouched
+	otherId, err := CreateUser(&e, "otherUser", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	//Members of the table's groups may insert, but not update
+	gid, err := CreateGroup(&e, "upsert_inserters")
+	if err != nil { t.Fatal(err.Error()) }
+	err = AddUserToGroup(&e, otherId, gid)
+	if err != nil { t.Fatal(err.Error()) }
+	err = AddTableGroup(&e, "upsert_table", gid)
+	if err != nil { t.Fatal(err.Error()) }
+	mr, err := e.Upsert(otherId, UpsertQuery{
+		Table: "upsert_table",
+		Keys: []string{"name"},
+		Data: map[string]interface{}{ "name": "counter", "label": 10 },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if n, _ := mr.RowsAffected(); n != 0 {
+		t.Fatal("Upsert updated a row without permission")
+	}
+}
+
+func TestNestedInsert(t *testing.T){
+	var e Engine
+	config := Config{
+		DatabaseType: "memdb",
+	}
+	err := e.Init(&config)
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "nestedUser", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	//Both paintings must reference the same artist, looked up by name
+	for _, name := range []string{"Sunflowers", "Irises"} {
+		_, err = e.Insert(uid, InsertQuery{
+			Table: "paintings",
+			Data: map[string]interface{}{
+				"name": name,
+				"artist": map[string]interface{}{ "name": "Vincent" },
+			},
+			ForeignKeys: map[string]string{ "artist": "artists" },
+			LookupKeys: map[string][]string{ "artist": []string{"name"} },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+	}
+
+	res, err := e.Select(uid, SelectQuery{ Table: "artists", Selection: Tautology{} })
+	if err != nil { t.Fatal(err.Error()) }
+	artist, err := GetRow(res)
+	if err != nil { t.Fatal(err.Error()) }
+	if res.Next() { t.Fatal("Related object inserted twice") }
+
+	res, err = e.Select(uid, SelectQuery{ Table: "paintings", Selection: Tautology{} })
+	if err != nil { t.Fatal(err.Error()) }
+	for res.Next() {
+		painting, err := res.Get()
+		if err != nil { t.Fatal(err.Error()) }
+		if painting["artist"] != artist["id"] {
+			t.Fatal("Painting does not reference its artist")
+		}
+	}
+	if e.LocalStats["paintings"].ForeignKeyCount["artist"]["artists"] != 2 {
+		t.Fatal("Foreign key stats not updated")
+	}
+
+	//Without a known table, nested objects are stored as they are
+	_, err = e.Insert(uid, InsertQuery{
+		Table: "paintings",
+		Data: map[string]interface{}{
+			"name": "Untitled",
+			"dimensions": map[string]interface{}{ "width": 2 },
+		},
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	res, err = e.Select(uid, Filter("paintings", map[string]interface{}{ "name": "Untitled" }))
+	if err != nil { t.Fatal(err.Error()) }
+	painting, err := GetRow(res)
+	if err != nil { t.Fatal(err.Error()) }
+	if _, ok := painting["dimensions"].(map[string]interface{}); !ok {
+		t.Fatal("Nested object without a table not stored as JSON")
+	}
+}
+
+func TestManyToMany(t *testing.T){
+	var e Engine
+	config := Config{
+		DatabaseType: "memdb",
+	}
+	err := e.Init(&config)
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "m2mUser", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	r, err := e.Insert(uid, InsertQuery{
+		Table: "artists",
+		Data: map[string]interface{}{ "name": "Bob" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	bob, err := r.LastInsertId()
+	if err != nil { t.Fatal(err.Error()) }
+
+	//Lists may mix new objects and ids of existing rows
+	r, err = e.Insert(uid, InsertQuery{
+		Table: "bands",
+		Data: map[string]interface{}{
+			"name": "Trio",
+			"artists": []interface{}{ map[string]interface{}{ "name": "Ann" }, bob },
+		},
+		ForeignKeys: map[string]string{ "artists": "artists" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	trio, err := r.LastInsertId()
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = e.Insert(uid, InsertQuery{
+		Table: "bands",
+		Data: map[string]interface{}{
+			"name": "Solo",
+			"artists": []interface{}{ bob },
+		},
+		ForeignKeys: map[string]string{ "artists": "artists" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = e.Insert(uid, InsertQuery{
+		Table: "events",
+		Data: map[string]interface{}{ "name": "Gig", "band": trio },
+		ForeignKeys: map[string]string{ "band": "bands" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+
+	if _, ok := e.Schema[throughTableName("bands", "artists")]; !ok {
+		t.Fatal("Through table not created")
+	}
+	res, err := e.Select(uid, SelectQuery{ Table: throughTableName("bands", "artists"), Selection: Tautology{} })
+	if countRows(t, res, err) != 3 {
+		t.Fatal("Incorrect number of links")
+	}
+
+	err = e.flushStatsToDB()
+	if err != nil { t.Fatal(err.Error()) }
+	err = e.loadGlobalStats()
+	if err != nil { t.Fatal(err.Error()) }
+
+	selections := []struct{
+		table string
+		selection Formula
+		count int
+	}{
+		{ "bands", ValueSelection{ Attr: "artists__name", Value: "Ann", Op: "=" }, 1 },
+		{ "bands", ValueSelection{ Attr: "artists__name", Value: "Bob", Op: "=" }, 2 },
+		{ "bands", Not{ ValueSelection{ Attr: "artists__name", Value: "Ann", Op: "=" } }, 1 },
+		{ "events", ValueSelection{ Attr: "band__artists__name", Value: "Ann", Op: "=" }, 1 },
+		{ "events", ValueSelection{ Attr: "band__artists__name", Value: "Cat", Op: "=" }, 0 },
+	}
+	for _, s := range selections {
+		res, err = e.Select(uid, SelectQuery{ Table: s.table, Selection: s.selection })
+		if countRows(t, res, err) != s.count {
+			t.Fatalf("Incorrect number of rows for selection on %s: %v", s.table, s.selection)
+		}
+	}
+}
+
+//Through tables belong to no user: anyone who may insert a row may link it
+func TestManyToManyUsers(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	first, err := CreateUser(&e, "m2mFirst", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	second, err := CreateUser(&e, "m2mSecond", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	for _, table := range []string{"bands", "artists"} {
+		err = e.SetTablePermissions(table, ObjectPermissions{
+			Owner: Permissions{ Read: true, Insert: true, Update: true, Delete: true },
+			Everyone: Permissions{ Read: true, Insert: true },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+	}
+
+	for _, uid := range []int64{ first, second } {
+		_, err = e.Insert(uid, InsertQuery{
+			Table: "bands",
+			Data: map[string]interface{}{
+				"name": "Band",
+				"artists": []interface{}{ map[string]interface{}{ "name": "Ann" } },
+			},
+			ForeignKeys: map[string]string{ "artists": "artists" },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+	}
+	through := throughTableName("bands", "artists")
+	if _, owned := e.TableOwner(through); owned {
+		t.Fatal("Through table claimed")
+	}
+	res, _, err := e.RawSelect(SelectQuery{ Table: through, Selection: Tautology{} })
+	if countRows(t, res, err) != 2 {
+		t.Fatal("Incorrect number of links")
+	}
+}
+
+func TestReverseRelations(t *testing.T){
+	var e Engine
+	config := Config{
+		DatabaseType: "memdb",
+	}
+	err := e.Init(&config)
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "reverseUser", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	venues := make([]int64, 0)
+	for _, name := range []string{"Hall", "Barn", "Park"} {
+		r, err := e.Insert(uid, InsertQuery{
+			Table: "venues",
+			Data: map[string]interface{}{ "name": name },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+		id, err := r.LastInsertId()
+		if err != nil { t.Fatal(err.Error()) }
+		venues = append(venues, id)
+	}
+	events := []struct{
+		venue int64
+		date int64
+	}{ {venues[0], 10}, {venues[0], 30}, {venues[1], 20} }
+	for _, ev := range events {
+		_, err = e.Insert(uid, InsertQuery{
+			Table: "events",
+			Data: map[string]interface{}{ "venue": ev.venue, "date": ev.date },
+			ForeignKeys: map[string]string{ "venue": "venues" },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+	}
+	err = e.flushStatsToDB()
+	if err != nil { t.Fatal(err.Error()) }
+	err = e.loadGlobalStats()
+	if err != nil { t.Fatal(err.Error()) }
+
+	//Venues with several matching events must only be returned once
+	selections := []struct{
+		selection Formula
+		count int
+	}{
+		{ ValueSelection{ Attr: "events__date", Value: int64(15), Op: ">" }, 2 },
+		{ ValueSelection{ Attr: "events__date", Value: int64(25), Op: ">" }, 1 },
+		{ Not{ ValueSelection{ Attr: "events__date", Value: int64(0), Op: ">" } }, 1 },
+	}
+	for _, s := range selections {
+		res, err := e.Select(uid, SelectQuery{ Table: "venues", Selection: s.selection })
+		if countRows(t, res, err) != s.count {
+			t.Fatalf("Incorrect number of venues for selection %v", s.selection)
+		}
+	}
+}
+
+func TestExpand(t *testing.T){
+	var e Engine
+	config := Config{
+		DatabaseType: "memdb",
+	}
+	err := e.Init(&config)
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "expandUser", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	otherUID, err := CreateUser(&e, "expandOther", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	insert := func(userId int64, table string, data map[string]interface{}, fks map[string]string) int64 {
+		r, err := e.Insert(userId, InsertQuery{ Table: table, Data: data, ForeignKeys: fks })
+		if err != nil { t.Fatal(err.Error()) }
+		id, err := r.LastInsertId()
+		if err != nil { t.Fatal(err.Error()) }
+		return id
+	}
+	owner := insert(uid, "people", map[string]interface{}{ "name": "Jim" }, nil)
+	//The other user may insert into people through a group of the table
+	gid, err := CreateGroup(&e, "people_inserters")
+	if err != nil { t.Fatal(err.Error()) }
+	err = AddUserToGroup(&e, otherUID, gid)
+	if err != nil { t.Fatal(err.Error()) }
+	err = AddTableGroup(&e, "people", gid)
+	if err != nil { t.Fatal(err.Error()) }
+	hidden := insert(otherUID, "people", map[string]interface{}{ "name": "Hidden" }, nil)
+	hall := insert(uid, "venues", map[string]interface{}{ "name": "Hall", "owner": owner },
+		map[string]string{ "owner": "people" })
+	barn := insert(uid, "venues", map[string]interface{}{ "name": "Barn", "owner": hidden },
+		map[string]string{ "owner": "people" })
+	for _, venue := range []int64{ hall, hall, barn } {
+		insert(uid, "events", map[string]interface{}{ "venue": venue },
+			map[string]string{ "venue": "venues" })
+	}
+	err = e.flushStatsToDB()
+	if err != nil { t.Fatal(err.Error()) }
+	err = e.loadGlobalStats()
+	if err != nil { t.Fatal(err.Error()) }
+
+	res, err := e.Select(uid, SelectQuery{
+		Table: "events",
+		Selection: Tautology{},
+		Expand: []string{ "venue__owner" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	n := 0
+	for res.Next() {
+		n += 1
+		event, err := res.Get()
+		if err != nil { t.Fatal(err.Error()) }
+		venue, ok := event["venue"].(map[string]interface{})
+		if !ok { t.Fatal("Venue not expanded") }
+		switch venue["name"] {
+		case "Hall":
+			person, ok := venue["owner"].(map[string]interface{})
+			if !ok || person["name"] != "Jim" { t.Fatal("Owner not expanded") }
+		case "Barn":
+			//Rows the user can't read are left as ids
+			if _, ok := venue["owner"].(map[string]interface{}); ok {
+				t.Fatal("Unreadable owner expanded")
+			}
+		default:
+			t.Fatal("Incorrect venue expanded")
+		}
+	}
+	if n != 3 { t.Fatal("Incorrect number of events") }
+
+	//Expanding must not modify the stored rows
+	res, err = e.Select(uid, SelectQuery{ Table: "events", Selection: Tautology{} })
+	if err != nil { t.Fatal(err.Error()) }
+	event, err := GetRow(res)
+	if err != nil { t.Fatal(err.Error()) }
+	if _, ok := event["venue"].(map[string]interface{}); ok {
+		t.Fatal("Stored row modified by expansion")
+	}
+
+	_, err = e.Select(uid, SelectQuery{ Table: "events", Selection: Tautology{}, Expand: []string{ "organizer" } })
+	if err == nil { t.Fatal("Unknown relation expanded") }
+}
@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+/* expand.go
+
+   SelectQuery.Expand lists relation paths (e.g. venue, venue__owner) whose
+   referenced rows are embedded in each result in place of their ids.
+   Related rows are fetched with one query per relation (per batch of ids)
+   rather than one per result, and are subject to the same read permissions
+   as any other select. References to rows which can't be read are left
+   as ids.
+*/
+
+//Maximum number of ids fetched by a single query when expanding relations
+const expandBatchSize = 500
+
+//Return the prefixes of every relation to expand, including those on the
+// way to a deeper relation, sorted so each comes after its parent
+func (e *Engine) expandPrefixes(query SelectQuery) (map[string]RelationPath, []string, error) {
+	selections := make([]Formula, 0)
+	for _, path := range query.Expand {
+		if path == "" || strings.HasPrefix(path, "__") || strings.HasSuffix(path, "__") {
+			return nil, nil, errors.New("Invalid relation to expand: '" + path + "'")
+		}
+		//The relation is determined exactly as if it were queried
+		selections = append(selections, ValueSelection{ Attr: path + "__id", Op: "=", Value: 0 })
+	}
+
+	e.SchemaLock.RLock()
+	e.GlobalStatsLock.RLock()
+	prefixes, err := genPrefixes(e.Schema, e.GlobalStats, query.Table, NestAnds(selections))
+	e.GlobalStatsLock.RUnlock()
+	e.SchemaLock.RUnlock()
+	if err != nil { return nil, nil, err }
+
+	sorted := make([]string, 0, len(prefixes))
+	for prefix, path := range prefixes {
+		if path.Table == "" {
+			return nil, nil, errors.New("Unknown relation '" + strings.TrimPrefix(prefix, "__") + "' of " + query.Table)
+		}
+		if path.Kind != RelationForward {
+			return nil, nil, errors.New("Only foreign keys can be expanded, not '" + strings.TrimPrefix(prefix, "__") + "'")
+		}
+		sorted = append(sorted, prefix)
+	}
+	sort.Sort(ByLength(sorted))
+	return prefixes, sorted, nil
+}
+
+//Replace the foreign keys of every row in `res` listed in query.Expand
+// with the rows they reference
+func (e *Engine) expandRelations(db AutoscopeQueryer, userId int64, query SelectQuery, res RetrievalResult) (RetrievalResult, error) {
+	prefixes, sorted, err := e.expandPrefixes(query)
+	if err != nil { return nil, err }
+
+	buffered, err := BufferRetrievalResult(res)
+	if err != nil { return nil, err }
+	//Rows may be shared with the database (as with memdb),
+	// so they are copied before being modified
+	for i, row := range buffered.Rows {
+		buffered.Rows[i] = copyRow(row)
+	}
+
+	//Rows at each prefix, into which deeper relations are embedded
+	rowsAt := map[string][]map[string]interface{}{ "__root": buffered.Rows }
+	for _, prefix := range sorted {
+		path := prefixes[prefix]
+		parents := rowsAt[path.FromTablePrefix]
+
+		ids := make([]int64, 0)
+		seen := make(map[int64]bool, 0)
+		for _, parent := range parents {
+			id, ok := idValue(parent[path.FromField])
+			if ok && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+
+		related, err := e.selectByIds(db, userId, path.Table, ids)
+		if err != nil { return nil, err }
+		for _, row := range related {
+			rowsAt[prefix] = append(rowsAt[prefix], row)
+		}
+		for _, parent := range parents {
+			id, ok := idValue(parent[path.FromField])
+			if row, found := related[id]; ok && found {
+				parent[path.FromField] = row
+			}
+		}
+	}
+	return buffered, nil
+}
+
+//Select the rows of `table` with the given ids that `userId` may read,
+// mapped by id
+func (e *Engine) selectByIds(db AutoscopeQueryer, userId int64, table string, ids []int64) (map[int64]map[string]interface{}, error) {
+	rows := make(map[int64]map[string]interface{}, len(ids))
+	for start := 0; start < len(ids); start += expandBatchSize {
+		end := start + expandBatchSize
+		if end > len(ids) { end = len(ids) }
+		selections := make([]Formula, 0, end - start)
+		for _, id := range ids[start:end] {
+			selections = append(selections, ValueSelection{ Attr: "id", Op: "=", Value: id })
+		}
+
+		res, err := e.selectOn(db, userId, SelectQuery{ Table: table, Selection: NestOrs(selections) })
+		if err != nil { return nil, err }
+		for res.Next() {
+			row, err := res.Get()
+			if err != nil { return nil, err }
+			if id, ok := idValue(row["id"]); ok {
+				rows[id] = copyRow(row)
+			}
+		}
+	}
+	return rows, nil
+}
+
+//Return a shallow copy of a row
+func copyRow(row map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,248 @@
+package engine
+
+import (
+	"errors"
+	"strings"
+)
+
+/* field_permissions.go
+
+   Fields may have permissions of their own, in addition to those of their
+   table, e.g. to hide autoscope_users.passhash. They're declared under
+   `fields` in autoscope_permissions.yml and stored in
+   autoscope_field_permissions. As with rows, the owner and group of a
+   field are those of the row containing it.
+
+   - Read: fields which can't be read are removed from selected rows,
+     and selections may only filter on rows where the field can be read.
+   - Update: updates only modify rows where every field written can be
+     updated, and are rejected if there are none.
+   - Insert: inserts are rejected if a field written can't be inserted.
+     The user inserting a row is its owner.
+
+   Rules (see PermissionRule) apply to tables only; field permissions
+   with rules are rejected.
+*/
+
+var errFieldRules = errors.New("Field permissions can't have rules")
+
+//Seed the field permissions table with those in autoscope_permissions.yml.
+// Fields already present keep their permissions.
+func (e *Engine) seedFieldPermissions() error {
+	configured, err := AutoscopeFieldPermissions()
+	if err != nil { return err }
+	stored, err := e.storedFieldPermissions()
+	if err != nil { return err }
+	for tableName, fields := range configured {
+		for field, perms := range fields {
+			if _, ok := stored[tableName][field]; ok { continue }
+			row, err := fieldPermissionsRow(tableName, field, perms)
+			if err != nil { return err }
+			_, err = e.RawInsert(InsertQuery{
+				Table: "autoscope_field_permissions",
+				Data: row,
+			})
+			if err != nil { return err }
+		}
+	}
+	return nil
+}
+
+//Read the permissions of every field from the field permissions table
+func (e *Engine) storedFieldPermissions() (map[string]map[string]ObjectPermissions, error) {
+	res, _, err := e.RawSelect(SelectQuery{ Table: "autoscope_field_permissions" })
+	if err != nil { return nil, err }
+	stored := make(map[string]map[string]ObjectPermissions, 0)
+	for res.Next() {
+		row, err := res.Get()
+		if err != nil { return nil, err }
+		perms, err := permissionsFromRow(row)
+		if err != nil { return nil, err }
+		if len(perms.Rules) > 0 { return nil, errFieldRules }
+		tableName := row["table_name"].(string)
+		if _, ok := stored[tableName]; !ok {
+			stored[tableName] = make(map[string]ObjectPermissions, 0)
+		}
+		stored[tableName][row["field_name"].(string)] = perms
+	}
+	return stored, nil
+}
+
+//Helper to build the field permissions table row for a field
+func fieldPermissionsRow(tableName string, field string, perms ObjectPermissions) (map[string]interface{}, error) {
+	if len(perms.Rules) > 0 { return nil, errFieldRules }
+	row, err := permissionsRow(tableName, perms)
+	if err != nil { return nil, err }
+	row["field_name"] = field
+	return row, nil
+}
+
+//Return the permissions of each field of a table which has its own
+func (e *Engine) GetFieldPermissions(tableName string) map[string]ObjectPermissions {
+	e.PermissionsLock.RLock()
+	defer e.PermissionsLock.RUnlock()
+	fields := make(map[string]ObjectPermissions, len(e.FieldPermissions[tableName]))
+	for field, perms := range e.FieldPermissions[tableName] {
+		fields[field] = perms
+	}
+	return fields
+}
+
+//Change the permissions of a field, storing them so they're shared
+// with other nodes and persist across restarts
+func (e *Engine) SetFieldPermissions(tableName string, field string, perms ObjectPermissions) error {
+	row, err := fieldPermissionsRow(tableName, field, perms)
+	if err != nil { return err }
+	e.SchemaLock.RLock()
+	_, err = e.DB.Upsert(e.Schema, nil, UpsertQuery{
+		Table: "autoscope_field_permissions",
+		Keys: []string{"table_name", "field_name"},
+		Data: row,
+	})
+	e.SchemaLock.RUnlock()
+	if err != nil { return err }
+
+	e.PermissionsLock.Lock()
+	if _, ok := e.FieldPermissions[tableName]; !ok {
+		e.FieldPermissions[tableName] = make(map[string]ObjectPermissions, 0)
+	}
+	e.FieldPermissions[tableName][field] = perms
+	e.PermissionsLock.Unlock()
+	return nil
+}
+
+//Whether `action` is permitted on a field of a row
+func fieldPermitted(perms ObjectPermissions, action func(Permissions) bool, isOwner bool, inGroup bool) bool {
+	return action(perms.Everyone) ||
+		(action(perms.Owner) && isOwner) ||
+		(action(perms.Group) && inGroup)
+}
+
+//A retrieval result whose rows have unreadable fields removed
+type fieldFilteredResult struct {
+	res RetrievalResult
+	fields map[string]ObjectPermissions
+	userId int64
+	groups []int64
+}
+
+func (r *fieldFilteredResult) Next() bool {
+	return r.res.Next()
+}
+
+func (r *fieldFilteredResult) Get() (map[string]interface{}, error) {
+	row, err := r.res.Get()
+	if err != nil || row == nil { return row, err }
+	uid, hasOwner := idValue(row["autoscope_uid"])
+	gid, hasGroup := idValue(row["autoscope_gid"])
+	isOwner := hasOwner && uid == r.userId
+	inGroup := hasGroup && listContainsInt64(r.groups, gid)
+
+	//Rows may be shared with the database (as with memdb),
+	// so they are copied before being modified
+	var filtered map[string]interface{}
+	for field, perms := range r.fields {
+		if _, ok := row[field]; !ok { continue }
+		if fieldPermitted(perms, ReadAction, isOwner, inGroup) { continue }
+		if filtered == nil { filtered = copyRow(row) }
+		delete(filtered, field)
+	}
+	if filtered == nil { return row, nil }
+	return filtered, nil
+}
+
+//Remove fields `userId` may not read from rows of `tableName`
+func (e *Engine) filterFields(tableName string, userId int64, groups []int64, res RetrievalResult) RetrievalResult {
+	fields := e.GetFieldPermissions(tableName)
+	if len(fields) == 0 { return res }
+	return &fieldFilteredResult{ res: res, fields: fields, userId: userId, groups: groups }
+}
+
+//Restrict a selection on `tableName` to rows where `userId` may read every
+// field it filters on. Filtering on related rows' fields requires that
+// everyone may read them, since related rows are matched existentially.
+func (e *Engine) restrictFieldSelection(tableName string, selection Formula, userId int64, groups []int64) (Formula, error) {
+	if selection == nil { return selection, nil }
+	attrs := make([]string, 0)
+	ModifyLeaves(func(f Formula) Formula {
+		switch leaf := f.(type) {
+		case ValueSelection:
+			attrs = append(attrs, leaf.Attr)
+		case AttrSelection:
+			attrs = append(attrs, leaf.AttrA, leaf.AttrB)
+		}
+		return f
+	}, selection)
+
+	e.SchemaLock.RLock()
+	e.GlobalStatsLock.RLock()
+	prefixes, err := genPrefixes(e.Schema, e.GlobalStats, tableName, selection)
+	e.GlobalStatsLock.RUnlock()
+	e.SchemaLock.RUnlock()
+	if err != nil { return nil, err }
+
+	restrictions := make([]Formula, 0)
+	restricted := make(map[string]bool, 0)
+	for _, attr := range attrs {
+		parts := strings.Split(attr, "__")
+		field := parts[len(parts) - 1]
+		table := tableName
+		if len(parts) > 1 {
+			path, ok := prefixes["__" + strings.Join(parts[0:len(parts) - 1], "__")]
+			if !ok || path.Table == "" { continue }
+			table = path.Table
+		}
+		perms, ok := e.GetFieldPermissions(table)[field]
+		if !ok || perms.Everyone.Read { continue }
+		if len(parts) > 1 {
+			return nil, errors.New("Field " + field + " of " + table + " can't be filtered on")
+		}
+		if restricted[field] { continue }
+		restricted[field] = true
+		restriction, allow := permissionsFormula(perms, "", userId, groups, ReadAction)
+		if !allow {
+			return nil, errors.New("Field " + field + " of " + table + " can't be filtered on")
+		}
+		restrictions = append(restrictions, restriction)
+	}
+	if len(restrictions) == 0 { return selection, nil }
+	return And{ A: selection, B: NestAnds(restrictions) }, nil
+}
+
+//Return a restriction matching the rows of `tableName` on which `userId`
+// may update every field in `data`, or nil if there is no restriction.
+// An error is returned if no such row can exist.
+func (e *Engine) restrictFieldUpdates(tableName string, data map[string]interface{}, userId int64, groups []int64) (Formula, error) {
+	fields := e.GetFieldPermissions(tableName)
+	restrictions := make([]Formula, 0)
+	for field, _ := range data {
+		perms, ok := fields[field]
+		if !ok { continue }
+		restriction, allow := permissionsFormula(perms, "", userId, groups, UpdateAction)
+		if !allow {
+			return nil, errors.New("User does not have permissions to update field " + field + ".")
+		}
+		if restriction != nil {
+			restrictions = append(restrictions, restriction)
+		}
+	}
+	if len(restrictions) == 0 { return nil, nil }
+	return NestAnds(restrictions), nil
+}
+
+//Return an error if `userId` may not insert a row of `tableName` with
+// every field in `data`. The inserting user owns the row.
+func (e *Engine) checkFieldInserts(tableName string, data map[string]interface{}, userId int64, groups []int64) error {
+	fields := e.GetFieldPermissions(tableName)
+	if len(fields) == 0 { return nil }
+	gid, hasGroup := idValue(data["autoscope_gid"])
+	inGroup := hasGroup && listContainsInt64(groups, gid)
+	for field, _ := range data {
+		perms, ok := fields[field]
+		if !ok { continue }
+		if !fieldPermitted(perms, InsertAction, true, inGroup) {
+			return errors.New("User does not have permissions to insert field " + field + ".")
+		}
+	}
+	return nil
+}
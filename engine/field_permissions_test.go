@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"testing"
+)
+
+func TestConfiguredFieldPermissions(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	fields := e.GetFieldPermissions("autoscope_users")
+	for _, field := range []string{"passhash", "salt"} {
+		perms, ok := fields[field]
+		if !ok { t.Fatal("No permissions for " + field) }
+		if perms.Owner.Read || perms.Group.Read || perms.Everyone.Read {
+			t.Fatal(field + " is readable")
+		}
+	}
+}
+
+func TestFieldPermissions(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "employee", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	otherUID, err := CreateUser(&e, "other_employee", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	everyone, _ := PermissionsFromString("read, insert, update")
+	err = e.SetTablePermissions("employees", ObjectPermissions{ Everyone: everyone })
+	if err != nil { t.Fatal(err.Error()) }
+	//Only the owner of a row may read and update its salary, and no one
+	// may insert it or do anything with ssn
+	err = e.SetFieldPermissions("employees", "salary", ObjectPermissions{
+		Owner: Permissions{ Read: true, Update: true },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	err = e.SetFieldPermissions("employees", "ssn", ObjectPermissions{})
+	if err != nil { t.Fatal(err.Error()) }
+
+	for _, row := range []map[string]interface{}{
+		{ "name": "own", "kind": "staff", "salary": 100, "ssn": "1", "autoscope_uid": uid },
+		{ "name": "other", "kind": "staff", "salary": 200, "ssn": "2", "autoscope_uid": otherUID },
+	} {
+		_, err = e.RawInsert(InsertQuery{ Table: "employees", Data: row })
+		if err != nil { t.Fatal(err.Error()) }
+	}
+
+	//Unreadable fields are removed from results
+	res, err := e.Select(uid, SelectQuery{ Table: "employees" })
+	if err != nil { t.Fatal(err.Error()) }
+	rows := 0
+	for res.Next() {
+		row, err := res.Get()
+		if err != nil { t.Fatal(err.Error()) }
+		rows += 1
+		_, hasSalary := row["salary"]
+		if hasSalary != (row["name"] == "own") {
+			t.Fatal("Incorrect salary visibility for " + row["name"].(string))
+		}
+		if _, ok := row["ssn"]; ok { t.Fatal("ssn visible") }
+	}
+	if rows != 2 { t.Fatal("Incorrect number of rows retrieved") }
+
+	//Only rows where a field is readable may be filtered on it
+	res, err = e.Select(uid, SelectQuery{
+		Table: "employees",
+		Selection: ValueSelection{ Attr: "salary", Value: 50, Op: ">" },
+	})
+	if countRows(t, res, err) != 1 {
+		t.Fatal("Filtered on unreadable salary")
+	}
+	_, err = e.Select(uid, SelectQuery{
+		Table: "employees",
+		Selection: ValueSelection{ Attr: "ssn", Value: "2", Op: "=" },
+	})
+	if err == nil { t.Fatal("Filtered on unreadable ssn") }
+
+	//Only rows where every field written may be updated are updated
+	ures, err := e.Update(uid, Update("employees",
+		map[string]interface{}{ "kind": "staff" },
+		map[string]interface{}{ "salary": 300 }))
+	if err != nil { t.Fatal(err.Error()) }
+	if n, _ := ures.RowsAffected(); n != 1 {
+		t.Fatal("Updated salary without permission")
+	}
+	_, err = e.Update(uid, Update("employees",
+		map[string]interface{}{ "kind": "staff" },
+		map[string]interface{}{ "ssn": "3" }))
+	if err == nil { t.Fatal("Updated ssn without permission") }
+
+	//Protected fields can't be inserted
+	_, err = e.Insert(uid, InsertQuery{
+		Table: "employees",
+		Data: map[string]interface{}{ "name": "new", "salary": 10 },
+	})
+	if err == nil { t.Fatal("Inserted salary without permission") }
+	_, err = e.Insert(uid, InsertQuery{
+		Table: "employees",
+		Data: map[string]interface{}{ "name": "new" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+}
+
+//Rules only apply to tables, so field permissions with rules are rejected
+func TestFieldPermissionRules(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	rule, err := ParseFormula(`autoscope_uid = $uid`)
+	if err != nil { t.Fatal(err.Error()) }
+	perms := ObjectPermissions{
+		Rules: []PermissionRule{{ Permissions: Permissions{ Read: true }, Formula: rule }},
+	}
+	err = e.SetFieldPermissions("ruled", "secret", perms)
+	if err == nil { t.Fatal("Field permissions with rules accepted") }
+	if _, ok := e.GetFieldPermissions("ruled")["secret"]; ok {
+		t.Fatal("Rejected field permissions applied")
+	}
+
+	//Rules stored by other means aren't loaded
+	row, err := permissionsRow("ruled", perms)
+	if err != nil { t.Fatal(err.Error()) }
+	row["field_name"] = "secret"
+	_, err = e.RawInsert(InsertQuery{ Table: "autoscope_field_permissions", Data: row })
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = e.storedFieldPermissions()
+	if err == nil { t.Fatal("Stored field permissions with rules loaded") }
+}
@@ -0,0 +1,384 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* formula_text.go
+
+   A textual language for formulas, as an alternative to their JSON form:
+
+     venue__owner__name = "Jim" and (price < 10 or not sold)
+
+   Grammar, lowest precedence first:
+
+     formula    := and ("or" and)*
+     and        := unary ("and" unary)*
+     unary      := "not" unary | "(" formula ")" | "true" | comparison | attr
+     comparison := attr op (value | attr)
+     op         := "=" | "!=" | "<" | "<=" | ">" | ">=" | "like"
+     value      := "string" | number | "true" | "false" | variable
+     variable   := "$uid"
+     attr       := identifier | `quoted identifier`
+
+   A bare attribute (e.g. `sold`) is shorthand for `sold = true`.
+   Variables are kept as strings (e.g. "$uid") and substituted when the
+   formula is used; see PermissionRule.
+   Keywords are case insensitive. Strings use Go's escape sequences.
+*/
+
+//Error parsing a textual formula. Pos is the byte offset at which
+// the error occurred.
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("Formula syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenKeyword
+	tokenVariable
+)
+
+type formulaToken struct {
+	kind int
+	text string
+	pos int
+}
+
+var formulaKeywords = map[string]bool{
+	"and": true, "or": true, "not": true, "true": true, "false": true, "like": true,
+}
+
+var formulaVariables = map[string]bool{
+	"$uid": true,
+}
+
+//Split a textual formula into tokens
+func lexFormula(text string) ([]formulaToken, error) {
+	tokens := make([]formulaToken, 0)
+	i := 0
+	for i < len(text) {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i += 1
+		case c == '(':
+			tokens = append(tokens, formulaToken{ kind: tokenLParen, text: "(", pos: i })
+			i += 1
+		case c == ')':
+			tokens = append(tokens, formulaToken{ kind: tokenRParen, text: ")", pos: i })
+			i += 1
+		case c == '=' || c == '<' || c == '>' || c == '!':
+			op := string(c)
+			if i + 1 < len(text) && text[i + 1] == '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, ParseError{ Pos: i, Msg: "expected !=" }
+			}
+			tokens = append(tokens, formulaToken{ kind: tokenOp, text: op, pos: i })
+			i += len(op)
+		case c == '"':
+			end := i + 1
+			for end < len(text) && text[end] != '"' {
+				if text[end] == '\\' { end += 1 }
+				end += 1
+			}
+			if end >= len(text) {
+				return nil, ParseError{ Pos: i, Msg: "unterminated string" }
+			}
+			s, err := strconv.Unquote(text[i:end + 1])
+			if err != nil {
+				return nil, ParseError{ Pos: i, Msg: "invalid string " + text[i:end + 1] }
+			}
+			tokens = append(tokens, formulaToken{ kind: tokenString, text: s, pos: i })
+			i = end + 1
+		case c == '`':
+			end := strings.IndexByte(text[i + 1:], '`')
+			if end < 0 {
+				return nil, ParseError{ Pos: i, Msg: "unterminated quoted identifier" }
+			}
+			tokens = append(tokens, formulaToken{ kind: tokenIdent, text: text[i + 1:i + 1 + end], pos: i })
+			i += end + 2
+		case c == '$':
+			end := i + 1
+			for end < len(text) && isIdentByte(text[end]) {
+				end += 1
+			}
+			if !formulaVariables[text[i:end]] {
+				return nil, ParseError{ Pos: i, Msg: "unknown variable " + text[i:end] }
+			}
+			tokens = append(tokens, formulaToken{ kind: tokenVariable, text: text[i:end], pos: i })
+			i = end
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(text) && strings.IndexByte("0123456789.eE+-", text[end]) >= 0 {
+				//A sign is only part of a number directly after an exponent
+				if (text[end] == '+' || text[end] == '-') && text[end - 1] != 'e' && text[end - 1] != 'E' { break }
+				end += 1
+			}
+			tokens = append(tokens, formulaToken{ kind: tokenNumber, text: text[i:end], pos: i })
+			i = end
+		case isIdentByte(c) && !(c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(text) && isIdentByte(text[end]) {
+				end += 1
+			}
+			word := text[i:end]
+			if formulaKeywords[strings.ToLower(word)] {
+				tokens = append(tokens, formulaToken{ kind: tokenKeyword, text: strings.ToLower(word), pos: i })
+			} else {
+				tokens = append(tokens, formulaToken{ kind: tokenIdent, text: word, pos: i })
+			}
+			i = end
+		default:
+			return nil, ParseError{ Pos: i, Msg: "unexpected character " + strconv.QuoteRune(rune(c)) }
+		}
+	}
+	tokens = append(tokens, formulaToken{ kind: tokenEOF, pos: len(text) })
+	return tokens, nil
+}
+
+//Whether `c` may appear in an unquoted identifier
+func isIdentByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+type formulaParser struct {
+	tokens []formulaToken
+	current int
+}
+
+func (p *formulaParser) peek() formulaToken {
+	return p.tokens[p.current]
+}
+
+func (p *formulaParser) next() formulaToken {
+	t := p.tokens[p.current]
+	if t.kind != tokenEOF { p.current += 1 }
+	return t
+}
+
+func (p *formulaParser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokenKeyword && t.text == word {
+		p.next()
+		return true
+	}
+	return false
+}
+
+//Describe a token for use in error messages
+func (t formulaToken) describe() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of formula"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return "'" + t.text + "'"
+}
+
+func (p *formulaParser) parseOr() (Formula, error) {
+	f, err := p.parseAnd()
+	if err != nil { return nil, err }
+	for p.keyword("or") {
+		b, err := p.parseAnd()
+		if err != nil { return nil, err }
+		f = Or{ A: f, B: b }
+	}
+	return f, nil
+}
+
+func (p *formulaParser) parseAnd() (Formula, error) {
+	f, err := p.parseUnary()
+	if err != nil { return nil, err }
+	for p.keyword("and") {
+		b, err := p.parseUnary()
+		if err != nil { return nil, err }
+		f = And{ A: f, B: b }
+	}
+	return f, nil
+}
+
+func (p *formulaParser) parseUnary() (Formula, error) {
+	if p.keyword("not") {
+		a, err := p.parseUnary()
+		if err != nil { return nil, err }
+		return Not{ A: a }, nil
+	}
+	if p.keyword("true") {
+		return Tautology{}, nil
+	}
+	t := p.next()
+	switch t.kind {
+	case tokenLParen:
+		f, err := p.parseOr()
+		if err != nil { return nil, err }
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, ParseError{ Pos: closing.pos, Msg: "expected ')' but found " + closing.describe() }
+		}
+		return f, nil
+	case tokenIdent:
+		return p.parseComparison(t)
+	}
+	return nil, ParseError{ Pos: t.pos, Msg: "expected a selection but found " + t.describe() }
+}
+
+func (p *formulaParser) parseComparison(attr formulaToken) (Formula, error) {
+	op := p.peek()
+	if op.kind == tokenKeyword && op.text == "like" {
+		op.text = "LIKE"
+	} else if op.kind != tokenOp {
+		//A bare attribute must be true
+		return ValueSelection{ Attr: attr.text, Op: "=", Value: true }, nil
+	}
+	p.next()
+
+	t := p.next()
+	switch t.kind {
+	case tokenIdent:
+		return AttrSelection{ AttrA: attr.text, Op: op.text, AttrB: t.text }, nil
+	case tokenString, tokenVariable:
+		return ValueSelection{ Attr: attr.text, Op: op.text, Value: t.text }, nil
+	case tokenNumber:
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return ValueSelection{ Attr: attr.text, Op: op.text, Value: n }, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, ParseError{ Pos: t.pos, Msg: "invalid number " + t.text }
+		}
+		return ValueSelection{ Attr: attr.text, Op: op.text, Value: f }, nil
+	case tokenKeyword:
+		if t.text == "true" || t.text == "false" {
+			return ValueSelection{ Attr: attr.text, Op: op.text, Value: t.text == "true" }, nil
+		}
+	}
+	return nil, ParseError{ Pos: t.pos, Msg: "expected a value or attribute after " + op.describe() + " but found " + t.describe() }
+}
+
+//Parse a formula written in the textual formula language
+func ParseFormula(text string) (Formula, error) {
+	tokens, err := lexFormula(text)
+	if err != nil { return nil, err }
+	p := formulaParser{ tokens: tokens }
+	if p.peek().kind == tokenEOF {
+		return nil, ParseError{ Pos: 0, Msg: "empty formula" }
+	}
+	f, err := p.parseOr()
+	if err != nil { return nil, err }
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, ParseError{ Pos: t.pos, Msg: "unexpected " + t.describe() }
+	}
+	return f, nil
+}
+
+//Parse a formula given either as JSON or in the textual formula language
+func FormulaFromString(s string) (Formula, error) {
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		return FormulaFromJSON([]byte(s))
+	}
+	return ParseFormula(s)
+}
+
+//Format an attribute, quoting it if it isn't a plain identifier
+func formatAttr(attr string) (string, error) {
+	if strings.Contains(attr, "`") {
+		return "", errors.New("Attribute " + attr + " can't be formatted")
+	}
+	tokens, err := lexFormula(attr)
+	if err != nil || len(tokens) != 2 || tokens[0].kind != tokenIdent || tokens[0].text != attr {
+		return "`" + attr + "`", nil
+	}
+	return attr, nil
+}
+
+//Format a value so that it parses back to the same type
+func formatValue(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		if formulaVariables[val] { return val, nil }
+		return strconv.Quote(val), nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case int:
+		return strconv.Itoa(val), nil
+	case int32:
+		return strconv.FormatInt(int64(val), 10), nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil
+	case float32:
+		return formatValue(float64(val))
+	case float64:
+		s := strconv.FormatFloat(val, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eE") {
+			s += ".0"
+		}
+		return s, nil
+	}
+	return "", errors.New(fmt.Sprintf("Value %v can't be formatted", v))
+}
+
+//Format a formula in the textual formula language
+func FormatFormula(f Formula) (string, error) {
+	switch val := f.(type) {
+	case nil, Tautology:
+		return "true", nil
+	case ValueSelection:
+		if !ValidOp(val.Op) { return "", errors.New("Invalid operator " + val.Op) }
+		attr, err := formatAttr(val.Attr)
+		if err != nil { return "", err }
+		value, err := formatValue(val.Value)
+		if err != nil { return "", err }
+		return attr + " " + strings.ToLower(val.Op) + " " + value, nil
+	case AttrSelection:
+		if !ValidOp(val.Op) { return "", errors.New("Invalid operator " + val.Op) }
+		a, err := formatAttr(val.AttrA)
+		if err != nil { return "", err }
+		b, err := formatAttr(val.AttrB)
+		if err != nil { return "", err }
+		return a + " " + strings.ToLower(val.Op) + " " + b, nil
+	case Not:
+		a, err := FormatFormula(val.A)
+		if err != nil { return "", err }
+		switch val.A.(type) {
+		case And, Or:
+			a = "(" + a + ")"
+		}
+		return "not " + a, nil
+	case And:
+		a, err := FormatFormula(val.A)
+		if err != nil { return "", err }
+		b, err := FormatFormula(val.B)
+		if err != nil { return "", err }
+		//Or binds less tightly than And
+		if _, ok := val.A.(Or); ok { a = "(" + a + ")" }
+		if _, ok := val.B.(Or); ok { b = "(" + b + ")" }
+		//And is parsed left-associatively
+		if _, ok := val.B.(And); ok { b = "(" + b + ")" }
+		return a + " and " + b, nil
+	case Or:
+		a, err := FormatFormula(val.A)
+		if err != nil { return "", err }
+		b, err := FormatFormula(val.B)
+		if err != nil { return "", err }
+		if _, ok := val.B.(Or); ok { b = "(" + b + ")" }
+		return a + " or " + b, nil
+	}
+	return "", errors.New(fmt.Sprintf("Formula of type %T can't be formatted", f))
+}
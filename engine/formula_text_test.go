@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFormula(t *testing.T){
+	f, err := ParseFormula(`venue__owner__name = "Jim" and (price < 10 or not sold)`)
+	if err != nil { t.Fatal(err.Error()) }
+	expected := And{
+		A: ValueSelection{ Attr: "venue__owner__name", Op: "=", Value: "Jim" },
+		B: Or{
+			A: ValueSelection{ Attr: "price", Op: "<", Value: int64(10) },
+			B: Not{ A: ValueSelection{ Attr: "sold", Op: "=", Value: true } },
+		},
+	}
+	if !reflect.DeepEqual(f, expected) {
+		t.Fatalf("Incorrect formula: %#v", f)
+	}
+
+	cases := map[string]Formula{
+		`a = 1 or b = 2 and c = 3`: Or{
+			A: ValueSelection{ Attr: "a", Op: "=", Value: int64(1) },
+			B: And{
+				A: ValueSelection{ Attr: "b", Op: "=", Value: int64(2) },
+				B: ValueSelection{ Attr: "c", Op: "=", Value: int64(3) },
+			},
+		},
+		`low <= high`: AttrSelection{ AttrA: "low", Op: "<=", AttrB: "high" },
+		`name LIKE "J%" AND price >= -2.5e1`: And{
+			A: ValueSelection{ Attr: "name", Op: "LIKE", Value: "J%" },
+			B: ValueSelection{ Attr: "price", Op: ">=", Value: -25.0 },
+		},
+		"`and` != false": ValueSelection{ Attr: "and", Op: "!=", Value: false },
+		`true`: Tautology{},
+		`name = "say \"hi\""`: ValueSelection{ Attr: "name", Op: "=", Value: `say "hi"` },
+		`venue__owner = $uid`: ValueSelection{ Attr: "venue__owner", Op: "=", Value: "$uid" },
+	}
+	for text, expected := range cases {
+		f, err := ParseFormula(text)
+		if err != nil { t.Fatal(err.Error()) }
+		if !reflect.DeepEqual(f, expected) {
+			t.Fatalf("Incorrect formula for %s: %#v", text, f)
+		}
+	}
+}
+
+func TestParseFormulaErrors(t *testing.T){
+	cases := map[string]int{
+		``: 0,
+		`a = `: 4,
+		`a = 1 and`: 9,
+		`(a = 1`: 6,
+		`a = 1)`: 5,
+		`a ! 1`: 2,
+		`a = "open`: 4,
+		`a = 1 # b`: 6,
+		`a = and`: 4,
+		`a = $gid`: 4,
+	}
+	for text, pos := range cases {
+		_, err := ParseFormula(text)
+		perr, ok := err.(ParseError)
+		if !ok {
+			t.Fatalf("No parse error for %s", text)
+		}
+		if perr.Pos != pos {
+			t.Fatalf("Incorrect position for %s: %s", text, perr.Error())
+		}
+	}
+}
+
+func TestFormatFormula(t *testing.T){
+	formulas := []Formula{
+		And{
+			A: Or{
+				A: ValueSelection{ Attr: "a", Op: "=", Value: int64(1) },
+				B: ValueSelection{ Attr: "b", Op: "LIKE", Value: "x\ny" },
+			},
+			B: Not{ A: And{
+				A: AttrSelection{ AttrA: "c", Op: "<", AttrB: "d__e" },
+				B: ValueSelection{ Attr: "not", Op: "!=", Value: 2.0 },
+			}},
+		},
+		Or{
+			A: ValueSelection{ Attr: "a", Op: "=", Value: true },
+			B: Or{
+				A: ValueSelection{ Attr: "b", Op: ">", Value: int64(-3) },
+				B: Tautology{},
+			},
+		},
+		ValueSelection{ Attr: "owner", Op: "=", Value: "$uid" },
+	}
+	for _, f := range formulas {
+		text, err := FormatFormula(f)
+		if err != nil { t.Fatal(err.Error()) }
+		parsed, err := ParseFormula(text)
+		if err != nil { t.Fatal(err.Error()) }
+		if !reflect.DeepEqual(parsed, f) {
+			t.Fatalf("Formula %s did not round trip: %#v", text, parsed)
+		}
+	}
+
+	_, err := FormatFormula(ValueSelection{ Attr: "a", Op: "=", Value: []int{1} })
+	if err == nil { t.Fatal("Unformattable value formatted") }
+
+	//Either representation is accepted
+	for _, s := range []string{ `{"type": "VALUE_SELECTION", "attr": "a", "op": "=", "value": 1}`, `a = 1` } {
+		f, err := FormulaFromString(s)
+		if err != nil { t.Fatal(err.Error()) }
+		if vs, ok := f.(ValueSelection); !ok || vs.Attr != "a" {
+			t.Fatal("Incorrect formula from " + s)
+		}
+	}
+}
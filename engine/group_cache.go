@@ -0,0 +1,205 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/* group_cache.go
+
+   Permission checks need the groups of the user making a query, and often
+   those of the table queried. Both are cached in the engine rather than
+   selected on every query.
+
+   Changes made through this engine (AddUserToGroup, DeleteGroup,
+   AddTableGroup, ...) clear the cache. Other nodes sharing the database
+   learn of changes through a version counter stored in
+   autoscope_cache_versions: every change increments it, and nodes check
+   it at most every Config.GroupCacheInterval seconds, clearing their
+   cache when it differs from the version they last saw.
+*/
+
+//Name of the row of autoscope_cache_versions counting changes to groups
+const groupVersionName = "groups"
+
+//Seconds between checks of the group version if not configured
+const defaultGroupCacheInterval = 5
+
+type GroupCache struct {
+	lock sync.Mutex
+	//User id -> ids of the groups they're a member of
+	users map[int64][]int64
+	//Table name -> ids of the table's groups
+	tables map[string][]int64
+	//Group version last seen, and when it was checked
+	version int64
+	checked time.Time
+	stats GroupCacheStats
+}
+
+//Cache effectiveness, as reported by /asapi/stats/cache/
+type GroupCacheStats struct {
+	Hits int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	//Number of times the cache has been cleared, whether due to
+	// changes made through this engine or by other nodes
+	Invalidations int64 `json:"invalidations"`
+	Version int64 `json:"version"`
+	CachedUsers int `json:"cached_users"`
+	CachedTables int `json:"cached_tables"`
+}
+
+//Create the group cache, starting from the stored version
+func (e *Engine) initGroupCache() error {
+	version, err := e.storedGroupVersion()
+	if err != nil { return err }
+	e.GroupCache = &GroupCache{
+		users: make(map[int64][]int64, 0),
+		tables: make(map[string][]int64, 0),
+		version: version,
+		checked: time.Now(),
+	}
+	return nil
+}
+
+//Return the version of groups stored in the database, or zero if groups
+// have never changed
+func (e *Engine) storedGroupVersion() (int64, error) {
+	res, _, err := e.RawSelect(Filter("autoscope_cache_versions", map[string]interface{}{
+		"name": groupVersionName,
+	}))
+	if err != nil { return 0, err }
+	row, ok, err := FirstRow(res)
+	if err != nil || !ok { return 0, err }
+	version, _ := idValue(row["version"])
+	return version, nil
+}
+
+//Increment the stored version of groups, so that other nodes clear their
+// caches. The increment is retried if another node increments it first.
+func (e *Engine) incrementGroupVersion() (int64, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		version, err := e.storedGroupVersion()
+		if err != nil { return 0, err }
+		if version == 0 {
+			//Create the counter unless another node just has
+			e.SchemaLock.RLock()
+			res, err := e.DB.Upsert(e.Schema, nil, UpsertQuery{
+				Table: "autoscope_cache_versions",
+				Keys: []string{"name"},
+				Data: map[string]interface{}{ "name": groupVersionName, "version": int64(1) },
+				Restriction: Not{ A: Tautology{} },
+			})
+			e.SchemaLock.RUnlock()
+			if err != nil { return 0, err }
+			if n, err := res.RowsAffected(); err == nil && n > 0 { return 1, nil }
+			continue
+		}
+		res, _, err := e.RawUpdate(Update("autoscope_cache_versions", map[string]interface{}{
+			"name": groupVersionName,
+			"version": version,
+		}, map[string]interface{}{
+			"version": version + 1,
+		}))
+		if err != nil { return 0, err }
+		if n, err := res.RowsAffected(); err == nil && n > 0 { return version + 1, nil }
+	}
+	return 0, errors.New("Couldn't increment group version due to concurrent changes")
+}
+
+//Clear the cache after groups have changed, and signal the change to
+// other nodes
+func (e *Engine) invalidateGroupCache() error {
+	if e.GroupCache == nil { return nil }
+	version, err := e.incrementGroupVersion()
+	c := e.GroupCache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.clear()
+	if err == nil {
+		c.version = version
+		c.checked = time.Now()
+	}
+	return err
+}
+
+//Clear every cached entry. Callers must hold lock.
+func (c *GroupCache) clear() {
+	c.users = make(map[int64][]int64, 0)
+	c.tables = make(map[string][]int64, 0)
+	c.stats.Invalidations += 1
+}
+
+//Clear the cache if another node has changed groups since the version
+// was last checked, unless it has been checked recently.
+func (e *Engine) checkGroupVersion() error {
+	c := e.GroupCache
+	interval := int64(defaultGroupCacheInterval)
+	if e.Config != nil && e.Config.GroupCacheInterval > 0 {
+		interval = e.Config.GroupCacheInterval
+	}
+	c.lock.Lock()
+	due := time.Since(c.checked) >= time.Duration(interval) * time.Second
+	c.lock.Unlock()
+	if !due { return nil }
+	return e.refreshGroupCache()
+}
+
+//Check the stored version now, clearing the cache if it has changed
+func (e *Engine) refreshGroupCache() error {
+	if e.GroupCache == nil { return nil }
+	version, err := e.storedGroupVersion()
+	if err != nil { return err }
+	c := e.GroupCache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if version != c.version {
+		c.clear()
+		c.version = version
+	}
+	c.checked = time.Now()
+	return nil
+}
+
+//Return cached groups using `lookup`, or load and cache them using `load`
+func (e *Engine) cachedGroups(lookup func(*GroupCache) ([]int64, bool), store func(*GroupCache, []int64), load func() ([]int64, error)) ([]int64, error) {
+	c := e.GroupCache
+	if c == nil { return load() }
+	err := e.checkGroupVersion()
+	if err != nil { return nil, err }
+
+	c.lock.Lock()
+	groups, ok := lookup(c)
+	if ok {
+		c.stats.Hits += 1
+		c.lock.Unlock()
+		return copyInt64s(groups), nil
+	}
+	c.stats.Misses += 1
+	version := c.version
+	c.lock.Unlock()
+
+	groups, err = load()
+	if err != nil { return nil, err }
+	c.lock.Lock()
+	//Don't cache groups loaded before an invalidation
+	if c.version == version {
+		store(c, copyInt64s(groups))
+	}
+	c.lock.Unlock()
+	return groups, nil
+}
+
+//Return the statistics of the group cache
+func (e *Engine) GroupCacheStats() GroupCacheStats {
+	if e.GroupCache == nil { return GroupCacheStats{} }
+	c := e.GroupCache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := c.stats
+	stats.Version = c.version
+	stats.CachedUsers = len(c.users)
+	stats.CachedTables = len(c.tables)
+	return stats
+}
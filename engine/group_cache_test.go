@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGroupCache(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "cached_user", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	gid, err := CreateGroup(&e, "cached_group")
+	if err != nil { t.Fatal(err.Error()) }
+	otherGID, err := CreateGroup(&e, "other_cached_group")
+	if err != nil { t.Fatal(err.Error()) }
+
+	expectGroups := func(expected []int64) {
+		groups, err := UserGroups(&e, uid)
+		if err != nil { t.Fatal(err.Error()) }
+		if !reflect.DeepEqual(groups, expected) {
+			t.Fatalf("Incorrect groups %v, expected %v", groups, expected)
+		}
+	}
+
+	//Groups are selected once, then cached
+	start := e.GroupCacheStats()
+	expectGroups([]int64{})
+	expectGroups([]int64{})
+	stats := e.GroupCacheStats()
+	if stats.Misses != start.Misses + 1 || stats.Hits != start.Hits + 1 {
+		t.Fatalf("Incorrect cache stats: %+v", stats)
+	}
+
+	//Changes made through the engine invalidate the cache
+	err = AddUserToGroup(&e, uid, gid)
+	if err != nil { t.Fatal(err.Error()) }
+	expectGroups([]int64{ gid })
+	if e.GroupCacheStats().Invalidations == stats.Invalidations {
+		t.Fatal("Cache not invalidated")
+	}
+
+	//Changes made by other nodes apply once they increment the version
+	// and it's next checked
+	_, err = e.RawInsert(InsertQuery{
+		Table: "autoscope_user_groups",
+		Data: map[string]interface{}{ "user_id": uid, "group_id": otherGID },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = e.incrementGroupVersion()
+	if err != nil { t.Fatal(err.Error()) }
+	expectGroups([]int64{ gid })
+	e.GroupCache.lock.Lock()
+	e.GroupCache.checked = time.Now().Add(-time.Minute)
+	e.GroupCache.lock.Unlock()
+	expectGroups([]int64{ gid, otherGID })
+
+	//Table groups are cached too
+	err = AddTableGroup(&e, "cached_table", gid)
+	if err != nil { t.Fatal(err.Error()) }
+	for i := 0; i < 2; i++ {
+		groups, err := GetTableGroups(&e, "cached_table")
+		if err != nil { t.Fatal(err.Error()) }
+		if !reflect.DeepEqual(groups, []int64{ gid }) {
+			t.Fatalf("Incorrect table groups %v", groups)
+		}
+	}
+	if e.GroupCacheStats().CachedTables != 1 {
+		t.Fatal("Table groups not cached")
+	}
+
+	//Deleting a group removes it from users and tables
+	err = DeleteGroup(&e, gid)
+	if err != nil { t.Fatal(err.Error()) }
+	expectGroups([]int64{ otherGID })
+	groups, err := GetTableGroups(&e, "cached_table")
+	if err != nil { t.Fatal(err.Error()) }
+	if len(groups) != 0 { t.Fatalf("Deleted group still associated with table: %v", groups) }
+}
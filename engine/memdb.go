@@ -4,11 +4,15 @@ import (
 	"sync"
 	"errors"
 	"log"
+	"os"
+	"strings"
 	_ "strconv"
 )
 
 /* MemDB provides a simple, thread-safe in-memory database
    At present, it is best suited for testing purposes only.
+   Optional durability is provided by a snapshot + append-only log,
+   see memdb_log.go.
 
    Current performance issues:
    - No indexing
@@ -18,6 +22,16 @@ type MemDB struct {
 	Tables map[string]*MemTable
 	Config *Config
 	TableLock sync.RWMutex
+	//Append-only log file, nil unless persistence is enabled
+	logFile *os.File
+	logLock sync.Mutex
+	//Held exclusively by an open transaction, and shared by all other
+	// writes, so that nothing else is modified while a transaction is open
+	TxLock sync.RWMutex
+	//Set on the copy of the database a transaction works on. Modifications
+	// are collected in txLog instead of being written to the log.
+	inTx bool
+	txLog []memLogEntry
 }
 
 //Type representing a single row
@@ -31,6 +45,8 @@ type MemTable struct {
 	Rows map[int64]MemRow
 	//Last index used
 	LastIndex int64
+	//Declared foreign keys, enforced on every modification
+	ForeignKeys map[string]ForeignKey
 	//Table level lock
 	Lock sync.RWMutex
 }
@@ -38,6 +54,10 @@ type MemTable struct {
 func (memDB *MemDB) Connect(config *Config) error {
 	memDB.Config = config
 	memDB.Tables = make(map[string]*MemTable, 0)
+	if config != nil && config.MemDBDataDir != "" {
+		err := memDB.openPersistence(config)
+		if err != nil { return err }
+	}
 	log.Println("MemDB Initialized")
 	return nil
 }
@@ -49,12 +69,14 @@ func (memDB *MemDB) CurrentSchema() (map[string]Table, error) {
 			Name: tableName,
 			Columns: table.Columns,
 			Status: "created",
+			ForeignKeys: table.ForeignKeys,
 		}
 	}
 	return tables, nil
 }
 
 func (memDB *MemDB) PerformMigration(steps []MigrationStep) error {
+	defer memDB.writeLock()()
 	for _, step := range steps {
 		switch val := step.(type){
 		case MigrationStepCreateTable:
@@ -63,12 +85,28 @@ func (memDB *MemDB) PerformMigration(steps []MigrationStep) error {
 		case MigrationStepPromoteField:
 			mspf := step.(MigrationStepPromoteField)
 			memDB.TableLock.Lock()
-			memDB.Tables[mspf.tableName].Columns[mspf.column] = mspf.columnType
+			err := memDB.record(memLogEntry{
+				Op: "promote_field",
+				Table: mspf.tableName,
+				Column: mspf.column,
+				ColumnType: mspf.columnType,
+			})
 			memDB.TableLock.Unlock()
+			if err != nil { return err }
 			break
 		case MigrationStepIndexColumn:
 			// Indexing not yet supported
 			break
+		case MigrationStepAddForeignKey:
+			memDB.TableLock.Lock()
+			err := memDB.record(memLogEntry{
+				Op: "add_foreign_key",
+				Table: val.tableName,
+				Column: val.column,
+				ForeignKey: &val.foreignKey,
+			})
+			memDB.TableLock.Unlock()
+			if err != nil { return err }
 		default:
 			return errors.New("memDB: Unknown migration step type")
 		}
@@ -77,16 +115,17 @@ func (memDB *MemDB) PerformMigration(steps []MigrationStep) error {
 }
 
 func (memDB *MemDB) MigrationCreateTable(ct MigrationStepCreateTable) error {
+	memDB.TableLock.Lock()
+	defer memDB.TableLock.Unlock()
 	if _, ok := memDB.Tables[ct.tableName]; ok {
 		log.Println("memDB: Table already exists")
 		return nil 
 	}
-	memDB.Tables[ct.tableName] = &MemTable{
+	return memDB.record(memLogEntry{
+		Op: "create_table",
+		Table: ct.tableName,
 		Columns: ct.table.Columns,
-		Rows: make(map[int64]MemRow, 0),
-		LastIndex: 0,
-	}
-	return nil
+	})
 }
 
 type MemDBRetrievalResult struct {
@@ -134,7 +173,7 @@ func upcast(v interface{}) interface{} {
 	case int:
 		return int64(v.(int))
 	case float32:
-		return float64(v.(int))
+		return float64(v.(float32))
 	}
 	return v
 }
@@ -171,30 +210,137 @@ func performOp(vd1 interface{}, vd2 interface{}, op string) bool {
 	log.Println("MEMDB ERROR: Unknown operation or type for op: "+op)
 	return false
 }
-//Recursively evaluate a restriction formula for a given row
-//TODO: Function correctly for relational queries (venue__owner)
-func (memDB *MemDB) evalFormula(prefixes map[string]RelationPath, row MemRow, formula Formula) bool {
+//Rows of the tables referenced by a query's relational selections. These
+// are copied before the query's own table is locked, so that evaluating
+// a selection never needs to lock another table.
+type memRelations struct {
+	prefixes map[string]RelationPath
+	tables map[string]map[int64]MemRow
+}
+
+//Copy the rows of every table referenced by `prefixes`. Callers must hold
+// TableLock, but no table's lock.
+func (memDB *MemDB) snapshotRelations(prefixes map[string]RelationPath) *memRelations {
+	if len(prefixes) == 0 { return nil }
+	rel := &memRelations{
+		prefixes: prefixes,
+		tables: make(map[string]map[int64]MemRow, 0),
+	}
+	for _, path := range prefixes {
+		for _, name := range []string{path.Table, path.ThroughTable} {
+			table, ok := memDB.Tables[name]
+			if _, copied := rel.tables[name]; !ok || copied { continue }
+			table.Lock.RLock()
+			rows := make(map[int64]MemRow, len(table.Rows))
+			for k, v := range table.Rows {
+				rows[k] = v
+			}
+			table.Lock.RUnlock()
+			rel.tables[name] = rows
+		}
+	}
+	return rel
+}
+
+//Whether two values represent the same id
+func idEquals(a interface{}, b interface{}) bool {
+	idA, okA := idValue(a)
+	idB, okB := idValue(b)
+	return okA && okB && idA == idB
+}
+
+//Return the rows related to `row` by `path`
+func (rel *memRelations) related(path RelationPath, row MemRow) []MemRow {
+	rows := make([]MemRow, 0)
+	target := rel.tables[path.Table]
+	if path.Kind == RelationReverse {
+		for _, related := range target {
+			if idEquals(related[path.ReverseField], row["id"]) {
+				rows = append(rows, related)
+			}
+		}
+		return rows
+	}
+	if path.Kind == RelationThrough {
+		for _, link := range rel.tables[path.ThroughTable] {
+			if !idEquals(link["from_id"], row["id"]) { continue }
+			toId, ok := idValue(link["to_id"])
+			//Primary keys are one greater than ids
+			if related, found := target[toId + 1]; ok && found {
+				rows = append(rows, related)
+			}
+		}
+		return rows
+	}
+	id, ok := idValue(row[path.FromField])
+	if related, found := target[id + 1]; ok && found && idEquals(related["id"], id) {
+		rows = append(rows, related)
+	}
+	return rows
+}
+
+//Return every value `attr` takes for `row`. Relational attributes
+// (e.g. venue__owner__name) may take any number of values.
+func (memDB *MemDB) attrValues(rel *memRelations, row MemRow, attr string) []interface{} {
+	values := make([]interface{}, 0)
+	parts := strings.Split(attr, "__")
+	rows := []MemRow{ row }
+	if rel != nil && len(parts) > 1 {
+		prefix := ""
+		for _, field := range parts[0:len(parts) - 1] {
+			prefix += "__" + field
+			path, ok := rel.prefixes[prefix]
+			if !ok {
+				//Not a relation; treat the attribute as a plain field
+				rows = []MemRow{ row }
+				parts = []string{ attr }
+				break
+			}
+			next := make([]MemRow, 0)
+			for _, r := range rows {
+				next = append(next, rel.related(path, r)...)
+			}
+			rows = next
+		}
+	} else {
+		parts = []string{ attr }
+	}
+	for _, r := range rows {
+		if v, ok := r[parts[len(parts) - 1]]; ok {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+//Recursively evaluate a restriction formula for a given row. Relational
+// selections are true if any related row satisfies them.
+func (memDB *MemDB) evalFormula(rel *memRelations, row MemRow, formula Formula) bool {
+	//An empty selection matches every row
+	if formula == nil { return true }
 	switch formula.(type){
+	case Tautology:
+		return true
 	case AttrSelection:
 		as := formula.(AttrSelection)
-		if attrA, ok := row[as.AttrA]; ok {
-			if attrB, ok := row[as.AttrB]; ok {
-				return performOp(attrA, attrB, as.Op)
+		for _, attrA := range memDB.attrValues(rel, row, as.AttrA) {
+			for _, attrB := range memDB.attrValues(rel, row, as.AttrB) {
+				if performOp(attrA, attrB, as.Op) { return true }
 			}
 		}
 		return false
 	case ValueSelection:
 		vs := formula.(ValueSelection)
-		if attr, ok := row[vs.Attr]; ok {
-			return performOp(attr, vs.Value, vs.Op)
+		for _, attr := range memDB.attrValues(rel, row, vs.Attr) {
+			if performOp(attr, vs.Value, vs.Op) { return true }
 		}
 		return false
 	case Or:
-		return memDB.evalFormula(prefixes, row, formula.(Or).A) || memDB.evalFormula(prefixes, row, formula.(Or).B)
+		return memDB.evalFormula(rel, row, formula.(Or).A) || memDB.evalFormula(rel, row, formula.(Or).B)
 	case And:
-		return memDB.evalFormula(prefixes, row, formula.(And).A) && memDB.evalFormula(prefixes, row, formula.(And).B)
+		return memDB.evalFormula(rel, row, formula.(And).A) && memDB.evalFormula(rel, row, formula.(And).B)
 	case Not:
-		return !memDB.evalFormula(prefixes, row, formula.(Not).A)
+		return !memDB.evalFormula(rel, row, formula.(Not).A)
 	}
 	return false
 }
@@ -212,6 +358,7 @@ func (memDB *MemDB) Select(schema map[string]Table, prefixes map[string]Relation
 		return &r, nil
 	}
 
+	rel := memDB.snapshotRelations(prefixes)
 	t := memDB.Tables[query.Table]
 	t.Lock.Lock()
 	defer t.Lock.Unlock()
@@ -227,7 +374,7 @@ func (memDB *MemDB) Select(schema map[string]Table, prefixes map[string]Relation
 	}
 	
 	for _, row := range memDB.Tables[query.Table].Rows {
-		if  wildcard || memDB.evalFormula(prefixes, row, query.Selection){
+		if  wildcard || memDB.evalFormula(rel, row, query.Selection){
 			r.Rows = append(r.Rows, row)
 		}
 	}
@@ -239,13 +386,17 @@ func (memDB *MemDB) Select(schema map[string]Table, prefixes map[string]Relation
 // For now, we will just perform a linear scan on the table
 func (memDB *MemDB) Delete(schema map[string]Table, prefixes map[string]RelationPath, query SelectQuery) (ModificationResult, error) {
 	var r MemDBModificationResult
-	
-	memDB.TableLock.RLock()
-	defer memDB.TableLock.RUnlock()
+	defer memDB.writeLock()()
+
+	//Deleting rows may modify the tables referencing them,
+	// so no other table may be in use
+	memDB.TableLock.Lock()
+	defer memDB.TableLock.Unlock()
 	if _, ok := memDB.Tables[query.Table]; !ok {
 		return nil, nil
 	}
 
+	rel := memDB.snapshotRelations(prefixes)
 	t := memDB.Tables[query.Table]
 	t.Lock.Lock()
 	defer t.Lock.Unlock()
@@ -259,20 +410,22 @@ func (memDB *MemDB) Delete(schema map[string]Table, prefixes map[string]Relation
 		wildcard = true
 	}
 
-	deleted := 0
+	keys := make([]int64, 0)
 	for idx, row := range memDB.Tables[query.Table].Rows {
-		if  wildcard || memDB.evalFormula(prefixes, row, query.Selection){
-			delete(memDB.Tables[query.Table].Rows, idx)
-			deleted = deleted + 1
+		if  wildcard || memDB.evalFormula(rel, row, query.Selection){
+			keys = append(keys, idx)
 		}
 	}
+	err := memDB.deleteRows(query.Table, keys)
+	if err != nil { return nil, err }
 
-	r.rowsAffected = int64(deleted)
+	r.rowsAffected = int64(len(keys))
 	return &r, nil
 }
 
 func (memDB *MemDB) Insert(schema map[string]Table, query InsertQuery) (ModificationResult, error) {
 	var r MemDBModificationResult
+	defer memDB.writeLock()()
 
 	memDB.TableLock.Lock()
 	defer memDB.TableLock.Unlock()
@@ -288,31 +441,139 @@ func (memDB *MemDB) Insert(schema map[string]Table, query InsertQuery) (Modifica
 	}
 
 
+	err := memDB.checkReferences(query.Table, query.Data)
+	if err != nil { return nil, err }
+
 	table := memDB.Tables[query.Table]
-	r.id = table.LastIndex
+	table.Lock.Lock()
+	defer table.Lock.Unlock()
+	id, err := memDB.insertRow(query.Table, table, query.Data)
+	if err != nil { return nil, err }
+	r.id = id
 	r.rowsAffected = 1
-	query.Data["id"] = table.LastIndex
+	return r, nil
+}
 
+//Insert many rows while holding the table lock only once
+func (memDB *MemDB) InsertBatch(schema map[string]Table, query BatchInsertQuery) ([]int64, error) {
+	defer memDB.writeLock()()
+	memDB.TableLock.Lock()
+	defer memDB.TableLock.Unlock()
+	if _, ok := memDB.Tables[query.Table]; !ok {
+		memDB.Tables[query.Table] = &MemTable{
+			Columns: make(map[string]string, 0),
+			Rows: make(map[int64]MemRow, 0),
+			LastIndex: 0,
+		}
+	}
+
+	for _, data := range query.Data {
+		err := memDB.checkReferences(query.Table, data)
+		if err != nil { return nil, err }
+	}
+
+	table := memDB.Tables[query.Table]
 	table.Lock.Lock()
 	defer table.Lock.Unlock()
-	table.LastIndex += 1
-	table.Rows[table.LastIndex] = make(map[string]interface{})
-	for k, v := range query.Data {
+	ids := make([]int64, 0, len(query.Data))
+	for _, data := range query.Data {
+		id, err := memDB.insertRow(query.Table, table, data)
+		if err != nil { return ids, err }
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+//Insert a row, or update the row with the same key. The whole operation
+// takes place under the table's lock, so it is atomic.
+func (memDB *MemDB) Upsert(schema map[string]Table, prefixes map[string]RelationPath, query UpsertQuery) (ModificationResult, error) {
+	r := MemDBModificationResult{ id: -1 }
+	err := validateUpsertKeys(query)
+	if err != nil { return nil, err }
+
+	defer memDB.writeLock()()
+	memDB.TableLock.Lock()
+	defer memDB.TableLock.Unlock()
+	if _, ok := memDB.Tables[query.Table]; !ok {
+		memDB.Tables[query.Table] = &MemTable{
+			Columns: make(map[string]string, 0),
+			Rows: make(map[int64]MemRow, 0),
+			LastIndex: 0,
+		}
+	}
+
+	err = memDB.checkReferences(query.Table, query.Data)
+	if err != nil { return nil, err }
+
+	rel := memDB.snapshotRelations(prefixes)
+	table := memDB.Tables[query.Table]
+	table.Lock.Lock()
+	defer table.Lock.Unlock()
+
+	keySelection := upsertKeySelection(query)
+	for pk, row := range table.Rows {
+		if !memDB.evalFormula(nil, row, keySelection) { continue }
+		//The row exists, but may not be updated
+		if query.Restriction != nil && !memDB.evalFormula(rel, row, query.Restriction) {
+			return r, nil
+		}
+		data, err := upsertUpdateData(row, query)
+		if err != nil { return nil, err }
+		updated := make(MemRow, len(row))
+		for k, v := range row {
+			updated[k] = v
+		}
+		for k, v := range data {
+			updated[k] = upcast(v)
+		}
+		err = memDB.record(memLogEntry{
+			Op: "update",
+			Table: query.Table,
+			Key: pk,
+			Row: persistedRow(updated),
+		})
+		if err != nil { return nil, err }
+		r.id, _ = idValue(row["id"])
+		r.rowsAffected = 1
+		return r, nil
+	}
+
+	id, err := memDB.insertRow(query.Table, table, upsertInsertData(query))
+	if err != nil { return nil, err }
+	r.id = id
+	r.rowsAffected = 1
+	return r, nil
+}
+
+//Insert a single row into `table`, returning its id.
+// Callers must hold the table's lock.
+func (memDB *MemDB) insertRow(tableName string, table *MemTable, data map[string]interface{}) (int64, error) {
+	id := table.LastIndex
+	data["id"] = id
+
+	row := make(MemRow)
+	for k, v := range data {
 		//TODO: Correctly convert all other types, to ensure
 		// a consistent interface across engine backends
 		switch v.(type){
 		case int32:
-			table.Rows[table.LastIndex][k] = int64(v.(int32))
+			row[k] = int64(v.(int32))
 			break
 		case int:
-			table.Rows[table.LastIndex][k] = int64(v.(int))
+			row[k] = int64(v.(int))
 			break
 		default:
-			table.Rows[table.LastIndex][k] = v
+			row[k] = v
 		}
 	}
 
-	return r, nil
+	err := memDB.record(memLogEntry{
+		Op: "insert",
+		Table: tableName,
+		Key: table.LastIndex + 1,
+		Row: persistedRow(row),
+	})
+	return id, err
 }
 
 func (memDB *MemDB) Update(schema map[string]Table, prefixes map[string]RelationPath, query UpdateQuery) (ModificationResult, error) {
@@ -320,18 +581,225 @@ func (memDB *MemDB) Update(schema map[string]Table, prefixes map[string]Relation
 		id: -1,
 		rowsAffected: 0,
 	}
+	defer memDB.writeLock()()
+	memDB.TableLock.RLock()
+	defer memDB.TableLock.RUnlock()
 	if _, ok := memDB.Tables[query.Table]; !ok {
 		return nil, errors.New("memDB: Tables does not exist")
 	}
 
-	for pk, row := range memDB.Tables[query.Table].Rows {
-		if memDB.evalFormula(prefixes, row, query.Selection){
-			r.rowsAffected += 1
+	err := memDB.checkReferences(query.Table, query.Data)
+	if err != nil { return nil, err }
+
+	rel := memDB.snapshotRelations(prefixes)
+	t := memDB.Tables[query.Table]
+	t.Lock.Lock()
+	defer t.Lock.Unlock()
+
+	for pk, row := range t.Rows {
+		if memDB.evalFormula(rel, row, query.Selection){
+			updated := make(MemRow, len(row))
+			for k, v := range row {
+				updated[k] = v
+			}
 			for k, v := range query.Data {
-				row[k] = v
+				updated[k] = v
 			}
-			memDB.Tables[query.Table].Rows[pk] = row
+			err := memDB.record(memLogEntry{
+				Op: "update",
+				Table: query.Table,
+				Key: pk,
+				Row: persistedRow(updated),
+			})
+			if err != nil { return nil, err }
+			r.rowsAffected += 1
 		}
 	}
 	return r, nil
 }
+
+//Ensure every foreign key in `data` references an existing row.
+// Callers must hold TableLock, but no table's lock.
+func (memDB *MemDB) checkReferences(tableName string, data map[string]interface{}) error {
+	table, ok := memDB.Tables[tableName]
+	if !ok { return nil }
+	for column, fk := range table.ForeignKeys {
+		val, ok := data[column]
+		if !ok || val == nil { continue }
+		id, ok := idValue(val)
+		if !ok {
+			return errors.New("memDB: Foreign key " + tableName + "." + column + " must be an id")
+		}
+		found := false
+		if target, ok := memDB.Tables[fk.Table]; ok {
+			target.Lock.RLock()
+			//Primary keys are one greater than ids
+			_, found = target.Rows[id + 1]
+			target.Lock.RUnlock()
+		}
+		if !found {
+			return errors.New("memDB: Foreign key " + tableName + "." + column + " references a missing row of " + fk.Table)
+		}
+	}
+	return nil
+}
+
+//Delete the rows of `tableName` with primary keys `keys`, along with any
+// rows referencing them with OnDeleteCascade. References with
+// OnDeleteSetNull are cleared, and references with OnDeleteRestrict
+// prevent the deletion. Callers must hold TableLock exclusively.
+func (memDB *MemDB) deleteRows(tableName string, keys []int64) error {
+	deleted := map[string]map[int64]bool{ tableName: make(map[int64]bool, len(keys)) }
+	for _, key := range keys {
+		deleted[tableName][key] = true
+	}
+	//Columns to clear, by table and primary key
+	cleared := make(map[string]map[int64][]string, 0)
+	restricted := make([]string, 0)
+	restrictedKeys := make([]int64, 0)
+
+	//Follow references breadth first, until no more rows are deleted
+	pending := map[string][]int64{ tableName: keys }
+	for len(pending) > 0 {
+		next := make(map[string][]int64, 0)
+		for name, table := range memDB.Tables {
+			for column, fk := range table.ForeignKeys {
+				targets, ok := pending[fk.Table]
+				if !ok { continue }
+				ids := make(map[int64]bool, len(targets))
+				for _, key := range targets {
+					ids[key - 1] = true
+				}
+				for pk, row := range table.Rows {
+					id, ok := idValue(row[column])
+					if !ok || !ids[id] || deleted[name][pk] { continue }
+					switch fk.OnDelete {
+					case OnDeleteCascade:
+						if deleted[name] == nil { deleted[name] = make(map[int64]bool, 0) }
+						deleted[name][pk] = true
+						next[name] = append(next[name], pk)
+					case OnDeleteSetNull:
+						if cleared[name] == nil { cleared[name] = make(map[int64][]string, 0) }
+						cleared[name][pk] = append(cleared[name][pk], column)
+					default:
+						restricted = append(restricted, name)
+						restrictedKeys = append(restrictedKeys, pk)
+					}
+				}
+			}
+		}
+		pending = next
+	}
+
+	//Referencing rows which are deleted anyway don't restrict the deletion
+	for i, name := range restricted {
+		if !deleted[name][restrictedKeys[i]] {
+			return errors.New("memDB: Cannot delete rows of " + tableName + " referenced by " + name)
+		}
+	}
+
+	for name, rows := range cleared {
+		table := memDB.Tables[name]
+		for pk, columns := range rows {
+			if deleted[name][pk] { continue }
+			updated := make(MemRow, len(table.Rows[pk]))
+			for k, v := range table.Rows[pk] {
+				updated[k] = v
+			}
+			for _, column := range columns {
+				updated[column] = nil
+			}
+			err := memDB.record(memLogEntry{
+				Op: "update",
+				Table: name,
+				Key: pk,
+				Row: persistedRow(updated),
+			})
+			if err != nil { return err }
+		}
+	}
+	for name, rows := range deleted {
+		if len(rows) == 0 { continue }
+		keys := make([]int64, 0, len(rows))
+		for pk, _ := range rows {
+			keys = append(keys, pk)
+		}
+		err := memDB.record(memLogEntry{ Op: "delete", Table: name, Keys: keys })
+		if err != nil { return err }
+	}
+	return nil
+}
+
+//Wait for any open transaction to finish before modifying the database.
+// Returns the function which releases the lock.
+func (memDB *MemDB) writeLock() func() {
+	if memDB.inTx { return func(){} }
+	memDB.TxLock.RLock()
+	return memDB.TxLock.RUnlock
+}
+
+//A transaction on a MemDB. Queries are performed on a copy of the database,
+// which replaces the original when the transaction is committed. Only one
+// transaction may be open at a time, and other writes block until it finishes.
+type MemDBTx struct {
+	parent *MemDB
+	MemDB
+	done bool
+}
+
+func (memDB *MemDB) Begin() (AutoscopeTx, error) {
+	memDB.TxLock.Lock()
+	tx := &MemDBTx{ parent: memDB }
+	tx.Config = memDB.Config
+	tx.inTx = true
+	tx.txLog = make([]memLogEntry, 0)
+
+	//Rows are never modified in place, so copying each table's row map
+	// is enough to isolate the transaction from the original
+	memDB.TableLock.RLock()
+	tx.Tables = make(map[string]*MemTable, len(memDB.Tables))
+	for name, table := range memDB.Tables {
+		table.Lock.RLock()
+		clone := &MemTable{
+			Columns: make(map[string]string, len(table.Columns)),
+			Rows: make(map[int64]MemRow, len(table.Rows)),
+			LastIndex: table.LastIndex,
+			ForeignKeys: make(map[string]ForeignKey, len(table.ForeignKeys)),
+		}
+		for k, v := range table.Columns {
+			clone.Columns[k] = v
+		}
+		for k, v := range table.ForeignKeys {
+			clone.ForeignKeys[k] = v
+		}
+		for k, v := range table.Rows {
+			clone.Rows[k] = v
+		}
+		table.Lock.RUnlock()
+		tx.Tables[name] = clone
+	}
+	memDB.TableLock.RUnlock()
+	return tx, nil
+}
+
+func (tx *MemDBTx) Commit() error {
+	if tx.done { return errors.New("memDB: Transaction already finished") }
+	tx.done = true
+	defer tx.parent.TxLock.Unlock()
+
+	tx.parent.TableLock.Lock()
+	defer tx.parent.TableLock.Unlock()
+	if len(tx.txLog) > 0 {
+		err := tx.parent.appendLog(memLogEntry{ Op: "tx", Entries: tx.txLog })
+		if err != nil { return err }
+	}
+	tx.parent.Tables = tx.Tables
+	return nil
+}
+
+func (tx *MemDBTx) Rollback() error {
+	if tx.done { return nil }
+	tx.done = true
+	tx.parent.TxLock.Unlock()
+	return nil
+}
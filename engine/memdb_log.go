@@ -0,0 +1,371 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/* MemDB persistence
+
+   When Config.MemDBDataDir is set, every modification to a MemDB
+   (inserts, updates, deletes and migrations) is first appended to an
+   append-only log as a single line of JSON, and only then applied in memory.
+
+   Every Config.MemDBSnapshotInterval seconds the whole database is written
+   out as a compacted snapshot and the log is truncated. On Connect, the
+   snapshot is loaded and the log is replayed on top of it.
+
+   Log entries describe the resulting state of each affected row rather
+   than the query that produced it, so replaying an entry more than once
+   (e.g. after a crash between writing a snapshot and truncating the log)
+   is harmless.
+*/
+
+const (
+	memDBSnapshotFile = "memdb.snapshot"
+	memDBLogFile = "memdb.log"
+)
+
+//A single entry in the memdb append-only log
+type memLogEntry struct {
+	//One of insert, update, delete, create_table, promote_field,
+	// add_foreign_key, tx
+	Op string `json:"op"`
+	Table string `json:"table"`
+	//Primary key of the inserted or updated row
+	Key int64 `json:"key,omitempty"`
+	//Primary keys of deleted rows
+	Keys []int64 `json:"keys,omitempty"`
+	//Full contents of the inserted or updated row
+	Row persistedRow `json:"row,omitempty"`
+	//Columns of a created table
+	Columns map[string]string `json:"columns,omitempty"`
+	//Promoted column and its type
+	Column string `json:"column,omitempty"`
+	ColumnType string `json:"column_type,omitempty"`
+	//Foreign key declared for Column
+	ForeignKey *ForeignKey `json:"foreign_key,omitempty"`
+	//Entries of a committed transaction, which are written as a single
+	// line so that they are replayed either completely or not at all
+	Entries []memLogEntry `json:"entries,omitempty"`
+}
+
+//Serialized form of a MemTable
+type memSnapshotTable struct {
+	Columns map[string]string `json:"columns"`
+	LastIndex int64 `json:"last_index"`
+	Rows map[int64]persistedRow `json:"rows"`
+	ForeignKeys map[string]ForeignKey `json:"foreign_keys,omitempty"`
+}
+
+//JSON has no notion of int64 vs float64, so each persisted value
+// is stored alongside its autoscope type
+type persistedValue struct {
+	Type string `json:"t"`
+	Value interface{} `json:"v"`
+}
+
+//A row which retains the types of its values when serialized
+type persistedRow map[string]interface{}
+
+func (r persistedRow) MarshalJSON() ([]byte, error) {
+	typed := make(map[string]persistedValue, len(r))
+	for k, v := range r {
+		typed[k] = persistedValue{ Type: TypeFromValue(v), Value: v }
+	}
+	return json.Marshal(typed)
+}
+
+func (r *persistedRow) UnmarshalJSON(b []byte) error {
+	var typed map[string]persistedValue
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	err := d.Decode(&typed)
+	if err != nil { return err }
+
+	row := make(persistedRow, len(typed))
+	for k, pv := range typed {
+		v, err := pv.decode()
+		if err != nil { return err }
+		row[k] = v
+	}
+	*r = row
+	return nil
+}
+
+//Convert a persisted value back to the type it was stored as
+func (pv persistedValue) decode() (interface{}, error) {
+	switch pv.Type {
+	case "int":
+		n, ok := pv.Value.(json.Number)
+		if !ok { return nil, errors.New("memDB: Persisted int is not a number") }
+		return n.Int64()
+	case "float":
+		n, ok := pv.Value.(json.Number)
+		if !ok { return nil, errors.New("memDB: Persisted float is not a number") }
+		return n.Float64()
+	}
+	return plainJSONNumbers(pv.Value), nil
+}
+
+//Replace json.Numbers nested in a decoded value with float64s, matching
+// what encoding/json produces by default
+func plainJSONNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		f, _ := val.Float64()
+		return f
+	case map[string]interface{}:
+		for k, inner := range val {
+			val[k] = plainJSONNumbers(inner)
+		}
+	case []interface{}:
+		for i, inner := range val {
+			val[i] = plainJSONNumbers(inner)
+		}
+	}
+	return v
+}
+
+//Load the snapshot and log from the configured directory, then open the
+// log for appending
+func (memDB *MemDB) openPersistence(config *Config) error {
+	err := os.MkdirAll(config.MemDBDataDir, 0700)
+	if err != nil { return err }
+
+	err = memDB.loadSnapshot(filepath.Join(config.MemDBDataDir, memDBSnapshotFile))
+	if err != nil { return err }
+
+	logPath := filepath.Join(config.MemDBDataDir, memDBLogFile)
+	err = memDB.replayLog(logPath)
+	if err != nil { return err }
+
+	memDB.logFile, err = os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil { return err }
+
+	if config.MemDBSnapshotInterval > 0 {
+		go memDB.snapshotLoop(time.Duration(config.MemDBSnapshotInterval) * time.Second)
+	}
+	return nil
+}
+
+func (memDB *MemDB) loadSnapshot(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return err }
+
+	var tables map[string]memSnapshotTable
+	err = json.Unmarshal(contents, &tables)
+	if err != nil { return errors.New("memDB: Corrupt snapshot: " + err.Error()) }
+
+	for name, st := range tables {
+		table := &MemTable{
+			Columns: st.Columns,
+			Rows: make(map[int64]MemRow, len(st.Rows)),
+			LastIndex: st.LastIndex,
+			ForeignKeys: st.ForeignKeys,
+		}
+		if table.Columns == nil { table.Columns = make(map[string]string, 0) }
+		for key, row := range st.Rows {
+			table.Rows[key] = MemRow(row)
+		}
+		memDB.Tables[name] = table
+	}
+	log.Println("memDB: Loaded snapshot " + path)
+	return nil
+}
+
+//Replay every entry of the log at `path`. A partially written final entry,
+// as left behind by a crash mid-write, is discarded.
+func (memDB *MemDB) replayLog(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return err }
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	entries := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Println("memDB: Discarding incomplete log entry")
+				f.Close()
+				return os.Truncate(path, offset)
+			}
+			break
+		}
+		if err != nil { return err }
+
+		var entry memLogEntry
+		err = json.Unmarshal(line, &entry)
+		if err != nil { return errors.New("memDB: Corrupt log entry: " + err.Error()) }
+		err = memDB.applyEntry(entry)
+		if err != nil { return err }
+		offset += int64(len(line))
+		entries += 1
+	}
+	if entries > 0 {
+		log.Printf("memDB: Replayed %d log entries", entries)
+	}
+	return nil
+}
+
+//Append an entry to the log (if persistence is enabled), then apply it.
+// Within a transaction, the entry is kept until the transaction commits.
+// Callers must hold whichever locks applying the entry requires.
+func (memDB *MemDB) record(entry memLogEntry) error {
+	if memDB.inTx {
+		memDB.txLog = append(memDB.txLog, entry)
+	} else {
+		err := memDB.appendLog(entry)
+		if err != nil { return err }
+	}
+	return memDB.applyEntry(entry)
+}
+
+//Append an entry to the log, if persistence is enabled
+func (memDB *MemDB) appendLog(entry memLogEntry) error {
+	memDB.logLock.Lock()
+	defer memDB.logLock.Unlock()
+	if memDB.logFile == nil { return nil }
+
+	b, err := json.Marshal(entry)
+	if err != nil { return err }
+	_, err = memDB.logFile.Write(append(b, '\n'))
+	if err == nil && memDB.Config.MemDBSyncWrites {
+		err = memDB.logFile.Sync()
+	}
+	return err
+}
+
+//Apply a single log entry to the in-memory tables
+func (memDB *MemDB) applyEntry(entry memLogEntry) error {
+	table, ok := memDB.Tables[entry.Table]
+	switch entry.Op {
+	case "create_table":
+		if ok { return nil }
+		columns := make(map[string]string, len(entry.Columns))
+		for k, v := range entry.Columns {
+			columns[k] = v
+		}
+		memDB.Tables[entry.Table] = &MemTable{
+			Columns: columns,
+			Rows: make(map[int64]MemRow, 0),
+			LastIndex: 0,
+		}
+	case "promote_field":
+		if !ok { return errors.New("memDB: Cannot promote field of missing table " + entry.Table) }
+		table.Columns[entry.Column] = entry.ColumnType
+	case "add_foreign_key":
+		if !ok { return errors.New("memDB: Cannot add foreign key to missing table " + entry.Table) }
+		if entry.ForeignKey == nil { return errors.New("memDB: Foreign key missing from log entry") }
+		if table.ForeignKeys == nil {
+			table.ForeignKeys = make(map[string]ForeignKey, 0)
+		}
+		table.ForeignKeys[entry.Column] = *entry.ForeignKey
+	case "insert", "update":
+		//As with Insert, tables are created on first use
+		if !ok {
+			table = &MemTable{
+				Columns: make(map[string]string, 0),
+				Rows: make(map[int64]MemRow, 0),
+				LastIndex: 0,
+			}
+			memDB.Tables[entry.Table] = table
+		}
+		table.Rows[entry.Key] = MemRow(entry.Row)
+		if entry.Key > table.LastIndex {
+			table.LastIndex = entry.Key
+		}
+	case "delete":
+		if !ok { return nil }
+		for _, key := range entry.Keys {
+			delete(table.Rows, key)
+		}
+	case "tx":
+		for _, inner := range entry.Entries {
+			err := memDB.applyEntry(inner)
+			if err != nil { return err }
+		}
+	default:
+		return errors.New("memDB: Unknown log entry type " + entry.Op)
+	}
+	return nil
+}
+
+//Write a compacted snapshot of the database and truncate the log.
+// This is a no-op unless persistence is enabled.
+func (memDB *MemDB) Snapshot() error {
+	//Hold the table lock exclusively so no modifications occur while
+	// the snapshot is taken
+	memDB.TableLock.Lock()
+	defer memDB.TableLock.Unlock()
+	memDB.logLock.Lock()
+	defer memDB.logLock.Unlock()
+	if memDB.logFile == nil { return nil }
+
+	tables := make(map[string]memSnapshotTable, len(memDB.Tables))
+	for name, table := range memDB.Tables {
+		table.Lock.RLock()
+		rows := make(map[int64]persistedRow, len(table.Rows))
+		for key, row := range table.Rows {
+			rows[key] = persistedRow(row)
+		}
+		tables[name] = memSnapshotTable{
+			Columns: table.Columns,
+			LastIndex: table.LastIndex,
+			Rows: rows,
+			ForeignKeys: table.ForeignKeys,
+		}
+		table.Lock.RUnlock()
+	}
+	b, err := json.Marshal(tables)
+	if err != nil { return err }
+
+	//Write to a temporary file and rename it, so a crash never leaves
+	// a partially written snapshot behind
+	path := filepath.Join(memDB.Config.MemDBDataDir, memDBSnapshotFile)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil { return err }
+	_, err = tmp.Write(b)
+	if err == nil { err = tmp.Sync() }
+	if cerr := tmp.Close(); err == nil { err = cerr }
+	if err != nil { return err }
+	err = os.Rename(path + ".tmp", path)
+	if err != nil { return err }
+
+	return memDB.logFile.Truncate(0)
+}
+
+//Periodically write snapshots while the database is open
+func (memDB *MemDB) snapshotLoop(interval time.Duration){
+	for {
+		time.Sleep(interval)
+		memDB.logLock.Lock()
+		closed := memDB.logFile == nil
+		memDB.logLock.Unlock()
+		if closed { return }
+		err := memDB.Snapshot()
+		if err != nil { log.Println("memDB: Snapshot error: " + err.Error()) }
+	}
+}
+
+//Close the append-only log, if one is open
+func (memDB *MemDB) Close() error {
+	memDB.logLock.Lock()
+	defer memDB.logLock.Unlock()
+	if memDB.logFile == nil { return nil }
+	err := memDB.logFile.Close()
+	memDB.logFile = nil
+	return err
+}
@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"testing"
+	"io/ioutil"
+	"os"
+)
+
+//Helper to count rows in a memdb table matching a selection
+func memDBCount(t *testing.T, m *MemDB, table string, selection Formula) int {
+	res, err := m.Select(nil, nil, SelectQuery{ Table: table, Selection: selection })
+	if err != nil { t.Fatal(err.Error()) }
+	n := 0
+	for res.Next() { n += 1 }
+	return n
+}
+
+func TestMemDBPersistence(t *testing.T){
+	dir, err := ioutil.TempDir("", "autoscope_memdb")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+	config := &Config{ DatabaseType: "memdb", MemDBDataDir: dir }
+
+	var m MemDB
+	err = m.Connect(config)
+	if err != nil { t.Fatal(err.Error()) }
+
+	err = m.PerformMigration([]MigrationStep{
+		MigrationStepCreateTable{
+			tableName: "persisted",
+			table: Table{ Name: "persisted", Columns: map[string]string{ "id": "serial" } },
+		},
+		MigrationStepPromoteField{ tableName: "persisted", column: "name", columnType: "string" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+
+	for _, name := range []string{"a", "b", "c"} {
+		_, err = m.Insert(nil, InsertQuery{
+			Table: "persisted",
+			Data: map[string]interface{}{ "name": name, "count": 1, "price": 2.0 },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+	}
+	_, err = m.Update(nil, nil, UpdateQuery{
+		Table: "persisted",
+		Selection: ValueSelection{ Attr: "name", Value: "a", Op: "=" },
+		Data: map[string]interface{}{ "count": int64(2) },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = m.Delete(nil, nil, SelectQuery{
+		Table: "persisted",
+		Selection: ValueSelection{ Attr: "name", Value: "b", Op: "=" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	m.Close()
+
+	//Reopen the database: the log alone must restore its state
+	var m2 MemDB
+	err = m2.Connect(config)
+	if err != nil { t.Fatal(err.Error()) }
+	if m2.Tables["persisted"].Columns["name"] != "string" {
+		t.Fatal("Promoted field not restored")
+	}
+	if memDBCount(t, &m2, "persisted", nil) != 2 {
+		t.Fatal("Incorrect number of rows after replay")
+	}
+	if memDBCount(t, &m2, "persisted", ValueSelection{ Attr: "count", Value: int64(2), Op: "=" }) != 1 {
+		t.Fatal("Update not restored")
+	}
+	//Value types must survive the round trip
+	if memDBCount(t, &m2, "persisted", ValueSelection{ Attr: "price", Value: 2.0, Op: "=" }) != 2 {
+		t.Fatal("Float values not restored")
+	}
+
+	//Compact, write some more, and reopen from snapshot + log
+	err = m2.Snapshot()
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = m2.Insert(nil, InsertQuery{
+		Table: "persisted",
+		Data: map[string]interface{}{ "name": "d" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+
+	//Only committed transactions are persisted
+	for _, commit := range []bool{true, false} {
+		tx, err := m2.Begin()
+		if err != nil { t.Fatal(err.Error()) }
+		_, err = tx.Insert(nil, InsertQuery{
+			Table: "persisted",
+			Data: map[string]interface{}{ "name": "e" },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil { t.Fatal(err.Error()) }
+	}
+	m2.Close()
+
+	var m3 MemDB
+	err = m3.Connect(config)
+	if err != nil { t.Fatal(err.Error()) }
+	if memDBCount(t, &m3, "persisted", nil) != 4 {
+		t.Fatal("Incorrect number of rows after snapshot")
+	}
+	if m3.Tables["persisted"].LastIndex != 5 {
+		t.Fatal("Last index not restored")
+	}
+	m3.Close()
+}
@@ -81,3 +81,84 @@ func TestQueries(t *testing.T){
 		}
 	}
 }
+
+func TestMemDBForeignKeys(t *testing.T){
+	var m MemDB
+	m.Connect(nil)
+
+	steps := make([]MigrationStep, 0)
+	for _, name := range []string{"venues", "events", "tickets", "posters"} {
+		steps = append(steps, MigrationStepCreateTable{
+			tableName: name,
+			table: AddDefaultFields(Table{ Name: name, Columns: map[string]string{ "venue": "bigint", "event": "bigint" } }),
+		})
+	}
+	steps = append(steps,
+		MigrationStepAddForeignKey{ tableName: "events", column: "venue",
+			foreignKey: ForeignKey{ Table: "venues", OnDelete: OnDeleteCascade } },
+		MigrationStepAddForeignKey{ tableName: "tickets", column: "event",
+			foreignKey: ForeignKey{ Table: "events", OnDelete: OnDeleteCascade } },
+		MigrationStepAddForeignKey{ tableName: "posters", column: "venue",
+			foreignKey: ForeignKey{ Table: "venues", OnDelete: OnDeleteSetNull } },
+	)
+	err := m.PerformMigration(steps)
+	if err != nil { t.Fatal(err.Error()) }
+	schema, err := m.CurrentSchema()
+	if err != nil { t.Fatal(err.Error()) }
+	if schema["events"].ForeignKeys["venue"].Table != "venues" {
+		t.Fatal("Foreign key missing from schema")
+	}
+
+	insert := func(table string, data map[string]interface{}) int64 {
+		r, err := m.Insert(nil, InsertQuery{ Table: table, Data: data })
+		if err != nil { t.Fatal(err.Error()) }
+		id, _ := r.LastInsertId()
+		return id
+	}
+	venue := insert("venues", map[string]interface{}{})
+	event := insert("events", map[string]interface{}{ "venue": venue })
+	insert("tickets", map[string]interface{}{ "event": event })
+	insert("posters", map[string]interface{}{ "venue": venue })
+
+	//References to missing rows are rejected
+	_, err = m.Insert(nil, InsertQuery{ Table: "events", Data: map[string]interface{}{ "venue": venue + 10 } })
+	if err == nil { t.Fatal("Insert referencing a missing row allowed") }
+	_, err = m.Update(nil, nil, UpdateQuery{
+		Table: "events",
+		Selection: Tautology{},
+		Data: map[string]interface{}{ "venue": venue + 10 },
+	})
+	if err == nil { t.Fatal("Update referencing a missing row allowed") }
+
+	//Deletion cascades through events to tickets, and clears posters
+	_, err = m.Delete(nil, nil, SelectQuery{ Table: "venues", Selection: Tautology{} })
+	if err != nil { t.Fatal(err.Error()) }
+	if memDBCount(t, &m, "events", nil) != 0 || memDBCount(t, &m, "tickets", nil) != 0 {
+		t.Fatal("Delete did not cascade")
+	}
+	if memDBCount(t, &m, "posters", nil) != 1 {
+		t.Fatal("Poster deleted instead of cleared")
+	}
+	res, err := m.Select(nil, nil, SelectQuery{ Table: "posters" })
+	if err != nil { t.Fatal(err.Error()) }
+	poster, err := GetRow(res)
+	if err != nil { t.Fatal(err.Error()) }
+	if poster["venue"] != nil {
+		t.Fatal("Reference not cleared")
+	}
+
+	//Restricted references prevent deletion
+	err = m.PerformMigration([]MigrationStep{
+		MigrationStepAddForeignKey{ tableName: "posters", column: "event",
+			foreignKey: ForeignKey{ Table: "events", OnDelete: OnDeleteRestrict } },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	venue = insert("venues", map[string]interface{}{})
+	event = insert("events", map[string]interface{}{ "venue": venue })
+	insert("posters", map[string]interface{}{ "event": event })
+	_, err = m.Delete(nil, nil, SelectQuery{ Table: "venues", Selection: Tautology{} })
+	if err == nil { t.Fatal("Delete of a restricted reference allowed") }
+	if memDBCount(t, &m, "venues", nil) != 1 || memDBCount(t, &m, "events", nil) != 1 {
+		t.Fatal("Rows deleted despite restriction")
+	}
+}
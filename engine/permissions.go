@@ -4,12 +4,15 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"encoding/json"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"errors"
 )
 
 //  TODO: For efficiency, several optimizations need to be made here.
-//   - Caching of logged-in user group membership in the engine
 //   - For production mode, generation of UPDATE/SELECT queries that
 //     effectively perform user/group permission testing, rather than
 //     executing additional queries. This is unsuitable for debug mode,
@@ -19,6 +22,7 @@ type Permissions struct {
 	Read bool
 	Update bool
 	Insert bool
+	Delete bool
 }
 
 
@@ -26,23 +30,101 @@ type ObjectPermissions struct {
 	Owner Permissions
 	Group Permissions
 	Everyone Permissions
+	//Additional permissions granted on rows matching each rule's formula
+	Rules []PermissionRule
+}
+
+//Grants Permissions on the rows matching Formula, e.g. read on events
+// whose venue the user owns: `venue__autoscope_uid = $uid`. The value
+// "$uid" stands for the current user's id. Formulas may reference related
+// rows as in any selection. Rules grant read, update and delete, not insert.
+type PermissionRule struct {
+	Permissions Permissions
+	Formula Formula
+}
+
+//A PermissionRule as written in autoscope_permissions.yml and stored in
+// the permissions table, using the textual formula language
+type permissionRuleConfig struct {
+	Permissions string `yaml:"permissions" json:"permissions"`
+	Formula string `yaml:"formula" json:"formula"`
+}
+
+//Parse rules written in autoscope_permissions.yml or the permissions table
+func parseRules(configs []permissionRuleConfig) ([]PermissionRule, error) {
+	if len(configs) == 0 { return nil, nil }
+	rules := make([]PermissionRule, 0, len(configs))
+	for _, config := range configs {
+		p, err := PermissionsFromString(config.Permissions)
+		if err != nil { return nil, err }
+		f, err := ParseFormula(config.Formula)
+		if err != nil { return nil, err }
+		rules = append(rules, PermissionRule{ Permissions: p, Formula: f })
+	}
+	return rules, nil
+}
+
+//Encode rules to be stored in the permissions table
+func encodeRules(rules []PermissionRule) (string, error) {
+	if len(rules) == 0 { return "", nil }
+	configs := make([]permissionRuleConfig, 0, len(rules))
+	for _, rule := range rules {
+		f, err := FormatFormula(rule.Formula)
+		if err != nil { return "", err }
+		configs = append(configs, permissionRuleConfig{
+			Permissions: PermissionsToString(rule.Permissions),
+			Formula: f,
+		})
+	}
+	b, err := json.Marshal(configs)
+	return string(b), err
+}
+
+//Replace variables (i.e. "$uid") in a rule's formula with their values
+func substituteVariables(formula Formula, userId int64) Formula {
+	return ModifyLeaves(func(f Formula) Formula {
+		if vs, ok := f.(ValueSelection); ok && vs.Value == "$uid" {
+			vs.Value = userId
+			return vs
+		}
+		return f
+	}, formula)
+}
+
+//Prefix every attribute of a formula with a relation path, e.g. "venue__"
+func prefixAttrs(formula Formula, prefix string) Formula {
+	if prefix == "" { return formula }
+	return ModifyLeaves(func(f Formula) Formula {
+		switch leaf := f.(type) {
+		case ValueSelection:
+			leaf.Attr = prefix + leaf.Attr
+			return leaf
+		case AttrSelection:
+			leaf.AttrA = prefix + leaf.AttrA
+			leaf.AttrB = prefix + leaf.AttrB
+			return leaf
+		}
+		return f
+	}, formula)
 }
 
 func DefaultPermissions() ObjectPermissions {
 	return ObjectPermissions{
-		Owner: Permissions{ Read: true, Insert: true, Update: true},
+		Owner: Permissions{ Read: true, Insert: true, Update: true, Delete: true},
 		Group: Permissions{ Read: true, Insert: true },
 		Everyone: Permissions{},
 	}
 }
 
-//Turn a string e.g. "read, write" into Permissions{ Read: true, Update: true, Insert: true}
+//Turn a string e.g. "read, write" into Permissions{ Read: true, Update: true, Insert: true, Delete: true}.
+// "write" permits every modification, i.e. insert, update and delete.
 func PermissionsFromString(perms string) (Permissions, error) {
 	parts := strings.Split(strings.ToLower(strings.Replace(perms, " ", "", -1)), ",")
 	p := Permissions {
 		Read: false,
 		Update: false,
 		Insert: false,
+		Delete: false,
 	}
 	for _, part := range parts {
 		switch(part){
@@ -55,9 +137,13 @@ func PermissionsFromString(perms string) (Permissions, error) {
 		case "update":
 			p.Update = true
 			break
+		case "delete":
+			p.Delete = true
+			break
 		case "write":
 			p.Insert = true
 			p.Update = true
+			p.Delete = true
 			break
 		case "none":
 			break
@@ -68,58 +154,570 @@ func PermissionsFromString(perms string) (Permissions, error) {
 	return p, nil
 }
 
-//Extract autoscope table permissions from autoscope_permissions.yml
-func AutoscopePermissions() (map[string]ObjectPermissions, error){
+//Turn Permissions into a string accepted by PermissionsFromString,
+// e.g. Permissions{ Read: true, Update: true, Insert: true, Delete: true} into "read, write"
+func PermissionsToString(p Permissions) string {
+	parts := make([]string, 0)
+	if p.Read {
+		parts = append(parts, "read")
+	}
+	if p.Insert && p.Update && p.Delete {
+		parts = append(parts, "write")
+	} else {
+		if p.Insert { parts = append(parts, "insert") }
+		if p.Update { parts = append(parts, "update") }
+		if p.Delete { parts = append(parts, "delete") }
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+//Permissions of a table as written in autoscope_permissions.yml
+type permissionsConfig struct {
+	Owner string `yaml:"owner"`
+	Group string `yaml:"group"`
+	Everyone string `yaml:"everyone"`
+	//Permissions of individual fields: field -> entity -> permissions
+	Fields map[string]map[string]string `yaml:"fields"`
+	Rules []permissionRuleConfig `yaml:"rules"`
+}
+
+func readPermissionsConfig() (map[string]permissionsConfig, error){
 	contents, err := ioutil.ReadFile(os.Getenv("AUTOSCOPE_CONFIG_DIR") + "/autoscope_permissions.yml")
 	if err != nil {
 		log.Fatal("Failed to read autoscope_permissions.yml")
 	}
 
-	var permissions map[string]map[string]map[string]string
+	var permissions map[string]map[string]permissionsConfig
 	err = yaml.Unmarshal([]byte(contents), &permissions)
 	if err != nil {
 		log.Fatal("Failed to load yaml from config file: "+err.Error())
 	}
+	return permissions["permissions"], nil
+}
+
+//Parse the permissions of each entity (owner, group, everyone), using
+// `defaults` for those which are absent
+func objectPermissionsFromStrings(perms map[string]string, defaults map[string]string) (ObjectPermissions, error) {
+	actual := make(map[string]Permissions)
+	for entity, defs := range defaults {
+		str, ok := perms[entity]
+		if !ok || str == "" { str = defs }
+		p, err := PermissionsFromString(str)
+		if err != nil { return ObjectPermissions{}, err }
+		actual[entity] = p
+	}
+	return ObjectPermissions{
+		Owner: actual["owner"],
+		Group: actual["group"],
+		Everyone: actual["everyone"],
+	}, nil
+}
+
+//Extract autoscope table permissions from autoscope_permissions.yml
+func AutoscopePermissions() (map[string]ObjectPermissions, error){
+	permissions, err := readPermissionsConfig()
+	if err != nil { return nil, err }
+	defaults := map[string]string{
+		"owner": "read, write",
+		"group": "read",
+		"everyone": "none",
+	}
 	res := make(map[string]ObjectPermissions, 0)
-	for k, table := range permissions["permissions"] {
-		defaults := map[string]string{
-			"owner": "read, write",
-			"group": "read",
-			"everyone": "none",
+	for k, table := range permissions {
+		perms, err := objectPermissionsFromStrings(map[string]string{
+			"owner": table.Owner,
+			"group": table.Group,
+			"everyone": table.Everyone,
+		}, defaults)
+		if err != nil { return nil, err }
+		perms.Rules, err = parseRules(table.Rules)
+		if err != nil { return nil, err }
+		res[k] = perms
+	}
+	return res, nil
+}
+
+//Extract field permissions (table -> field -> permissions) from
+// autoscope_permissions.yml. Entities absent from a field's permissions
+// have the permissions they have for its table.
+func AutoscopeFieldPermissions() (map[string]map[string]ObjectPermissions, error){
+	permissions, err := readPermissionsConfig()
+	if err != nil { return nil, err }
+	tables, err := AutoscopePermissions()
+	if err != nil { return nil, err }
+	res := make(map[string]map[string]ObjectPermissions, 0)
+	for k, table := range permissions {
+		if len(table.Fields) == 0 { continue }
+		res[k] = make(map[string]ObjectPermissions, len(table.Fields))
+		defaults := PermissionsMap(tables[k])
+		for field, perms := range table.Fields {
+			res[k][field], err = objectPermissionsFromStrings(perms, defaults)
+			if err != nil { return nil, err }
 		}
-		actual := make(map[string]Permissions)
-		for entity, defs := range defaults {
-			if perms, ok := table[entity]; ok {
-				actual[entity], err = PermissionsFromString(perms)
-				if err != nil { return nil, err}
-			} else {
-				actual[entity], err = PermissionsFromString(defs)
-				if err != nil { return nil, err}
-			}
+	}
+	return res, nil
+}
+
+//Seed the permissions table with those in autoscope_permissions.yml, then
+// load it. Tables already present in the permissions table keep their
+// permissions, so changes made at runtime survive restarts.
+func (e *Engine) initPermissions() error {
+	configured, err := AutoscopePermissions()
+	if err != nil { return err }
+	stored, _, err := e.storedPermissions()
+	if err != nil { return err }
+	for tableName, perms := range configured {
+		if _, ok := stored[tableName]; ok { continue }
+		row, err := permissionsRow(tableName, perms)
+		if err != nil { return err }
+		_, err = e.RawInsert(InsertQuery{
+			Table: "autoscope_permissions",
+			Data: row,
+		})
+		if err != nil { return err }
+	}
+	err = e.seedFieldPermissions()
+	if err != nil { return err }
+	return e.loadPermissions()
+}
+
+//Reload table permissions from the database, in case they've been
+// changed by other nodes
+func (e *Engine) loadPermissions() error {
+	stored, owners, err := e.storedPermissions()
+	if err != nil { return err }
+	fields, err := e.storedFieldPermissions()
+	if err != nil { return err }
+	e.PermissionsLock.Lock()
+	defer e.PermissionsLock.Unlock()
+	for tableName, perms := range stored {
+		e.Permissions[tableName] = perms
+	}
+	e.FieldPermissions = fields
+	for tableName, owner := range owners {
+		e.TableOwners[tableName] = owner
+	}
+	return nil
+}
+
+//Read every table's permissions and owner from the permissions table
+func (e *Engine) storedPermissions() (map[string]ObjectPermissions, map[string]int64, error) {
+	res, _, err := e.RawSelect(SelectQuery{ Table: "autoscope_permissions" })
+	if err != nil { return nil, nil, err }
+	stored := make(map[string]ObjectPermissions, 0)
+	owners := make(map[string]int64, 0)
+	for res.Next() {
+		row, err := res.Get()
+		if err != nil { return nil, nil, err }
+		tableName := row["table_name"].(string)
+		stored[tableName], err = permissionsFromRow(row)
+		if err != nil { return nil, nil, err }
+		if owner, ok := idValue(row["owner_id"]); ok {
+			owners[tableName] = owner
+		}
+	}
+	return stored, owners, nil
+}
+
+//Parse a row of the permissions table
+func permissionsFromRow(row map[string]interface{}) (ObjectPermissions, error) {
+	actual := make(map[string]Permissions, 3)
+	for _, entity := range []string{"owner", "group", "everyone"} {
+		str, _ := row[entity + "_permissions"].(string)
+		p, err := PermissionsFromString(str)
+		if err != nil { return ObjectPermissions{}, err }
+		actual[entity] = p
+	}
+	perms := ObjectPermissions{
+		Owner: actual["owner"],
+		Group: actual["group"],
+		Everyone: actual["everyone"],
+	}
+	if str, _ := row["rules"].(string); str != "" {
+		var configs []permissionRuleConfig
+		err := json.Unmarshal([]byte(str), &configs)
+		if err != nil { return perms, err }
+		perms.Rules, err = parseRules(configs)
+		if err != nil { return perms, err }
+	}
+	return perms, nil
+}
+
+//Helper to build the permissions table row for a table
+func permissionsRow(tableName string, perms ObjectPermissions) (map[string]interface{}, error) {
+	rules, err := encodeRules(perms.Rules)
+	if err != nil { return nil, err }
+	return map[string]interface{}{
+		"table_name": tableName,
+		"owner_permissions": PermissionsToString(perms.Owner),
+		"group_permissions": PermissionsToString(perms.Group),
+		"everyone_permissions": PermissionsToString(perms.Everyone),
+		"rules": rules,
+	}, nil
+}
+
+//Change the permissions of a table, storing them so they're shared
+// with other nodes and persist across restarts
+func (e *Engine) SetTablePermissions(tableName string, perms ObjectPermissions) error {
+	row, err := permissionsRow(tableName, perms)
+	if err != nil { return err }
+	e.SchemaLock.RLock()
+	_, err = e.DB.Upsert(e.Schema, nil, UpsertQuery{
+		Table: "autoscope_permissions",
+		Keys: []string{"table_name"},
+		Data: row,
+	})
+	e.SchemaLock.RUnlock()
+	if err != nil { return err }
+
+	e.PermissionsLock.Lock()
+	e.Permissions[tableName] = perms
+	e.PermissionsLock.Unlock()
+	return nil
+}
+
+//Set up default permissions for a table without any, making `userId` its
+// owner. Tables are created by their first insert, so the user performing
+// it owns the table. Must be called with SchemaLock held.
+// Within a transaction, the claim only applies to the engine once the
+// transaction commits; see publishClaims.
+func (e *Engine) claimTable(db AutoscopeQueryer, tableName string, userId int64) error {
+	e.PermissionsLock.Lock()
+	defer e.PermissionsLock.Unlock()
+	if _, ok := e.Permissions[tableName]; ok { return nil }
+	tx, inTx := db.(*engineTx)
+	if inTx {
+		if _, ok := tx.claimed[tableName]; ok { return nil }
+	}
+
+	//Another node may have claimed the table first, in which case
+	// its row is left as is
+	data, err := permissionsRow(tableName, DefaultPermissions())
+	if err != nil { return err }
+	data["owner_id"] = userId
+	_, err = db.Upsert(e.Schema, nil, UpsertQuery{
+		Table: "autoscope_permissions",
+		Keys: []string{"table_name"},
+		Data: data,
+		Restriction: Not{ A: Tautology{} },
+	})
+	if err != nil { return err }
+
+	res, err := db.Select(e.Schema, nil, Filter("autoscope_permissions", map[string]interface{}{
+		"table_name": tableName,
+	}))
+	if err != nil { return err }
+	row, err := GetRow(res)
+	if err != nil { return err }
+	perms, err := permissionsFromRow(row)
+	if err != nil { return err }
+	permissions, owners := e.Permissions, e.TableOwners
+	if inTx {
+		permissions, owners = tx.claimed, tx.owners
+	}
+	permissions[tableName] = perms
+	if owner, ok := idValue(row["owner_id"]); ok {
+		owners[tableName] = owner
+	}
+	return nil
+}
+
+//Apply the tables claimed within a committed transaction. Permissions
+// loaded in the meantime are kept.
+func (e *Engine) publishClaims(tx *engineTx) {
+	e.PermissionsLock.Lock()
+	defer e.PermissionsLock.Unlock()
+	for tableName, perms := range tx.claimed {
+		if _, ok := e.Permissions[tableName]; ok { continue }
+		e.Permissions[tableName] = perms
+		if owner, ok := tx.owners[tableName]; ok {
+			e.TableOwners[tableName] = owner
 		}
-		res[k] = ObjectPermissions{
-			Owner: actual["owner"],
-			Group: actual["group"],
-			Everyone: actual["everyone"],
+	}
+}
+
+//Return the permissions of a table as seen by `db`, including those
+// of tables claimed within it if it's a transaction
+func (e *Engine) tablePermissionsOn(db AutoscopeQueryer, tableName string) (ObjectPermissions, bool) {
+	perms, ok := e.GetTablePermissions(tableName)
+	if ok { return perms, ok }
+	if tx, inTx := db.(*engineTx); inTx {
+		e.PermissionsLock.RLock()
+		perms, ok = tx.claimed[tableName]
+		e.PermissionsLock.RUnlock()
+	}
+	return perms, ok
+}
+
+//Return the owner of a table: the user whose insert created it
+func (e *Engine) TableOwner(tableName string) (int64, bool) {
+	return e.tableOwnerOn(e.DB, tableName)
+}
+
+//Return the owner of a table as seen by `db`, including tables claimed
+// within it if it's a transaction
+func (e *Engine) tableOwnerOn(db AutoscopeQueryer, tableName string) (int64, bool) {
+	e.PermissionsLock.RLock()
+	defer e.PermissionsLock.RUnlock()
+	owner, ok := e.TableOwners[tableName]
+	if _, claimed := e.Permissions[tableName]; !ok && !claimed {
+		if tx, inTx := db.(*engineTx); inTx {
+			owner, ok = tx.owners[tableName]
 		}
 	}
-	return res, nil
+	return owner, ok
+}
+
+//Return the schema visible to a user. Admins see every table. Users
+// with the view_schema capability see every application table, and
+// others only the tables and fields they can read; internal (autoscope_)
+// tables are hidden from both. If `objectFields` is true, the
+// ObjectFields of each table map fields stored outside columns to
+// their most common type.
+func (e *Engine) VisibleSchema(userId int64, objectFields bool) (map[string]Table, error) {
+	admin, err := IsAdmin(e, userId)
+	if err != nil { return nil, err }
+	viewAll, err := HasCapability(e, userId, CapViewSchema)
+	if err != nil { return nil, err }
+	groups, err := UserGroups(e, userId)
+	if err != nil { return nil, err }
+
+	e.SchemaLock.RLock()
+	schema := make(map[string]Table, len(e.Schema))
+	for name, table := range e.Schema {
+		schema[name] = table
+	}
+	e.SchemaLock.RUnlock()
+
+	visible := make(map[string]Table, 0)
+	for name, table := range schema {
+		if !admin && strings.HasPrefix(name, "autoscope_") { continue }
+		if objectFields {
+			table = e.withObjectFields(name, table)
+		}
+		if !admin && !viewAll {
+			var ok bool
+			table, ok, err = e.readableTable(name, table, userId, groups)
+			if err != nil { return nil, err }
+			if !ok { continue }
+		}
+		visible[name] = table
+	}
+	return visible, nil
+}
+
+//Return the part of a table a user can read, if any. Users can read a
+// table's rows if everyone may read them, if they're in one of the table's
+// groups and its group may read them, or if its owner may read them and
+// they can own rows, i.e. they own the table or may insert into it.
+// Any rule granting read permission also makes the table readable.
+func (e *Engine) readableTable(tableName string, table Table, userId int64, groups []int64) (Table, bool, error) {
+	perms, ok := e.GetTablePermissions(tableName)
+	if !ok { perms = DefaultPermissions() }
+	tableGroups, err := GetTableGroups(e, tableName)
+	if err != nil { return table, false, err }
+	member := false
+	for _, gid := range tableGroups {
+		if listContainsInt64(groups, gid) { member = true }
+	}
+	owner, owned := e.TableOwner(tableName)
+	ownsRows := (owned && owner == userId) || perms.Everyone.Insert ||
+		(perms.Group.Insert && member)
+
+	readable := fieldPermitted(perms, ReadAction, ownsRows, member)
+	for _, rule := range perms.Rules {
+		if ReadAction(rule.Permissions) { readable = true }
+	}
+	if !readable { return table, false, nil }
+
+	//Remove the fields which can't be read
+	fields := e.GetFieldPermissions(tableName)
+	if len(fields) == 0 { return table, true, nil }
+	filter := func(m map[string]string) map[string]string {
+		if m == nil { return nil }
+		res := make(map[string]string, len(m))
+		for field, info := range m {
+			fp, ok := fields[field]
+			if ok && !fieldPermitted(fp, ReadAction, ownsRows, member) { continue }
+			res[field] = info
+		}
+		return res
+	}
+	table.Columns = filter(table.Columns)
+	table.ObjectFields = filter(table.ObjectFields)
+	return table, true, nil
+}
+
+//Add the fields observed in a table's stats which aren't columns to its
+// ObjectFields, along with the type most rows use for them
+func (e *Engine) withObjectFields(tableName string, table Table) Table {
+	e.GlobalStatsLock.RLock()
+	defer e.GlobalStatsLock.RUnlock()
+	objectFields := make(map[string]string, len(table.ObjectFields))
+	for field, kind := range table.ObjectFields {
+		objectFields[field] = kind
+	}
+	for field, types := range e.GlobalStats[tableName].ObjectFieldCount {
+		if _, ok := table.Columns[field]; ok { continue }
+		if _, ok := objectFields[field]; ok { continue }
+		if kind := maxKey(types); kind != "" {
+			objectFields[field] = kind
+		}
+	}
+	table.ObjectFields = objectFields
+	return table
+}
+
+//Return the permissions of each entity (owner, group, everyone)
+// as strings, e.g. "read, write"
+func PermissionsMap(perms ObjectPermissions) map[string]string {
+	return map[string]string{
+		"owner": PermissionsToString(perms.Owner),
+		"group": PermissionsToString(perms.Group),
+		"everyone": PermissionsToString(perms.Everyone),
+	}
+}
+
+//Change some of the permissions of a table on behalf of `userId`,
+// recording the change in the audit table. `changes` maps entities
+// (owner, group, everyone) to permission strings, e.g. "read, write";
+// entities not present keep their current permissions.
+func (e *Engine) AdminSetTablePermissions(userId int64, tableName string, changes map[string]string) (ObjectPermissions, error) {
+	perms, ok := e.GetTablePermissions(tableName)
+	if !ok { perms = DefaultPermissions() }
+	previous := PermissionsMap(perms)
+
+	for entity, str := range changes {
+		p, err := PermissionsFromString(str)
+		if err != nil { return perms, err }
+		switch entity {
+		case "owner":
+			perms.Owner = p
+		case "group":
+			perms.Group = p
+		case "everyone":
+			perms.Everyone = p
+		default:
+			return perms, errors.New("Invalid permissions entity: " + entity)
+		}
+	}
+
+	err := e.SetTablePermissions(tableName, perms)
+	if err != nil { return perms, err }
+
+	details := make([]string, 0)
+	for _, entity := range []string{"owner", "group", "everyone"} {
+		current := PermissionsMap(perms)[entity]
+		if current != previous[entity] {
+			details = append(details, entity + ": " + previous[entity] + " -> " + current)
+		}
+	}
+	return perms, AuditPermissions(e, userId, tableName, "set_permissions", strings.Join(details, "; "))
+}
+
+//Associate a group with a table on behalf of `userId`, recording the change
+func (e *Engine) AdminAddTableGroup(userId int64, tableName string, groupId int64) error {
+	err := AddTableGroup(e, tableName, groupId)
+	if err != nil { return err }
+	return AuditPermissions(e, userId, tableName, "add_table_group", "group " + strconv.FormatInt(groupId, 10))
 }
 
-//Modify a SELECT or UPDATE to include necessary permissions in query
+//Remove a group from a table on behalf of `userId`, recording the change
+func (e *Engine) AdminRemoveTableGroup(userId int64, tableName string, groupId int64) error {
+	err := RemoveTableGroup(e, tableName, groupId)
+	if err != nil { return err }
+	return AuditPermissions(e, userId, tableName, "remove_table_group", "group " + strconv.FormatInt(groupId, 10))
+}
+
+//Make a group the default group of a table on behalf of `userId`,
+// recording the change
+func (e *Engine) AdminSetDefaultTableGroup(userId int64, tableName string, groupId int64) error {
+	err := SetDefaultTableGroup(e, tableName, groupId)
+	if err != nil { return err }
+	return AuditPermissions(e, userId, tableName, "set_default_table_group", "group " + strconv.FormatInt(groupId, 10))
+}
+
+//Record a change to permissions made by `userId`
+func AuditPermissions(e *Engine, userId int64, tableName string, action string, details string) error {
+	_, err := e.RawInsert(InsertQuery{
+		Table: "autoscope_permissions_audit",
+		Data: map[string]interface{}{
+			"time": time.Now().Unix(),
+			"user_id": userId,
+			"table_name": tableName,
+			"action": action,
+			"details": details,
+		},
+	})
+	return err
+}
+
+//Return the recorded changes to the permissions of a table, oldest first.
+// If `tableName` is empty, changes to every table are returned.
+func PermissionsAudit(e *Engine, tableName string) ([]map[string]interface{}, error) {
+	query := SelectQuery{ Table: "autoscope_permissions_audit" }
+	if tableName != "" {
+		query = Filter("autoscope_permissions_audit", map[string]interface{}{
+			"table_name": tableName,
+		})
+	}
+	res, _, err := e.RawSelect(query)
+	if err != nil { return nil, err }
+	buffered, err := BufferRetrievalResult(res)
+	if err != nil { return nil, err }
+	sort.SliceStable(buffered.Rows, func(i, j int) bool {
+		a, _ := idValue(buffered.Rows[i]["id"])
+		b, _ := idValue(buffered.Rows[j]["id"])
+		return a < b
+	})
+	return buffered.Rows, nil
+}
+
+//Modify a SELECT, UPDATE or DELETE to include necessary permissions in query
 // - `groups` is a list of groups including the given user
 //   NOTE: If access should be denied before querying, the returned bool is false.
 func AddPermissionsToSelection(selection Formula, permissions ObjectPermissions, userId int64, groups []int64, action func(Permissions) bool) (Formula, bool) {
-	//If everyone is allowed to perform this SELECT or UPDATE, do nothing
-	if action(permissions.Everyone){
+	permFormula, allow := permissionsFormula(permissions, "", userId, groups, action)
+	if !allow {
+		return nil, false
+	}
+	if permFormula == nil {
 		return selection, true
 	}
+	return And{
+		A: selection,
+		B: permFormula,
+	}, true
+}
+
+//Return a formula matching rows on which `action` is permitted, or nil if
+// it's permitted on every row. `prefix` is the relation path to the rows,
+// e.g. "venue__", or empty for rows of the table queried.
+// If the action is permitted on no row, the returned bool is false.
+func permissionsFormula(permissions ObjectPermissions, prefix string, userId int64, groups []int64, action func(Permissions) bool) (Formula, bool) {
+	//If everyone is allowed to perform this action, no restriction is needed
+	if action(permissions.Everyone){
+		return nil, true
+	}
+
+	//Rules granting this action
+	ruleFormulas := make([]Formula, 0)
+	for _, rule := range permissions.Rules {
+		if action(rule.Permissions) && rule.Formula != nil {
+			ruleFormulas = append(ruleFormulas,
+				prefixAttrs(substituteVariables(rule.Formula, userId), prefix))
+		}
+	}
 
 	// If no one can perform this action, return false
 	var permFormula Formula
 	if !action(permissions.Everyone) &&
 		!action(permissions.Group) &&
-		!action(permissions.Owner) {
+		!action(permissions.Owner) &&
+		len(ruleFormulas) == 0 {
 		return nil, false
 	}
 	
@@ -128,7 +726,7 @@ func AddPermissionsToSelection(selection Formula, permissions ObjectPermissions,
 		for _, gid := range groups {
 			groupFormulas = append(groupFormulas,
 				ValueSelection{
-					Attr: "autoscope_gid",
+					Attr: prefix + "autoscope_gid",
 					Value: gid,
 					Op: "=",
 				})
@@ -138,7 +736,7 @@ func AddPermissionsToSelection(selection Formula, permissions ObjectPermissions,
 	}
 	if action(permissions.Owner){
 		ownerFormula := ValueSelection{
-			Attr: "autoscope_uid",
+			Attr: prefix + "autoscope_uid",
 			Value: userId,
 			Op: "=",
 		}
@@ -152,16 +750,21 @@ func AddPermissionsToSelection(selection Formula, permissions ObjectPermissions,
 		}
 	}
 
+	if len(ruleFormulas) > 0 {
+		if permFormula == nil {
+			permFormula = NestOrs(ruleFormulas)
+		} else {
+			permFormula = Or{ A: permFormula, B: NestOrs(ruleFormulas) }
+		}
+	}
+
 	// If the user can't perform this action (not in any groups
 	// while only group members can perform the action, for example)
 	// return false. 
 	if permFormula == nil {
 		return nil, false
 	}
-	return And{
-		A: selection,
-		B: permFormula,
-	}, true
+	return permFormula, true
 }
 
 
@@ -196,6 +799,11 @@ func HasUpdatePermissions(e *Engine, tableName string, userId int64, rowUID int6
 	return hasPermission(e, tableName, userId, rowUID, rowGID, f)
 }
 
+func HasDeletePermissions(e *Engine, tableName string, userId int64, rowUID int64, rowGID int64) bool {
+	f := func(p Permissions) bool { return p.Delete }
+	return hasPermission(e, tableName, userId, rowUID, rowGID, f)
+}
+
 // Every table has some number of groups assigned that have insert permissions.
 // In the absence of a row-specific gid, the group of a row is considered
 // to be the union of all associated groups for its containing table. 
@@ -207,11 +815,83 @@ func AddTableGroup(e *Engine, tableName string, groupId int64) error {
 			"group_id": groupId,
 			},
 	})
-	return err
+	if err != nil { return err }
+	return e.invalidateGroupCache()
+}
+
+//Remove a group from those associated with a table
+func RemoveTableGroup(e *Engine, tableName string, groupId int64) error {
+	_, _, err := e.RawDelete(Filter("autoscope_table_groups", map[string]interface{}{
+		"table_name": tableName,
+		"group_id": groupId,
+	}))
+	if err != nil { return err }
+	return e.invalidateGroupCache()
+}
+
+//Make a group the default group of a table, to which rows inserted into
+// the table belong unless another is given. The group is added to the
+// table's groups if necessary.
+func SetDefaultTableGroup(e *Engine, tableName string, groupId int64) error {
+	_, _, err := e.RawUpdate(Update("autoscope_table_groups", map[string]interface{}{
+		"table_name": tableName,
+	}, map[string]interface{}{
+		"is_default": int64(0),
+	}))
+	if err != nil { return err }
+	e.SchemaLock.RLock()
+	_, err = e.DB.Upsert(e.Schema, nil, UpsertQuery{
+		Table: "autoscope_table_groups",
+		Keys: []string{"table_name", "group_id"},
+		Data: map[string]interface{}{
+			"table_name": tableName,
+			"group_id": groupId,
+			"is_default": int64(1),
+		},
+	})
+	e.SchemaLock.RUnlock()
+	if err != nil { return err }
+	return e.invalidateGroupCache()
 }
 
-//TODO: Cache group IDs for each table in memory
+//Return the default group of a table: the group made default by
+// SetDefaultTableGroup, or otherwise the first group added to the table.
+// Returns false if the table has no groups.
+func DefaultTableGroup(e *Engine, tableName string) (int64, bool, error) {
+	res, _, err := e.RawSelect(Filter("autoscope_table_groups", map[string]interface{}{
+		"table_name": tableName,
+	}))
+	if err != nil { return -1, false, err }
+
+	group, first, found := int64(-1), int64(0), false
+	for res.Next() {
+		g, err := res.Get()
+		if err != nil { return -1, false, err }
+		if isDefault, _ := idValue(g["is_default"]); isDefault == 1 {
+			return g["group_id"].(int64), true, nil
+		}
+		if id, _ := idValue(g["id"]); !found || id < first {
+			first, group, found = id, g["group_id"].(int64), true
+		}
+	}
+	return group, found, nil
+}
+
+//Return the IDs of the groups associated with a table.
+// Groups are cached; see group_cache.go.
 func GetTableGroups(e *Engine, tableName string) ([]int64, error){
+	return e.cachedGroups(func(c *GroupCache) ([]int64, bool) {
+		groups, ok := c.tables[tableName]
+		return groups, ok
+	}, func(c *GroupCache, groups []int64) {
+		c.tables[tableName] = groups
+	}, func() ([]int64, error) {
+		return storedTableGroups(e, tableName)
+	})
+}
+
+//Select the groups associated with a table, sorted by id
+func storedTableGroups(e *Engine, tableName string) ([]int64, error){
 	res, _, err := e.RawSelect(Filter("autoscope_table_groups", map[string]interface{}{
 		"table_name": tableName,
 	}))
@@ -223,28 +903,44 @@ func GetTableGroups(e *Engine, tableName string) ([]int64, error){
 		if err != nil { return nil, err }
 		groups = append(groups, g["group_id"].(int64))
 	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
 	return groups, err
 }
 
+//Test whether a user may insert into a table. Rows inserted have no owner
+// or group yet, so the owner and group of the table itself apply: its owner
+// is the user who created it, and its groups are those added by AddTableGroup.
 func HasInsertPermissions(e *Engine, tableName string, userId int64) (bool, error) {
-	f := func(p Permissions) bool { return p.Insert }
+	return hasInsertPermissionsOn(e, e.DB, tableName, userId)
+}
 
-	//If the table doesn't yet exist, we need to check against the default permissions
-	perms := DefaultPermissions()
-	if perms.Owner.Insert == true {
-		return true, nil
-	}
+//Test whether a user may insert into a table within `db`
+func hasInsertPermissionsOn(e *Engine, db AutoscopeQueryer, tableName string, userId int64) (bool, error) {
+	perms, ok := e.tablePermissionsOn(db, tableName)
 
-	//Test permissions for non-existent group, to efficiently test for Everyone = true
-	if hasPermission(e, tableName, userId, -1, -1, f){
+	//Default to disallowing all actions in the absence of permissions
+	if !ok { return false, nil }
+
+	if perms.Everyone.Insert {
 		return true, nil
 	}
+	if perms.Owner.Insert {
+		if owner, ok := e.tableOwnerOn(db, tableName); ok && owner == userId {
+			return true, nil
+		}
+	}
+	if !perms.Group.Insert {
+		return false, nil
+	}
 
-	//Test permissions for each table-group
-	groups, err := GetTableGroups(e, tableName)
+	//Test whether the user is in any of the table's groups
+	tableGroups, err := GetTableGroups(e, tableName)
+	if err != nil { return false, err }
+	if len(tableGroups) == 0 { return false, nil }
+	userGroups, err := UserGroups(e, userId)
 	if err != nil { return false, err }
-	for _, group := range groups {
-		if hasPermission(e, tableName, userId, -1, group, f){
+	for _, group := range tableGroups {
+		if listContainsInt64(userGroups, group) {
 			return true, nil
 		}
 	}
@@ -255,3 +951,4 @@ func HasInsertPermissions(e *Engine, tableName string, userId int64) (bool, erro
 func ReadAction(p Permissions) bool { return p.Read }
 func InsertAction(p Permissions) bool { return p.Insert }
 func UpdateAction(p Permissions) bool { return p.Update }
+func DeleteAction(p Permissions) bool { return p.Delete }
@@ -1,6 +1,9 @@
 package engine
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"reflect"
 	"strconv"
 	"math/rand"
 )
@@ -11,12 +14,308 @@ func TestLoadPermissions(t *testing.T){
 }
 
 
+func TestPermissionsToString(t *testing.T){
+	for _, perms := range []string{"none", "read", "read, write", "insert", "read, update", "insert, update", "update, delete"} {
+		p, err := PermissionsFromString(perms)
+		if err != nil { t.Fatal(err.Error()) }
+		if PermissionsToString(p) != perms {
+			t.Fatal("Expected " + perms + " but found " + PermissionsToString(p))
+		}
+	}
+}
+
+func TestInsertPermissions(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "inserter", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	otherUID, err := CreateUser(&e, "other_inserter", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	//Internal tables can't be inserted into
+	internal := []string{"autoscope_users", "autoscope_user_sessions", "autoscope_user_groups",
+		"autoscope_table_groups", "autoscope_permissions", "autoscope_table_stats"}
+	for _, table := range internal {
+		allowed, err := HasInsertPermissions(&e, table, uid)
+		if err != nil { t.Fatal(err.Error()) }
+		if allowed { t.Fatal("Insert allowed into " + table) }
+		_, err = e.Insert(uid, InsertQuery{
+			Table: table,
+			Data: map[string]interface{}{ "username": "intruder" },
+		})
+		if err == nil { t.Fatal("Insert into " + table + " succeeded") }
+	}
+
+	//The user creating a table owns it, and only they may insert into it
+	_, err = e.Insert(uid, InsertQuery{ Table: "owned", Data: map[string]interface{}{ "a": 1 } })
+	if err != nil { t.Fatal(err.Error()) }
+	if owner, ok := e.TableOwner("owned"); !ok || owner != uid {
+		t.Fatal("Creator doesn't own table")
+	}
+	_, err = e.Insert(uid, InsertQuery{ Table: "owned", Data: map[string]interface{}{ "a": 2 } })
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = e.Insert(otherUID, InsertQuery{ Table: "owned", Data: map[string]interface{}{ "a": 3 } })
+	if err == nil { t.Fatal("Insert allowed for user without permissions") }
+
+	//Members of the table's groups may insert
+	gid, err := CreateGroup(&e, "owned_inserters")
+	if err != nil { t.Fatal(err.Error()) }
+	err = AddTableGroup(&e, "owned", gid)
+	if err != nil { t.Fatal(err.Error()) }
+	err = AddUserToGroup(&e, otherUID, gid)
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = e.Insert(otherUID, InsertQuery{ Table: "owned", Data: map[string]interface{}{ "a": 3 } })
+	if err != nil { t.Fatal(err.Error()) }
+
+	//Unless groups may not insert
+	perms := DefaultPermissions()
+	perms.Group.Insert = false
+	err = e.SetTablePermissions("owned", perms)
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = e.Insert(otherUID, InsertQuery{ Table: "owned", Data: map[string]interface{}{ "a": 4 } })
+	if err == nil { t.Fatal("Insert allowed despite group permissions") }
+}
+
+func TestRowGroups(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "grouper", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	otherUID, err := CreateUser(&e, "other_grouper", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	gid, err := CreateGroup(&e, "grouper_group")
+	if err != nil { t.Fatal(err.Error()) }
+	err = AddUserToGroup(&e, uid, gid)
+	if err != nil { t.Fatal(err.Error()) }
+	defaultGID, err := CreateGroup(&e, "default_group")
+	if err != nil { t.Fatal(err.Error()) }
+	otherGID, err := CreateGroup(&e, "other_group")
+	if err != nil { t.Fatal(err.Error()) }
+
+	rowGroup := func(name string) (int64, bool) {
+		res, _, err := e.RawSelect(Filter("grouped", map[string]interface{}{ "name": name }))
+		if err != nil { t.Fatal(err.Error()) }
+		row, err := GetRow(res)
+		if err != nil { t.Fatal(err.Error()) }
+		return idValue(row["autoscope_gid"])
+	}
+	insert := func(name string, group *int64) error {
+		_, err := e.Insert(uid, InsertQuery{
+			Table: "grouped",
+			Data: map[string]interface{}{ "name": name, "autoscope_gid": otherGID },
+			Group: group,
+		})
+		return err
+	}
+
+	//Rows of tables without groups have no group
+	err = insert("none", nil)
+	if err != nil { t.Fatal(err.Error()) }
+	if _, ok := rowGroup("none"); ok { t.Fatal("Row given a group") }
+
+	//Rows may be given to groups the user is a member of
+	err = insert("own", &gid)
+	if err != nil { t.Fatal(err.Error()) }
+	if g, ok := rowGroup("own"); !ok || g != gid { t.Fatal("Row not given requested group") }
+	err = insert("other", &otherGID)
+	if err == nil { t.Fatal("Row given to group user isn't a member of") }
+
+	//Otherwise, rows belong to the table's default group
+	err = AddTableGroup(&e, "grouped", gid)
+	if err != nil { t.Fatal(err.Error()) }
+	err = insert("first", nil)
+	if err != nil { t.Fatal(err.Error()) }
+	if g, ok := rowGroup("first"); !ok || g != gid { t.Fatal("Row not given table's first group") }
+	err = SetDefaultTableGroup(&e, "grouped", defaultGID)
+	if err != nil { t.Fatal(err.Error()) }
+	err = insert("default", nil)
+	if err != nil { t.Fatal(err.Error()) }
+	if g, ok := rowGroup("default"); !ok || g != defaultGID { t.Fatal("Row not given default group") }
+
+	//Owners and groups can't be changed by updates
+	_, err = e.Update(uid, Update("grouped", map[string]interface{}{ "name": "own" },
+		map[string]interface{}{ "autoscope_gid": otherGID }))
+	if err == nil { t.Fatal("Group changed by update") }
+
+	//Only the owner of a row may change its owner and group
+	chown := func(userId int64, name string, owner *int64, group *int64) (int64, error) {
+		res, err := e.Chown(userId, ChownQuery{
+			Table: "grouped",
+			Selection: ValueSelection{ Attr: "name", Value: name, Op: "=" },
+			Owner: owner,
+			Group: group,
+		})
+		if err != nil { return 0, err }
+		return res.RowsAffected()
+	}
+	if n, err := chown(otherUID, "own", &otherUID, nil); err != nil || n != 0 {
+		t.Fatal("Row owner changed by non-owner")
+	}
+	if _, err := chown(uid, "own", nil, &otherGID); err == nil {
+		t.Fatal("Row given to group user isn't a member of")
+	}
+	if n, err := chown(uid, "none", nil, &gid); err != nil || n != 1 {
+		t.Fatal("Row group not changed")
+	}
+	if g, ok := rowGroup("none"); !ok || g != gid { t.Fatal("Incorrect group after chown") }
+	if n, err := chown(uid, "own", &otherUID, nil); err != nil || n != 1 {
+		t.Fatal("Row owner not changed")
+	}
+	if n, err := chown(uid, "own", &uid, nil); err != nil || n != 0 {
+		t.Fatal("Row owner changed by previous owner")
+	}
+
+	//Admins may change the owner and group of any row
+	adminGID, err := CreateGroup(&e, "admin")
+	if err != nil { t.Fatal(err.Error()) }
+	err = AddUserToGroup(&e, otherUID, adminGID)
+	if err != nil { t.Fatal(err.Error()) }
+	if n, err := chown(otherUID, "first", &otherUID, &otherGID); err != nil || n != 1 {
+		t.Fatal("Admin couldn't change row owner")
+	}
+}
+
+//Permission to update rows doesn't imply permission to delete them
+func TestDeletePermissions(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "deleter", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	for _, canDelete := range []bool{false, true} {
+		tableName := "delete_test_" + strconv.FormatBool(canDelete)
+		err = e.SetTablePermissions(tableName, ObjectPermissions{
+			Owner: Permissions{ Read: true, Update: true, Delete: canDelete },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+		_, err = e.RawInsert(InsertQuery{
+			Table: tableName,
+			Data: map[string]interface{}{ "intcol": 1, "autoscope_uid": uid },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+
+		res, err := e.Delete(uid, Filter(tableName, map[string]interface{}{ "intcol": 1 }))
+		if err != nil { t.Fatal(err.Error()) }
+		deleted, err := res.RowsAffected()
+		if err != nil { t.Fatal(err.Error()) }
+		if canDelete && deleted != 1 {
+			t.Fatal("DELETE not allowed despite permissions.")
+		}
+		if !canDelete && deleted != 0 {
+			t.Fatal("DELETE allowed despite contrary permissions.")
+		}
+	}
+
+	write, err := PermissionsFromString("write")
+	if err != nil { t.Fatal(err.Error()) }
+	if !write.Insert || !write.Update || !write.Delete {
+		t.Fatal("write doesn't permit every modification")
+	}
+}
+
+//Permissions are loaded from autoscope_permissions.yml at init,
+// and runtime changes persist across restarts
+func TestStoredPermissions(t *testing.T){
+	dir, err := ioutil.TempDir("", "autoscope_permissions")
+	if err != nil { t.Fatal(err.Error()) }
+	defer os.RemoveAll(dir)
+	config := Config{ DatabaseType: "memdb", MemDBDataDir: dir }
+
+	var e Engine
+	err = e.Init(&config)
+	if err != nil { t.Fatal(err.Error()) }
+	perms, ok := e.GetTablePermissions("autoscope_users")
+	if !ok || perms.Everyone.Read || !perms.Owner.Update {
+		t.Fatal("Configured permissions not loaded")
+	}
+
+	custom := ObjectPermissions{
+		Owner: Permissions{ Read: true },
+		Everyone: Permissions{ Read: true, Insert: true },
+	}
+	err = e.SetTablePermissions("autoscope_users", custom)
+	if err != nil { t.Fatal(err.Error()) }
+	err = e.SetTablePermissions("custom_table", custom)
+	if err != nil { t.Fatal(err.Error()) }
+	e.DB.(*MemDB).Close()
+
+	var e2 Engine
+	err = e2.Init(&config)
+	if err != nil { t.Fatal(err.Error()) }
+	for _, table := range []string{"autoscope_users", "custom_table"} {
+		perms, ok := e2.GetTablePermissions(table)
+		if !ok || !reflect.DeepEqual(perms, custom) {
+			t.Fatal("Permissions of " + table + " not persisted")
+		}
+	}
+}
+
+func TestAdminPermissions(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+
+	uid, err := CreateUser(&e, "admin_user", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	admin, err := IsAdmin(&e, uid)
+	if err != nil || admin { t.Fatal("User is admin without an admin group") }
+	gid, err := CreateGroup(&e, "admin")
+	if err != nil { t.Fatal(err.Error()) }
+	err = AddUserToGroup(&e, uid, gid)
+	if err != nil { t.Fatal(err.Error()) }
+	admin, err = IsAdmin(&e, uid)
+	if err != nil || !admin { t.Fatal("Admin group member not admin") }
+
+	//Invalid permissions are rejected and leave the table unchanged
+	_, err = e.AdminSetTablePermissions(uid, "venues", map[string]string{ "everyone": "read, fly" })
+	if err == nil { t.Fatal("Invalid permission accepted") }
+	_, err = e.AdminSetTablePermissions(uid, "venues", map[string]string{ "others": "read" })
+	if err == nil { t.Fatal("Invalid entity accepted") }
+	if _, ok := e.GetTablePermissions("venues"); ok {
+		t.Fatal("Permissions set despite invalid input")
+	}
+
+	perms, err := e.AdminSetTablePermissions(uid, "venues", map[string]string{ "everyone": "read" })
+	if err != nil { t.Fatal(err.Error()) }
+	expected := DefaultPermissions()
+	expected.Everyone.Read = true
+	if stored, _ := e.GetTablePermissions("venues"); !reflect.DeepEqual(perms, expected) || !reflect.DeepEqual(stored, expected) {
+		t.Fatal("Permissions not changed")
+	}
+
+	err = e.AdminAddTableGroup(uid, "venues", gid)
+	if err != nil { t.Fatal(err.Error()) }
+	groups, err := GetTableGroups(&e, "venues")
+	if err != nil || len(groups) != 1 || groups[0] != gid { t.Fatal("Table group not added") }
+	err = e.AdminRemoveTableGroup(uid, "venues", gid)
+	if err != nil { t.Fatal(err.Error()) }
+	groups, err = GetTableGroups(&e, "venues")
+	if err != nil || len(groups) != 0 { t.Fatal("Table group not removed") }
+
+	changes, err := PermissionsAudit(&e, "venues")
+	if err != nil { t.Fatal(err.Error()) }
+	actions := []string{"set_permissions", "add_table_group", "remove_table_group"}
+	if len(changes) != len(actions) { t.Fatal("Incorrect number of audited changes") }
+	for i, action := range actions {
+		if changes[i]["action"] != action || changes[i]["user_id"] != uid {
+			t.Fatal("Incorrect audit record for " + action)
+		}
+	}
+	if changes[0]["details"] != "everyone: none -> read" {
+		t.Fatal("Incorrect audit details: " + changes[0]["details"].(string))
+	}
+}
+
 //Helper to generate a random permissions object
 func randPermissions() Permissions{
 	return Permissions{
 		Read: rand.Float32() > 0.5,
 		Update: rand.Float32() > 0.5,
 		Insert: rand.Float32() > 0.5,
+		Delete: rand.Float32() > 0.5,
 	}
 }
 
@@ -163,3 +462,164 @@ func TestPermissions(t *testing.T){
 		}
 	}
 }
+
+//Rules grant permissions on rows related to the current user
+func TestPermissionRules(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "rule_owner", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	manager, err := CreateUser(&e, "rule_manager", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	insert := func(table string, data map[string]interface{}, fks map[string]string) int64 {
+		r, err := e.Insert(uid, InsertQuery{ Table: table, Data: data, ForeignKeys: fks })
+		if err != nil { t.Fatal(err.Error()) }
+		id, err := r.LastInsertId()
+		if err != nil { t.Fatal(err.Error()) }
+		return id
+	}
+	managed := insert("rule_venues", map[string]interface{}{ "manager": manager }, nil)
+	other := insert("rule_venues", map[string]interface{}{ "manager": uid }, nil)
+	for i, venue := range []int64{ managed, managed, other } {
+		insert("rule_events", map[string]interface{}{ "venue": venue, "sold": false, "code": int64(i) },
+			map[string]string{ "venue": "rule_venues" })
+	}
+	err = e.flushStatsToDB()
+	if err != nil { t.Fatal(err.Error()) }
+	err = e.loadGlobalStats()
+	if err != nil { t.Fatal(err.Error()) }
+
+	selectEvents := func() int {
+		res, err := e.Select(manager, SelectQuery{ Table: "rule_events", Selection: Tautology{} })
+		return countRows(t, res, err)
+	}
+	if selectEvents() != 0 {
+		t.Fatal("Events readable without permissions")
+	}
+
+	rule, err := ParseFormula(`venue__manager = $uid`)
+	if err != nil { t.Fatal(err.Error()) }
+	perms, _ := e.GetTablePermissions("rule_events")
+	perms.Rules = []PermissionRule{{ Permissions: Permissions{ Read: true }, Formula: rule }}
+	err = e.SetTablePermissions("rule_events", perms)
+	if err != nil { t.Fatal(err.Error()) }
+	if selectEvents() != 2 {
+		t.Fatal("Incorrect number of events readable through rule")
+	}
+
+	//Rules only grant the permissions they list
+	res, err := e.Update(manager, UpdateQuery{
+		Table: "rule_events",
+		Selection: Tautology{},
+		Data: map[string]interface{}{ "sold": true },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if updated, _ := res.RowsAffected(); updated != 0 {
+		t.Fatal("UPDATE allowed by a read rule")
+	}
+
+	//Rules are stored along with the table's permissions
+	stored, _, err := e.storedPermissions()
+	if err != nil { t.Fatal(err.Error()) }
+	if !reflect.DeepEqual(stored["rule_events"], perms) {
+		t.Fatal("Rules not stored")
+	}
+
+	//Relational rules restrict the rows upserts update, as for updates
+	perms.Everyone.Insert = true
+	perms.Rules = append(perms.Rules, PermissionRule{ Permissions: Permissions{ Update: true }, Formula: rule })
+	err = e.SetTablePermissions("rule_events", perms)
+	if err != nil { t.Fatal(err.Error()) }
+	upsert := func(code int64) int64 {
+		res, err := e.Upsert(manager, UpsertQuery{
+			Table: "rule_events",
+			Keys: []string{"code"},
+			Data: map[string]interface{}{ "code": code, "sold": true },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+		n, err := res.RowsAffected()
+		if err != nil { t.Fatal(err.Error()) }
+		return n
+	}
+	if upsert(0) != 1 {
+		t.Fatal("Upsert not allowed by an update rule")
+	}
+	if upsert(2) != 0 {
+		t.Fatal("Upsert allowed on a row the rule doesn't match")
+	}
+}
+
+//Users only see the tables and fields they can read
+func TestVisibleSchema(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb", AdminUsers: []string{ "schema_admin" } })
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "schema_owner", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	otherUID, err := CreateUser(&e, "schema_other", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	adminUID, err := CreateUser(&e, "schema_admin", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	for _, table := range []string{ "schema_private", "schema_public" } {
+		_, err = e.Insert(uid, InsertQuery{
+			Table: table,
+			Data: map[string]interface{}{ "name": "a", "secret": "b" },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+	}
+	perms := DefaultPermissions()
+	perms.Everyone.Read = true
+	err = e.SetTablePermissions("schema_public", perms)
+	if err != nil { t.Fatal(err.Error()) }
+	err = e.SetFieldPermissions("schema_public", "secret", ObjectPermissions{
+		Owner: Permissions{ Read: true },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = e.Migrate()
+	if err != nil { t.Fatal(err.Error()) }
+
+	hasField := func(table Table, field string) bool {
+		_, column := table.Columns[field]
+		_, object := table.ObjectFields[field]
+		return column || object
+	}
+
+	schema, err := e.VisibleSchema(uid, true)
+	if err != nil { t.Fatal(err.Error()) }
+	if _, ok := schema["schema_private"]; !ok {
+		t.Fatal("Owned table not visible")
+	}
+	if !hasField(schema["schema_public"], "secret") {
+		t.Fatal("Readable field not visible")
+	}
+	if _, ok := schema["autoscope_users"]; ok {
+		t.Fatal("Internal table visible")
+	}
+
+	schema, err = e.VisibleSchema(otherUID, true)
+	if err != nil { t.Fatal(err.Error()) }
+	if _, ok := schema["schema_private"]; ok {
+		t.Fatal("Unreadable table visible")
+	}
+	public, ok := schema["schema_public"]
+	if !ok || !hasField(public, "name") || hasField(public, "secret") {
+		t.Fatalf("Incorrect public table: %v", public)
+	}
+
+	//Readers see every application table, and admins internal tables too
+	err = AssignUserRole(&e, otherUID, RoleReader)
+	if err != nil { t.Fatal(err.Error()) }
+	schema, err = e.VisibleSchema(otherUID, false)
+	if err != nil { t.Fatal(err.Error()) }
+	if _, ok := schema["schema_private"]; !ok {
+		t.Fatal("Table not visible to reader")
+	}
+	schema, err = e.VisibleSchema(adminUID, false)
+	if err != nil { t.Fatal(err.Error()) }
+	if _, ok := schema["autoscope_users"]; !ok {
+		t.Fatal("Internal table not visible to admin")
+	}
+}
@@ -13,28 +13,106 @@ import (
 	"encoding/json"
 	"strings"
 	"strconv"
+	"sync"
+	"time"
+	"hash/fnv"
 	"github.com/lib/pq"
 )
 
 type PostgresDB struct {
 	connection *sql.DB
 	version string
+	//Server version as reported by server_version_num, e.g. 90500
+	versionNum int
+	//Postgres schema containing autoscope's tables
+	schemaName string
+	//Prefix prepended to the physical name of every table
+	prefix string
+	//Open transaction, if queries should be performed within one
+	tx *sql.Tx
+	//Names of unique indexes known to exist, used by upserts
+	uniqueIndexes *sync.Map
+	//Unique indexes created within the open transaction. They're only
+	// added to uniqueIndexes once it commits.
+	txIndexes map[string]bool
+}
+
+//The subset of methods shared by sql.DB and sql.Tx used to perform queries
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+//Return the transaction queries should be performed in, or the connection
+// pool if there is none
+func (postgresDB *PostgresDB) queryer() sqlQueryer {
+	if postgresDB.tx != nil {
+		return postgresDB.tx
+	}
+	return postgresDB.connection
+}
+
+//A transaction on a postgres database
+type PostgresTx struct {
+	PostgresDB
+}
+
+func (postgresDB *PostgresDB) Begin() (AutoscopeTx, error) {
+	tx, err := postgresDB.connection.Begin()
+	if err != nil { return nil, err }
+	ptx := &PostgresTx{ PostgresDB: *postgresDB }
+	ptx.tx = tx
+	ptx.txIndexes = make(map[string]bool, 0)
+	return ptx, nil
+}
+
+func (ptx *PostgresTx) Commit() error {
+	err := ptx.tx.Commit()
+	if err != nil { return err }
+	if ptx.uniqueIndexes != nil {
+		for name, _ := range ptx.txIndexes {
+			ptx.uniqueIndexes.Store(name, true)
+		}
+	}
+	return nil
+}
+
+func (ptx *PostgresTx) Rollback() error {
+	return ptx.tx.Rollback()
 }
 
 func (postgresDB *PostgresDB) Connect(config *Config) error {
 	if config == nil {
 		return errors.New("Config is nil")
 	}
-	if config.DB_USER == "" { return errors.New("No postgres user provided in config") }
-	if config.DB_PASSWORD == "" { return errors.New("No postgres password provided in config") }
-	if config.DB_NAME == "" { return errors.New("No postgres database name provided config") }
-	dbinfo := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable",
-		config.DB_USER, config.DB_PASSWORD, config.DB_NAME)
+	dbinfo, err := postgresDSN(config)
+	if err != nil { return err }
 	db, err := sql.Open("postgres", dbinfo)
 	if err != nil {
 		return err
 	}
+
+	//Configure the connection pool
+	if config.DB_MAX_OPEN_CONNS > 0 { db.SetMaxOpenConns(int(config.DB_MAX_OPEN_CONNS)) }
+	if config.DB_MAX_IDLE_CONNS > 0 { db.SetMaxIdleConns(int(config.DB_MAX_IDLE_CONNS)) }
+	if config.DB_CONN_MAX_LIFETIME > 0 {
+		db.SetConnMaxLifetime(time.Duration(config.DB_CONN_MAX_LIFETIME) * time.Second)
+	}
+	if config.DB_CONN_MAX_IDLE_TIME > 0 {
+		db.SetConnMaxIdleTime(time.Duration(config.DB_CONN_MAX_IDLE_TIME) * time.Second)
+	}
+
 	postgresDB.connection = db
+	postgresDB.uniqueIndexes = &sync.Map{}
+	postgresDB.schemaName = config.DB_SCHEMA
+	if postgresDB.schemaName == "" { postgresDB.schemaName = "public" }
+	postgresDB.prefix = strings.ToLower(config.DB_PREFIX)
+	err = postgresDB.ping(config)
+	if err != nil {
+		db.Close()
+		return err
+	}
 	err = postgresDB.setup()
 	if err != nil {
 		return err
@@ -42,10 +120,99 @@ func (postgresDB *PostgresDB) Connect(config *Config) error {
 	return err
 }
 
+//Build a connection string from the given config.
+// If DB_URL is set, it is returned unchanged.
+func postgresDSN(config *Config) (string, error) {
+	if config.DB_URL != "" {
+		return config.DB_URL, nil
+	}
+	if config.DB_USER == "" { return "", errors.New("No postgres user provided in config") }
+	if config.DB_PASSWORD == "" && config.DB_SSLCERT == "" {
+		return "", errors.New("No postgres password provided in config")
+	}
+	if config.DB_NAME == "" { return "", errors.New("No postgres database name provided config") }
+
+	sslmode := config.DB_SSLMODE
+	if sslmode == "" { sslmode = "disable" }
+
+	//Parameters are emitted in a fixed order to keep the DSN stable
+	params := [][2]string{
+		{"user", config.DB_USER},
+		{"password", config.DB_PASSWORD},
+		{"dbname", config.DB_NAME},
+		{"host", config.DB_HOST},
+		{"port", config.DB_PORT},
+		{"sslmode", sslmode},
+		{"sslcert", config.DB_SSLCERT},
+		{"sslkey", config.DB_SSLKEY},
+		{"sslrootcert", config.DB_SSLROOTCERT},
+		{"application_name", config.DB_APPLICATION_NAME},
+		{"search_path", config.DB_SEARCH_PATH},
+	}
+	if config.DB_CONNECT_TIMEOUT > 0 {
+		params = append(params, [2]string{"connect_timeout", strconv.FormatInt(config.DB_CONNECT_TIMEOUT, 10)})
+	}
+
+	parts := make([]string, 0)
+	for _, p := range params {
+		if p[1] == "" { continue }
+		parts = append(parts, p[0] + "=" + dsnValue(p[1]))
+	}
+	return strings.Join(parts, " "), nil
+}
+
+//Quote a value for use in a key=value connection string, as described
+// in the libpq documentation
+func dsnValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " '\\") {
+		return v
+	}
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	v = strings.Replace(v, "'", "\\'", -1)
+	return "'" + v + "'"
+}
+
+//Ping the database, retrying with exponential backoff as configured.
+// Errors are only returned once every attempt has failed.
+func (postgresDB *PostgresDB) ping(config *Config) error {
+	interval := time.Duration(config.DB_CONNECT_RETRY_INTERVAL) * time.Second
+	if interval <= 0 { interval = time.Second }
+	maxInterval := 30 * time.Second
+
+	var attempt int64
+	for {
+		err := postgresDB.connection.Ping()
+		if err == nil || attempt >= config.DB_CONNECT_RETRIES {
+			return err
+		}
+		attempt += 1
+		log.Printf("Postgres connection failed (%v). Retrying in %v (attempt %d of %d)",
+			err, interval, attempt, config.DB_CONNECT_RETRIES)
+		time.Sleep(interval)
+		interval *= 2
+		if interval > maxInterval { interval = maxInterval }
+	}
+}
+
+//Return the qualified physical name of the table backing `table`,
+// taking DB_SCHEMA and DB_PREFIX into account.
+// e.g. events -> "tenant1"."app1_events"
+func (postgresDB *PostgresDB) tableName(table string) string {
+	schemaName := postgresDB.schemaName
+	if schemaName == "" { schemaName = "public" }
+	//Unquoted identifiers are folded to lower case by postgres, and
+	// table names have always been used unquoted
+	return pq.QuoteIdentifier(schemaName) + "." + pq.QuoteIdentifier(postgresDB.prefix + strings.ToLower(table))
+}
+
+//Returns the current schema. Only tables in our postgres schema that
+// carry our prefix are included, with the prefix removed from their names.
 func (postgresDB *PostgresDB) CurrentSchema() (map[string]Table, error) {
 	tables := make(map[string]Table, 0)
+	schemaName := postgresDB.schemaName
+	if schemaName == "" { schemaName = "public" }
 	//Get schema information from information_schema.columns
-	rows, err := postgresDB.connection.Query("SELECT table_name, column_name, data_type, character_maximum_length, numeric_precision, numeric_precision_radix, numeric_scale from information_schema.columns WHERE table_schema = 'public'")
+	rows, err := postgresDB.connection.Query("SELECT table_name, column_name, data_type, character_maximum_length, numeric_precision, numeric_precision_radix, numeric_scale from information_schema.columns WHERE table_schema = $1", schemaName)
 	if err != nil {
 		return tables, err
 	}
@@ -61,6 +228,12 @@ func (postgresDB *PostgresDB) CurrentSchema() (map[string]Table, error) {
 			return tables, err
 		}
 
+		//Skip tables belonging to other prefixes, and the prefix registry.
+		// Prefixes can't overlap (see registerPrefix), so tables with
+		// our prefix are ours.
+		if tableName == prefixRegistry || !strings.HasPrefix(tableName, postgresDB.prefix) { continue }
+		tableName = tableName[len(postgresDB.prefix):]
+
 		//Populate possibly null values
 		if charMaxLen.Valid { ci.CharMaxLength = charMaxLen.Int64	}
 		if numericPrecision.Valid { ci.NumericPrecision = numericPrecision.Int64	}
@@ -79,7 +252,51 @@ func (postgresDB *PostgresDB) CurrentSchema() (map[string]Table, error) {
 		//Set the column information to the string version of ColumnInfo
 		tables[tableName].Columns[ci.Name] = ci.ToString()
 	}
-	return tables, nil
+	err = rows.Err()
+	if err != nil { return tables, err }
+
+	err = postgresDB.loadForeignKeys(schemaName, tables)
+	return tables, err
+}
+
+//Add the declared foreign keys of every table to `tables`
+func (postgresDB *PostgresDB) loadForeignKeys(schemaName string, tables map[string]Table) error {
+	rows, err := postgresDB.connection.Query(`SELECT tc.table_name, kcu.column_name, ccu.table_name, rc.delete_rule
+		FROM information_schema.table_constraints tc
+		JOIN information_schema.key_column_usage kcu
+			ON tc.constraint_name = kcu.constraint_name AND tc.table_schema = kcu.table_schema
+		JOIN information_schema.constraint_column_usage ccu
+			ON tc.constraint_name = ccu.constraint_name AND tc.table_schema = ccu.table_schema
+		JOIN information_schema.referential_constraints rc
+			ON tc.constraint_name = rc.constraint_name AND tc.table_schema = rc.constraint_schema
+		WHERE tc.constraint_type = 'FOREIGN KEY' AND tc.table_schema = $1`, schemaName)
+	if err != nil { return err }
+	defer rows.Close()
+	for rows.Next() {
+		var tableName, column, foreignTable, deleteRule string
+		err = rows.Scan(&tableName, &column, &foreignTable, &deleteRule)
+		if err != nil { return err }
+
+		//Skip tables belonging to other prefixes
+		if !strings.HasPrefix(tableName, postgresDB.prefix) || !strings.HasPrefix(foreignTable, postgresDB.prefix) {
+			continue
+		}
+		table, ok := tables[tableName[len(postgresDB.prefix):]]
+		if !ok { continue }
+		if table.ForeignKeys == nil {
+			table.ForeignKeys = make(map[string]ForeignKey, 0)
+			tables[table.Name] = table
+		}
+		fk := ForeignKey{ Table: foreignTable[len(postgresDB.prefix):], OnDelete: OnDeleteRestrict }
+		switch deleteRule {
+		case "CASCADE":
+			fk.OnDelete = OnDeleteCascade
+		case "SET NULL":
+			fk.OnDelete = OnDeleteSetNull
+		}
+		table.ForeignKeys[column] = fk
+	}
+	return rows.Err()
 }
 
 func (postgresDB *PostgresDB) PerformMigration(steps []MigrationStep) error {
@@ -94,6 +311,9 @@ func (postgresDB *PostgresDB) PerformMigration(steps []MigrationStep) error {
 		case MigrationStepIndexColumn:
 			err := postgresDB.MigrationIndexColumn(val)
 			if err != nil { return err }
+		case MigrationStepAddForeignKey:
+			err := postgresDB.MigrationAddForeignKey(val)
+			if err != nil { return err }
 		default:
 			return errors.New("Error. Unknown migration step type")
 		}
@@ -157,7 +377,7 @@ func (postgresDB *PostgresDB) PromoteUnassigned(tableName string) error {
 //Create a table in postgres
 // TODO: We must also copy over any data present in autoscope_unassigned
 func (postgresDB *PostgresDB) MigrationCreateTable(ct MigrationStepCreateTable) error {
-	queryStr := "CREATE TABLE " + ct.tableName + "(\n"
+	queryStr := "CREATE TABLE " + postgresDB.tableName(ct.tableName) + "(\n"
 	for column, _ := range ct.table.Columns {
 		queryStr += column
 		queryStr += " " + postgresColumnType(ct.table, column)
@@ -184,7 +404,7 @@ func (postgresDB *PostgresDB) MigrationPromoteField(pf MigrationStepPromoteField
 		return errors.New("MigrationPromoteField: Empty column or no type for column '"+pf.column+"' in table '"+pf.table.Name+"'")
 	}
 	
-	queryStr := "ALTER TABLE " + pf.tableName + " ADD COLUMN " + pf.column + " " + postgresColumnType(pf.table, pf.column) + " " + postgresConstraints(pf.table, pf.column)
+	queryStr := "ALTER TABLE " + postgresDB.tableName(pf.tableName) + " ADD COLUMN " + pf.column + " " + postgresColumnType(pf.table, pf.column) + " " + postgresConstraints(pf.table, pf.column)
 	log.Println(queryStr)
 	_, err := postgresDB.connection.Exec(queryStr)
 	if err != nil {	return err }
@@ -202,7 +422,7 @@ func (postgresDB *PostgresDB) MigrationPromoteField(pf MigrationStepPromoteField
 		//postgresDB.PromoteUnassigned(ct.tableName)
 		return nil
 	}
-	rows, err := postgresDB.connection.Query("SELECT id, autoscope_objectfields FROM " + pf.tableName + " WHERE autoscope_objectfields ->> "+jsonProp(pf.column)+" != '')")
+	rows, err := postgresDB.connection.Query("SELECT id, autoscope_objectfields FROM " + postgresDB.tableName(pf.tableName) + " WHERE autoscope_objectfields ->> "+jsonProp(pf.column)+" != '')")
 	if err != nil {	return err }
 	
 	defer rows.Close()	
@@ -230,7 +450,7 @@ func (postgresDB *PostgresDB) MigrationPromoteField(pf MigrationStepPromoteField
 			return err
 		}
 
-		queryStr = "UPDATE " + pf.tableName + " SET"
+		queryStr = "UPDATE " + postgresDB.tableName(pf.tableName) + " SET"
 		queryStr += " \"" + pf.column + "\" = ?, "
 		queryStr += " autoscope_objectfields = ? "
 		queryStr += " WHERE id = ?"
@@ -248,6 +468,38 @@ func (postgresDB *PostgresDB) MigrationIndexColumn(pf MigrationStepIndexColumn)
 	return nil
 }
 
+//Add a FOREIGN KEY constraint for a declared foreign key
+func (postgresDB *PostgresDB) MigrationAddForeignKey(fk MigrationStepAddForeignKey) error {
+	queryStr, err := postgresDB.addForeignKeySQL(fk)
+	if err != nil { return err }
+	log.Println("MIGRATION: " + queryStr)
+	_, err = postgresDB.connection.Exec(queryStr)
+	return err
+}
+
+//Generate the ALTER TABLE statement adding a foreign key constraint.
+// The constraint is NOT VALID, so it applies to new and modified rows
+// without failing on rows inserted before the key was declared.
+func (postgresDB *PostgresDB) addForeignKeySQL(fk MigrationStepAddForeignKey) (string, error) {
+	onDelete := map[string]string{
+		"": "RESTRICT",
+		OnDeleteRestrict: "RESTRICT",
+		OnDeleteCascade: "CASCADE",
+		OnDeleteSetNull: "SET NULL",
+	}
+	action, ok := onDelete[fk.foreignKey.OnDelete]
+	if !ok {
+		return "", errors.New("Unknown on delete behaviour '" + fk.foreignKey.OnDelete + "' for foreign key " + fk.tableName + "." + fk.column)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(postgresDB.tableName(fk.tableName) + "(" + fk.column + ")"))
+	name := "autoscope_fk_" + strconv.FormatUint(h.Sum64(), 16)
+	return "ALTER TABLE " + postgresDB.tableName(fk.tableName) +
+		" ADD CONSTRAINT " + name +
+		" FOREIGN KEY (" + pq.QuoteIdentifier(fk.column) + ")" +
+		" REFERENCES " + postgresDB.tableName(fk.foreignKey.Table) + " (id)" +
+		" ON DELETE " + action + " NOT VALID", nil
+}
 
 type PostgresRetrievalResult struct {
 	Table Table
@@ -490,24 +742,19 @@ func RelationalQueryTransform(schema map[string]Table, prefixes map[string]Relat
 }
 
 //Internal function to generate a where clause for a SELECT, DELETE, or UPDATE
-func (postgresDB *PostgresDB) generateWhere(schema map[string]Table, prefixes map[string]RelationPath, query SelectQuery) (string, SQLPart, error) {
+// Returns the table which should be queried (either query.Table, or
+// autoscope_unassigned if it hasn't yet been created), the LEFT JOINs
+// needed for relational restrictions and the WHERE clause itself.
+func (postgresDB *PostgresDB) generateWhere(schema map[string]Table, prefixes map[string]RelationPath, query SelectQuery) (string, string, SQLPart, error) {
 	query.Table = strings.ToLower(query.Table)
-
-	wildcard := false
-	switch query.Selection.(type) {
-	case Tautology:
-		wildcard = true
-	}
 	if query.Selection == nil {
-		wildcard = true
-	}
-	
-	//If there are no query criteria, we assume all rows are being requested
-	if wildcard {
-		log.Println("Wildcard search. Not generating any SQL")
-		return "", SQLPart{}, nil
+		query.Selection = Tautology{}
 	}
 
+	//Record which prefixes refer to tables that haven't been created
+	// so we can create queries accordingly
+	unassigned := make(map[string]bool, 0)
+
 	//If the table given by `query` doesn't exist, we need to
 	// query autoscope_unassigned instead and modify the WHERE clause
 	// appropriately
@@ -517,33 +764,38 @@ func (postgresDB *PostgresDB) generateWhere(schema map[string]Table, prefixes ma
 			B: ValueSelection{ Attr: "table_name", Value: query.Table, Op: "=" },
 		}
 		query.Table = "autoscope_unassigned"
+		unassigned["__root"] = true
+	}
+
+	//If there are no query criteria, we assume all rows are being requested
+	if _, ok := query.Selection.(Tautology); ok {
+		log.Println("Wildcard search. Not generating any SQL")
+		return query.Table, "", SQLPart{}, nil
 	}
 
 	queryStr := ""
 
-	//Transform our attribute names appropriately where necessary
-	transformed := RelationalQueryTransform(schema, prefixes, query)
+	//Record which prefixes refer to tables that haven't been created
+	for prefix, path := range prefixes {
+		if _, ok := schema[path.Table]; !ok {
+			unassigned[prefix] = true
+		}
+	}
+
+	//Transform our attribute names appropriately where necessary.
+	// Selections on many-to-many fields become EXISTS subqueries.
+	fn := func(f Formula) Formula {
+		transformed := relationalFormulaTransform(schema, prefixes, f, query.Table)
+		return postgresDB.relationExists(schema, prefixes, unassigned, f, transformed)
+	}
+	transformed := query
+	transformed.Selection = ModifyLeaves(fn, query.Selection)
 
 	//Generate the WHERE clause
 	whereClause, err := transformed.Selection.toSQL()
 	if err != nil {
 		log.Println("Error generating where clause: "+err.Error())
-		return "", SQLPart{}, err
-	}
-
-	//Replace identifiers
-	whereClauseSQL := replaceIdentifiers(whereClause.SQL, whereClause.Idents)
-
-	//Replace ?s with $1s
-	whereClauseSQL = questionToPositional(whereClauseSQL, 1)
-
-	//Record which prefixes refer to tables that haven't been created
-	// so we can create queries accordingly
-	unassigned := make(map[string]bool, 0)
-
-	//If the starting table hasn't yet been created, mark it as unassigned
-	if _, ok := schema[query.Table]; !ok {
-		unassigned["__root"] = true
+		return "", "", SQLPart{}, err
 	}
 
 	// Sort prefixes by prefix length - this implicitly captures
@@ -555,59 +807,226 @@ func (postgresDB *PostgresDB) generateWhere(schema map[string]Table, prefixes ma
 	}
 	sort.Sort(ByLength(sortedPrefixes))
 
-	//Add relational joins
+	//Add relational joins. Prefixes reached through a many-to-many field
+	// or a reverse relation are joined within their EXISTS subquery instead.
 	for _, prefix := range sortedPrefixes {
+		if existsRoot(prefixes, prefix) != "" { continue }
 		path := prefixes[prefix]
 		joinTable := path.Table
 		additionalRestrictions := ""
 
 		//If table doesn't exist, we need to use autoscope_unassigned table instead
-		if _, ok := schema[path.Table]; !ok {
+		if unassigned[prefix] {
 			joinTable = "autoscope_unassigned"
-			//Record that this prefix refers to an unassigned table
-			unassigned[prefix] = true
 		}
 
+		fromTableSelection := relationIdAccess(schema, unassigned, path.FromTable, path.FromTablePrefix, path.FromField)
+		queryStr += "LEFT JOIN " + postgresDB.tableName(joinTable) + " " + prefix
+		queryStr += " on " + fromTableSelection + " = " + prefix + ".id"
+		queryStr += " " + additionalRestrictions + "\n"
+	}
+	log.Println("Generating where clause: "+queryStr)
+	log.Println(whereClause)
+	return query.Table, queryStr, whereClause, nil
+}
+
+//Return the SQL accessing the id stored in `field` of the row at `prefix`
+func relationIdAccess(schema map[string]Table, unassigned map[string]bool, table string, prefix string, field string) string {
+	_, columnExists := schema[table].Columns[field]
+	_, hasObjectfieldsCol := schema[table].Columns["autoscope_objectfields"]
+
+	if unassigned[prefix] {
 		//If the table we're coming from doesn't exist, we need to use
-		// (fromTablePrefix.data->>col)::int instead of fromTablePrefix.col
-		// since fromTablePrefix refers to autoscope_unassigned
-		var fromTableSelection string //  := path.FromTablePrefix + "." + path.FromField
+		// (prefix.autoscope_objectfields->>col)::int instead of prefix.col
+		// since prefix refers to autoscope_unassigned
+		return "(" + prefix + ".autoscope_objectfields->>" + jsonProp(field) + ")::int"
+	} else if hasObjectfieldsCol && !columnExists {
+		//If the table exists but the column doesn't, we need to access
+		// the autoscope_objectfields column
+		return "(" + prefix + ".autoscope_objectfields->>" + jsonProp(field) + ")::int"
+	}
+	// If autoscope_objectfields column also doesn't exist,
+	// we need to bail out and use the autoscope_unassigned table until
+	// it does.
+	return prefix + "." + field
+}
 
-		_, columnExists := schema[path.FromTable].Columns[path.FromField]
-		_, hasObjectfieldsCol := schema[path.FromTable].Columns["autoscope_objectfields"]
-		
-		if _, ok := unassigned[path.FromTablePrefix]; ok {
-			fromTableSelection = path.FromTablePrefix + ".autoscope_objectfields->>" + jsonProp(path.FromField)
-			fromTableSelection = "(" + fromTableSelection + ")::int"
-
-		} else if hasObjectfieldsCol && !columnExists {
-			//If the table exists but the column doesn't, we need to access
-			// the autoscope_objectfields column
-			fromTableSelection = path.FromTablePrefix + ".autoscope_objectfields->>" + jsonProp(path.FromField)
-			fromTableSelection = "(" + fromTableSelection + ")::int"
+//Return the outermost prefix of `prefix` (possibly itself) which is reached
+// through a many-to-many field or a reverse relation, or "" if there is none.
+// Such relations may match many rows, so they are queried with EXISTS.
+func existsRoot(prefixes map[string]RelationPath, prefix string) string {
+	current := ""
+	for _, field := range strings.Split(strings.TrimPrefix(prefix, "__"), "__") {
+		current += "__" + field
+		if kind := prefixes[current].Kind; kind == RelationThrough || kind == RelationReverse {
+			return current
+		}
+	}
+	return ""
+}
+
+//Return the prefixes an attribute depends upon, e.g. __band and
+// __band__artists for band__artists__name
+func attrPrefixes(attr string) []string {
+	parts := strings.Split(attr, "__")
+	res := make([]string, 0)
+	current := ""
+	for _, field := range parts[0:len(parts) - 1] {
+		current += "__" + field
+		res = append(res, current)
+	}
+	return res
+}
+
+//A selection which holds if a correlated subquery finds any row matching A.
+// Query is a SELECT whose WHERE clause links it to the outer query; its
+// placeholders are filled by Args.
+type existsSelection struct {
+	Query string
+	Args []interface{}
+	A Formula
+}
+
+func (es existsSelection) toSQL() (SQLPart, error) {
+	inner, err := es.A.toSQL()
+	if err != nil { return SQLPart{}, err }
+	//Identifiers are substituted with Sprintf, so the query itself must
+	// not contain any formatting verbs
+	query := strings.Replace(es.Query, "%", "%%", -1)
+	args := append(append([]interface{}{}, es.Args...), inner.Args...)
+	return SQLPart{SQL: "EXISTS (" + query + " AND (" + inner.SQL + "))",
+		Idents: inner.Idents,
+		Args: args}, nil
+}
+func (es existsSelection) validateSemantics(t *SchemaInfo) bool {
+	return es.A.validateSemantics(t)
+}
+
+//If the leaf selection `original` refers to fields reached through a
+// many-to-many field or a reverse relation, wrap its transformed version in
+// an EXISTS subquery joining the related tables, so that it holds if any
+// related row matches.
+func (postgresDB *PostgresDB) relationExists(schema map[string]Table, prefixes map[string]RelationPath, unassigned map[string]bool, original Formula, transformed Formula) Formula {
+	attrs := make([]string, 0)
+	switch original.(type) {
+	case AttrSelection:
+		attrs = append(attrs, original.(AttrSelection).AttrA, original.(AttrSelection).AttrB)
+	case ValueSelection:
+		attrs = append(attrs, original.(ValueSelection).Attr)
+	}
+
+	//Collect every prefix which must be joined within the subquery
+	needed := make(map[string]bool, 0)
+	for _, attr := range attrs {
+		for _, prefix := range attrPrefixes(attr) {
+			if existsRoot(prefixes, prefix) != "" {
+				needed[prefix] = true
+			}
+		}
+	}
+	if len(needed) == 0 {
+		return transformed
+	}
+	sortedPrefixes := make([]string, 0)
+	for prefix, _ := range needed {
+		sortedPrefixes = append(sortedPrefixes, prefix)
+	}
+	sort.Sort(ByLength(sortedPrefixes))
+
+	fromSQL := ""
+	whereSQL := ""
+	fromArgs := make([]interface{}, 0)
+	whereArgs := make([]interface{}, 0)
+	for _, prefix := range sortedPrefixes {
+		path := prefixes[prefix]
+		joinTable := path.Table
+		if unassigned[prefix] {
+			joinTable = "autoscope_unassigned"
+		}
+		fromId := path.FromTablePrefix + ".id"
+		if path.Kind == RelationReverse {
+			//Rows of the related table reference the row we're coming from
+			refAccess := relationIdAccess(schema, unassigned, path.Table, prefix, path.ReverseField)
+			restriction := ""
+			if unassigned[prefix] {
+				restriction = " AND " + prefix + ".table_name = ?"
+			}
+			if fromSQL == "" {
+				fromSQL = "FROM " + postgresDB.tableName(joinTable) + " " + prefix
+				whereSQL = " WHERE " + refAccess + " = " + fromId + restriction
+				if restriction != "" { whereArgs = append(whereArgs, path.Table) }
+			} else {
+				fromSQL += " JOIN " + postgresDB.tableName(joinTable) + " " + prefix +
+					" ON " + refAccess + " = " + fromId + restriction
+				if restriction != "" { fromArgs = append(fromArgs, path.Table) }
+			}
+			continue
+		}
+		if path.Kind != RelationThrough {
+			fromSQL += " LEFT JOIN " + postgresDB.tableName(joinTable) + " " + prefix +
+				" ON " + relationIdAccess(schema, unassigned, path.FromTable, path.FromTablePrefix, path.FromField) +
+				" = " + prefix + ".id"
+			continue
+		}
+
+		//Rows are linked by from_id and to_id columns of the through table,
+		// which live in autoscope_unassigned until it has been created
+		link := prefix + "__m2m"
+		throughTable := path.ThroughTable
+		linkAccess := link + ".from_id"
+		targetAccess := link + ".to_id"
+		restriction := ""
+		if _, ok := schema[path.ThroughTable]; !ok {
+			throughTable = "autoscope_unassigned"
+			linkAccess = "(" + link + ".autoscope_objectfields->>'from_id')::int"
+			targetAccess = "(" + link + ".autoscope_objectfields->>'to_id')::int"
+			restriction = " AND " + link + ".table_name = ?"
+		}
+		if fromSQL == "" {
+			//The first related table links the subquery to the outer query
+			fromSQL = "FROM " + postgresDB.tableName(throughTable) + " " + link
+			whereSQL = " WHERE " + linkAccess + " = " + fromId + restriction
+			if restriction != "" { whereArgs = append(whereArgs, path.ThroughTable) }
 		} else {
-			// If autoscope_objectfields column also doesn't exist,
-			// we need to bail out and use the autoscope_unassigned table until
-			// it does. 
-			fromTableSelection = path.FromTablePrefix + "." + path.FromField
+			fromSQL += " JOIN " + postgresDB.tableName(throughTable) + " " + link +
+				" ON " + linkAccess + " = " + fromId + restriction
+			if restriction != "" { fromArgs = append(fromArgs, path.ThroughTable) }
 		}
+		fromSQL += " JOIN " + postgresDB.tableName(joinTable) + " " + prefix +
+			" ON " + targetAccess + " = " + prefix + ".id"
+	}
 
-		queryStr += "LEFT JOIN " + joinTable + " " + prefix
-		queryStr += " on " + fromTableSelection + " = " + prefix + ".id"
-		queryStr += " " + additionalRestrictions + "\n"
+	return existsSelection{
+		Query: "SELECT 1 " + fromSQL + whereSQL,
+		Args: append(fromArgs, whereArgs...),
+		A: transformed,
 	}
-	log.Println("Generating where clause: "+queryStr)
-	log.Println(whereClause)
-	return queryStr, whereClause, nil
+}
+
+//Generate a restriction on __root for an UPDATE or DELETE, with placeholders
+// numbered from `start`. UPDATE and DELETE cannot take LEFT JOINs directly,
+// so relational restrictions select the ids of matching rows in a subquery
+// using the same joins as a SELECT.
+func (postgresDB *PostgresDB) modificationWhere(table string, joinSQL string, whereClause SQLPart, start int) string {
+	whereClauseSQL := replaceIdentifiers(whereClause.SQL, whereClause.Idents)
+	whereClauseSQL = questionToPositional(whereClauseSQL, start)
+	if whereClauseSQL == "" {
+		return ""
+	}
+	if joinSQL == "" {
+		return " WHERE " + whereClauseSQL
+	}
+	return " WHERE __root.id IN (SELECT __root.id FROM " + postgresDB.tableName(table) + " __root\n" +
+		joinSQL + "WHERE " + whereClauseSQL + ")"
 }	
 	
 //Perform a select query on the postgres database using relational filtering
 // (e.g. event__venue__owner = "Jim")
 func (postgresDB *PostgresDB) Select(schema map[string]Table, prefixes map[string]RelationPath, query SelectQuery) (RetrievalResult, error) {
 	//Generate query
-	joinSQL, whereClause, err := postgresDB.generateWhere(schema, prefixes, query)
+	table, joinSQL, whereClause, err := postgresDB.generateWhere(schema, prefixes, query)
 	if err != nil { return nil, err }
-	queryStr := "SELECT __root.* FROM " + query.Table + " __root\n" + joinSQL
+	queryStr := "SELECT __root.* FROM " + postgresDB.tableName(table) + " __root\n" + joinSQL
 
 	//Replace identifiers
 	whereClauseSQL := replaceIdentifiers(whereClause.SQL, whereClause.Idents)
@@ -622,44 +1041,49 @@ func (postgresDB *PostgresDB) Select(schema map[string]Table, prefixes map[strin
 
 	//Perform query
 	log.Println(queryStr)
-	rows, err := postgresDB.connection.Query(queryStr, whereClause.Args...)
+	rows, err := postgresDB.queryer().Query(queryStr, whereClause.Args...)
 	if err != nil {
 		log.Println(err.Error())
 		return nil, err
 	}
 
-	return PostgresRetrievalResult{ Rows: rows, Table: schema[query.Table] }, nil
+	r := PostgresRetrievalResult{ Rows: rows, Table: schema[table] }
+	//A transaction uses a single connection, which can't be used for
+	// further queries until the rows have been read
+	if postgresDB.tx != nil {
+		defer rows.Close()
+		return BufferRetrievalResult(r)
+	}
+	return r, nil
 }
 
 
 //Perform a select query on the postgres database using relational filtering
 // (e.g. event__venue__owner = "Jim")
 func (postgresDB *PostgresDB) Delete(schema map[string]Table, prefixes map[string]RelationPath, query SelectQuery) (ModificationResult, error) {
-	//Generate query
-	joinSQL, whereClause, err := postgresDB.generateWhere(schema, prefixes, query)
+	queryStr, args, err := postgresDB.deleteSQL(schema, prefixes, query)
 	if err != nil { return nil, err }
-	queryStr := "DELETE FROM " + query.Table + " __root\n" + joinSQL
-
-	//Replace identifiers
-	whereClauseSQL := replaceIdentifiers(whereClause.SQL, whereClause.Idents)
 
-	//Replace ?s with $1s
-	whereClauseSQL = questionToPositional(whereClauseSQL, 1)
-
-	//Only append "WHERE ..." if clause exists, otherwise omit => wildcard
-	if whereClauseSQL != "" {
-		queryStr += "WHERE " + whereClauseSQL
-	}
-	
 	//Perform query
 	log.Println(queryStr)
-	res, err := postgresDB.connection.Exec(queryStr, whereClause.Args...)
+	res, err := postgresDB.queryer().Exec(queryStr, args...)
 	if err != nil {
 		return nil, err
 	}
 	rowsAffected, err := res.RowsAffected()
 
-	return PostgresModificationResult{ rowsAffected: rowsAffected }, nil
+	return PostgresModificationResult{ rowsAffected: rowsAffected }, err
+}
+
+//Generate the SQL and arguments for a DELETE query
+func (postgresDB *PostgresDB) deleteSQL(schema map[string]Table, prefixes map[string]RelationPath, query SelectQuery) (string, []interface{}, error) {
+	table, joinSQL, whereClause, err := postgresDB.generateWhere(schema, prefixes, query)
+	if err != nil { return "", nil, err }
+
+	//Only append "WHERE ..." if clause exists, otherwise omit => wildcard
+	queryStr := "DELETE FROM " + postgresDB.tableName(table) + " __root"
+	queryStr += postgresDB.modificationWhere(table, joinSQL, whereClause, 1)
+	return queryStr, whereClause.Args, nil
 }
 
 
@@ -690,7 +1114,7 @@ func (postgresDB *PostgresDB) Insert(schema map[string]Table, query InsertQuery)
 		}
 	}
 
-	queryStr := "INSERT INTO " + escapeSQLIdent(query.Table) + " ("
+	queryStr := "INSERT INTO " + postgresDB.tableName(query.Table) + " ("
 	valueStr := ""
 	values := make([]interface{}, 0)
 	jsonValues := make(map[string]interface{})
@@ -732,133 +1156,624 @@ func (postgresDB *PostgresDB) Insert(schema map[string]Table, query InsertQuery)
 
 	log.Println(queryStr)
 	var id int64
-	err := postgresDB.connection.QueryRow(queryStr, values...).Scan(&id)
+	err := postgresDB.queryer().QueryRow(queryStr, values...).Scan(&id)
 	r.id = id
 	r.rowsAffected = 1
 	return r, err
 }
 
+//Maximum number of parameters postgres accepts in a single statement
+const postgresMaxParams = 65535
+
+//Insert many rows using multi-row INSERT statements. All rows are inserted
+// in a single transaction, so either all of them or none are inserted.
+func (postgresDB *PostgresDB) InsertBatch(schema map[string]Table, query BatchInsertQuery) ([]int64, error) {
+	table := strings.ToLower(query.Table)
+
+	//As with Insert, rows which don't fit the table's schema go into
+	// autoscope_unassigned. Record the position of each row so ids can
+	// be returned in order.
+	targets := make(map[string][]int, 0)
+	for idx, data := range query.Data {
+		target := postgresDB.insertTarget(schema, table, data)
+		if target != table {
+			data["table_name"] = table
+		}
+		targets[target] = append(targets[target], idx)
+	}
 
-func (ps *PostgresDB) setup() error{
-	//Set the postgres version
-	rows, err := ps.connection.Query("select version()")
-	if err != nil {
-		return err
+	//Use the open transaction if there is one, otherwise start our own
+	var tx sqlQueryer = postgresDB.tx
+	var ownTx *sql.Tx
+	if postgresDB.tx == nil {
+		var err error
+		ownTx, err = postgresDB.connection.Begin()
+		if err != nil { return nil, err }
+		defer ownTx.Rollback()
+		tx = ownTx
 	}
-	for rows.Next(){
-		err := rows.Scan(&ps.version)
-		if err != nil {
-			return err
+
+	ids := make([]int64, len(query.Data))
+	for target, idxs := range targets {
+		rows := make([]map[string]interface{}, len(idxs))
+		for i, idx := range idxs {
+			rows[i] = query.Data[idx]
+		}
+		columns, _ := insertColumns(schema[target], rows)
+		perStatement := postgresMaxParams / (len(columns) + 1)
+
+		for start := 0; start < len(rows); start += perStatement {
+			end := start + perStatement
+			if end > len(rows) { end = len(rows) }
+			queryStr, values, err := postgresDB.insertBatchSQL(schema, target, rows[start:end])
+			if err != nil { return nil, err }
+
+			log.Println(queryStr)
+			res, err := tx.Query(queryStr, values...)
+			if err != nil { return nil, err }
+			//Rows of a multi-row VALUES list are inserted, and returned, in order
+			i := start
+			for res.Next() {
+				err = res.Scan(&ids[idxs[i]])
+				if err != nil {
+					res.Close()
+					return nil, err
+				}
+				i += 1
+			}
+			res.Close()
+			if err = res.Err(); err != nil { return nil, err }
 		}
 	}
-  return err
+
+	if ownTx != nil {
+		err := ownTx.Commit()
+		if err != nil { return nil, err }
+	}
+	return ids, nil
 }
 
-//Perform an update query on the postgres database
-func (postgresDB *PostgresDB) Update(schema map[string]Table, prefixes map[string]RelationPath, query UpdateQuery) (ModificationResult, error) {
-	/*
-	UPDATE catalog_category
-	SET    leaf_category = TRUE
-	FROM   catalog_category c1
-	LEFT   join catalog_category c2 ON c1.id = c2.parent_id
-	WHERE  catalog_category.id = c1.id
-	AND    c2.parent_id IS NULL;
-	*/
-	var r PostgresModificationResult
+//Insert a row, or update the row with the same key.
+// If the table and its key columns exist, this is a single
+// INSERT ... ON CONFLICT DO UPDATE backed by a unique index on the keys.
+// Otherwise the key is looked up and the row inserted or updated within a
+// transaction holding an advisory lock on the key.
+func (postgresDB *PostgresDB) Upsert(schema map[string]Table, prefixes map[string]RelationPath, query UpsertQuery) (ModificationResult, error) {
 	query.Table = strings.ToLower(query.Table)
-	//table := schema[query.Table]
+	err := validateUpsertKeys(query)
+	if err != nil { return nil, err }
 
-	//If the table given by `query` doesn't exist, we need to
-	// query autoscope_unassigned instead and modify the WHERE clause
-	// appropriately
-	if _, ok := schema[query.Table]; !ok {
-		query.Selection = And{
-			A: query.Selection,
-			B: ValueSelection{ Attr: "table_name", Value: query.Table, Op: "=" },
+	if !postgresDB.canUpsertOnConflict(schema, query) {
+		return postgresDB.upsertLocked(schema, prefixes, query)
+	}
+	err = postgresDB.ensureUniqueIndex(query.Table, query.Keys)
+	if err == errNoUniqueIndex {
+		return postgresDB.upsertLocked(schema, prefixes, query)
+	}
+	if err != nil {
+		//Existing duplicate keys prevent creating the index. Outside of
+		// a transaction we can still fall back to locking.
+		if postgresDB.tx != nil { return nil, err }
+		log.Println("Unable to create unique index for upsert: " + err.Error())
+		return postgresDB.upsertLocked(schema, prefixes, query)
+	}
+
+	queryStr, values, err := postgresDB.upsertSQL(schema, prefixes, query)
+	if err != nil { return nil, err }
+	log.Println(queryStr)
+	r := PostgresModificationResult{ id: -1 }
+	err = postgresDB.queryer().QueryRow(queryStr, values...).Scan(&r.id)
+	if err == sql.ErrNoRows {
+		//The row exists, but its restriction prevented the update
+		return r, nil
+	}
+	if err != nil { return nil, err }
+	r.rowsAffected = 1
+	return r, nil
+}
+
+//Whether an upsert can be performed with INSERT ... ON CONFLICT
+func (postgresDB *PostgresDB) canUpsertOnConflict(schema map[string]Table, query UpsertQuery) bool {
+	if !postgresDB.supportsJsonbMerge() { return false }
+	table, ok := schema[query.Table]
+	if !ok { return false }
+	for _, key := range query.Keys {
+		if _, ok := table.Columns[key]; !ok { return false }
+	}
+	for key, _ := range query.Increments {
+		if _, ok := table.Columns[key]; !ok { return false }
+	}
+	return postgresDB.insertTarget(schema, query.Table, query.Data) == query.Table
+}
+
+//Returned by ensureUniqueIndex when creating the index has already failed
+var errNoUniqueIndex = errors.New("Unique index for upsert could not be created")
+
+//Create a unique index on the given columns unless one already exists.
+// Within a transaction, the index is created by the transaction and
+// only known to exist once it commits, since a rollback drops it.
+// Failures outside a transaction due to duplicate keys are remembered,
+// so that every upsert doesn't scan the table again.
+func (postgresDB *PostgresDB) ensureUniqueIndex(table string, keys []string) error {
+	sorted := append(make([]string, 0, len(keys)), keys...)
+	sort.Strings(sorted)
+	name := postgresDB.uniqueIndexName(table, sorted)
+	if postgresDB.uniqueIndexes != nil {
+		if created, ok := postgresDB.uniqueIndexes.Load(name); ok {
+			if !created.(bool) { return errNoUniqueIndex }
+			return nil
 		}
-		query.Table = "autoscope_unassigned"
 	}
+	if postgresDB.txIndexes[name] { return nil }
 
-	queryStr := "UPDATE " + escapeSQLIdent(query.Table) + " __root SET "
-	i := 1
-	colCount := 0
+	cols := make([]string, 0, len(sorted))
+	for _, key := range sorted {
+		cols = append(cols, pq.QuoteIdentifier(key))
+	}
+	queryStr := "CREATE UNIQUE INDEX IF NOT EXISTS " + pq.QuoteIdentifier(name) +
+		" ON " + postgresDB.tableName(table) + " (" + strings.Join(cols, ", ") + ")"
+	log.Println(queryStr)
+	_, err := postgresDB.queryer().Exec(queryStr)
+	if err != nil {
+		pqErr, ok := err.(*pq.Error)
+		if ok && pqErr.Code == "23505" && postgresDB.tx == nil && postgresDB.uniqueIndexes != nil {
+			postgresDB.uniqueIndexes.Store(name, false)
+		}
+		return err
+	}
+	if postgresDB.tx != nil {
+		if postgresDB.txIndexes != nil { postgresDB.txIndexes[name] = true }
+	} else if postgresDB.uniqueIndexes != nil {
+		postgresDB.uniqueIndexes.Store(name, true)
+	}
+	return nil
+}
 
-	values := make([]interface{}, 0)
-	jsonValues := make(map[string]interface{})
+//Name of the unique index on the given sorted columns of `table`
+func (postgresDB *PostgresDB) uniqueIndexName(table string, sorted []string) string {
+	h := fnv.New64a()
+	h.Write([]byte(postgresDB.tableName(table) + "(" + strings.Join(sorted, ",") + ")"))
+	return "autoscope_upsert_" + strconv.FormatUint(h.Sum64(), 16)
+}
 
+//Generate an INSERT ... ON CONFLICT DO UPDATE statement for an upsert
+func (postgresDB *PostgresDB) upsertSQL(schema map[string]Table, prefixes map[string]RelationPath, query UpsertQuery) (string, []interface{}, error) {
+	row := upsertInsertData(query)
+	queryStr, values, err := postgresDB.insertBatchSQL(schema, query.Table, []map[string]interface{}{ row })
+	if err != nil { return "", nil, err }
+	queryStr = strings.TrimSuffix(queryStr, " RETURNING id")
+	queryStr = strings.Replace(queryStr, postgresDB.tableName(query.Table),
+		postgresDB.tableName(query.Table) + " AS __root", 1)
+
+	keys := make([]string, 0, len(query.Keys))
+	for _, key := range query.Keys {
+		keys = append(keys, escapeSQLIdent(key))
+	}
 
-	for key, val := range query.Data {
-		if _, ok := schema[query.Table].Columns[key]; ok {
-			//Query normal column if it exists
-			queryStr += escapeSQLIdent(key) + "="
-			queryStr += "$" + strconv.Itoa(i) + ", "
-			values = append(values, val)
-			colCount += 1
+	//Update every given column except those recording ownership
+	columns, hasObjectFields := insertColumns(schema[query.Table], []map[string]interface{}{ row })
+	assignments := make([]string, 0)
+	for _, col := range columns {
+		if col == "id" || col == "autoscope_uid" || col == "autoscope_gid" { continue }
+		c := escapeSQLIdent(col)
+		if _, ok := query.Increments[col]; ok {
+			assignments = append(assignments, c + " = COALESCE(__root." + c + ", 0) + EXCLUDED." + c)
 		} else {
-			//Otherwise, build include the key/value pair in jsonValues
-			jsonValues[key] = val
+			assignments = append(assignments, c + " = EXCLUDED." + c)
 		}
-		i += 1
 	}
+	if hasObjectFields {
+		assignments = append(assignments, "autoscope_objectfields = " +
+			"COALESCE(__root.autoscope_objectfields::jsonb, '{}'::jsonb) || EXCLUDED.autoscope_objectfields::jsonb")
+	}
+	//DO UPDATE must assign something for RETURNING to report the row
+	if len(assignments) == 0 {
+		assignments = append(assignments, keys[0] + " = EXCLUDED." + keys[0])
+	}
+	queryStr += " ON CONFLICT (" + strings.Join(keys, ", ") + ") DO UPDATE SET " + strings.Join(assignments, ", ")
+
+	//The existing row is __root, as in an UPDATE, so relational
+	// restrictions are joined the same way
+	if query.Restriction != nil {
+		table, joinSQL, whereClause, err := postgresDB.generateWhere(schema, prefixes, SelectQuery{
+			Table: query.Table,
+			Selection: query.Restriction,
+		})
+		if err != nil { return "", nil, err }
+		queryStr += postgresDB.modificationWhere(table, joinSQL, whereClause, len(values) + 1)
+		values = append(values, whereClause.Args...)
+	}
+	return queryStr + " RETURNING __root.id", values, nil
+}
 
-	//Remove trailing commas if necessary
-	if i > 0 && len(jsonValues) == 0 {
-		queryStr = queryStr[0:len(queryStr) - 2]
+//Perform an upsert by looking up the key and then inserting or updating,
+// all within a transaction holding an advisory lock on the key. This
+// serializes upserts of the same key; other writes are not blocked.
+func (postgresDB *PostgresDB) upsertLocked(schema map[string]Table, prefixes map[string]RelationPath, query UpsertQuery) (ModificationResult, error) {
+	r := PostgresModificationResult{ id: -1 }
+	inner := *postgresDB
+	if postgresDB.tx == nil {
+		tx, err := postgresDB.connection.Begin()
+		if err != nil { return nil, err }
+		defer tx.Rollback()
+		inner.tx = tx
 	}
 
-	if len(jsonValues) > 0 {
-		// If we need to update the autoscope_objectfields portion of the row,
-		// we must first retrieve the whole row if we're using postgres < 9.5
-		// TODO: Implement postgres 9.5 efficient update
-		if postgresDB.version != "9.5" || true {
-			selectQuery := SelectQuery{
-				Selection: query.Selection,
-				Table: query.Table,
+	keyValues := make(map[string]interface{}, len(query.Keys))
+	for _, key := range query.Keys {
+		keyValues[key] = query.Data[key]
+	}
+	lockKey, err := json.Marshal([]interface{}{ postgresDB.tableName(query.Table), keyValues })
+	if err != nil { return nil, err }
+	_, err = inner.tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", string(lockKey))
+	if err != nil { return nil, err }
+
+	res, err := inner.Select(schema, nil, SelectQuery{
+		Table: query.Table,
+		Selection: upsertKeySelection(query),
+	})
+	if err != nil { return nil, err }
+	//The rows must be read before the transaction performs another query
+	existing, found, err := FirstRow(res)
+	if err != nil { return nil, err }
+	if found {
+		data, err := upsertUpdateData(existing, query)
+		if err != nil { return nil, err }
+		id := existing["id"].(int64)
+		var selection Formula = ValueSelection{ Attr: "id", Value: id, Op: "=" }
+		if query.Restriction != nil {
+			selection = And{ A: selection, B: query.Restriction }
+		}
+		mr, err := inner.Update(schema, prefixes, UpdateQuery{
+			Table: query.Table,
+			Selection: selection,
+			Data: data,
+		})
+		if err != nil { return nil, err }
+		n, err := mr.RowsAffected()
+		if err != nil { return nil, err }
+		if n > 0 {
+			r.id = id
+			r.rowsAffected = n
+		}
+	} else {
+		mr, err := inner.Insert(schema, InsertQuery{
+			Table: query.Table,
+			Data: upsertInsertData(query),
+		})
+		if err != nil { return nil, err }
+		r.id, err = mr.LastInsertId()
+		if err != nil { return nil, err }
+		r.rowsAffected = 1
+	}
+
+	if postgresDB.tx == nil {
+		err = inner.tx.Commit()
+		if err != nil { return nil, err }
+	}
+	return r, nil
+}
+
+//Determine which table a row should be inserted into: the table itself, or
+// autoscope_unassigned if the table doesn't exist or can't hold the row
+func (postgresDB *PostgresDB) insertTarget(schema map[string]Table, table string, data map[string]interface{}) string {
+	t, ok := schema[table]
+	if !ok { return "autoscope_unassigned" }
+	if _, ok := t.Columns["autoscope_objectfields"]; ok { return table }
+	for key, _ := range data {
+		if _, ok := t.Columns[key]; !ok {
+			return "autoscope_unassigned"
+		}
+	}
+	return table
+}
+
+//Return the sorted columns of `table` used by any of `rows`, and whether any
+// row has fields which must be stored in autoscope_objectfields
+func insertColumns(table Table, rows []map[string]interface{}) ([]string, bool) {
+	used := make(map[string]bool, 0)
+	hasObjectFields := false
+	for _, row := range rows {
+		for key, _ := range row {
+			if _, ok := table.Columns[key]; ok {
+				used[key] = true
+			} else {
+				hasObjectFields = true
 			}
-			res, err := postgresDB.Select(schema, prefixes, selectQuery)
-			if err != nil { return nil, err }
-			b := res.Next()
-			if !b { return nil, errors.New("Failed to retrieve row we're attempting to update") }
-			resMap, err := res.Get()
-			if err != nil { return nil, err }
+		}
+	}
+	columns := make([]string, 0, len(used))
+	for col, _ := range used {
+		columns = append(columns, col)
+	}
+	sort.Strings(columns)
+	return columns, hasObjectFields
+}
 
-			//Insert any old values that we're not overwriting into our
-			// map of object field names to values
-			for k, v := range resMap {
-				if _, ok := schema[query.Table].Columns[k]; !ok {
-					if _, ok := jsonValues[k]; !ok {
-						jsonValues[k] = v
-					}
+//Generate a multi-row INSERT statement for `rows`, all of which must fit
+// the schema of `table`. Columns a row doesn't provide take their default.
+func (postgresDB *PostgresDB) insertBatchSQL(schema map[string]Table, table string, rows []map[string]interface{}) (string, []interface{}, error) {
+	columns, hasObjectFields := insertColumns(schema[table], rows)
+	colNames := make([]string, 0, len(columns) + 1)
+	for _, col := range columns {
+		colNames = append(colNames, escapeSQLIdent(col))
+	}
+	if hasObjectFields {
+		colNames = append(colNames, "autoscope_objectfields")
+	}
+	//Rows without any values consist entirely of defaults
+	if len(colNames) == 0 {
+		colNames = append(colNames, "id")
+	}
+
+	values := make([]interface{}, 0)
+	tuples := make([]string, 0, len(rows))
+	for _, row := range rows {
+		placeholders := make([]string, 0, len(colNames))
+		for _, col := range columns {
+			if val, ok := row[col]; ok {
+				values = append(values, val)
+				placeholders = append(placeholders, "$" + strconv.Itoa(len(values)))
+			} else {
+				placeholders = append(placeholders, "DEFAULT")
+			}
+		}
+		if hasObjectFields {
+			jsonValues := make(map[string]interface{})
+			for key, val := range row {
+				if _, ok := schema[table].Columns[key]; !ok {
+					jsonValues[key] = val
 				}
 			}
-
-			s, err := json.Marshal(jsonValues)
-			if err != nil { return nil, err	}
-			queryStr += "autoscope_objectfields = "
-			queryStr += "'" + string(s) + "'"
+			if len(jsonValues) > 0 {
+				s, err := json.Marshal(jsonValues)
+				if err != nil { return "", nil, err }
+				values = append(values, string(s))
+				placeholders = append(placeholders, "$" + strconv.Itoa(len(values)))
+			} else {
+				placeholders = append(placeholders, "DEFAULT")
+			}
+		}
+		if len(placeholders) == 0 {
+			placeholders = append(placeholders, "DEFAULT")
 		}
+		tuples = append(tuples, "(" + strings.Join(placeholders, ", ") + ")")
 	}
 
-	//Transform our attribute names appropriately where necessary
-	fn := func(f Formula) Formula {
-		return relationalFormulaTransform(schema, prefixes, f, query.Table)
+	queryStr := "INSERT INTO " + postgresDB.tableName(table) + " (" + strings.Join(colNames, ", ") + ")"
+	queryStr += " VALUES " + strings.Join(tuples, ", ") + " RETURNING id"
+	return queryStr, values, nil
+}
+
+
+func (ps *PostgresDB) setup() error{
+	//Ensure our schema exists
+	if ps.schemaName != "public" {
+		_, err := ps.connection.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(ps.schemaName))
+		if err != nil { return err }
 	}
-	query.Selection = ModifyLeaves(fn, query.Selection)
 
-	whereClause, err := query.Selection.toSQL()
-	if err != nil { return r, err	}
+	//Set the postgres version, both as the human readable version string
+	// and as a comparable number (e.g. 90500 for 9.5.0)
+	err := ps.connection.QueryRow("select version()").Scan(&ps.version)
+	if err != nil { return err }
+	var versionNum string
+	err = ps.connection.QueryRow("SHOW server_version_num").Scan(&versionNum)
+	if err != nil { return err }
+	ps.versionNum, err = strconv.Atoi(versionNum)
+	if err != nil { return errors.New("Unable to parse postgres version number " + versionNum) }
+	log.Println("Connected to " + ps.version)
+	return ps.registerPrefix()
+}
 
-	//Replace identifiers
-	whereClauseSQL := replaceIdentifiers(whereClause.SQL, whereClause.Idents)
+//Unprefixed table recording the DB_PREFIX of every instance using a schema
+const prefixRegistry = "autoscope_prefixes"
+
+//Record our prefix in the registry, failing if it overlaps the prefix of
+// another instance. Tables are attributed to instances by prefix, so with
+// prefixes a_ and a_b_, the first instance would see the second's tables.
+func (ps *PostgresDB) registerPrefix() error {
+	registry := pq.QuoteIdentifier(ps.schemaName) + "." + pq.QuoteIdentifier(prefixRegistry)
+	_, err := ps.connection.Exec("CREATE TABLE IF NOT EXISTS " + registry + " (prefix varchar(128) PRIMARY KEY)")
+	if err != nil { return err }
+
+	tx, err := ps.connection.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	//Prevent concurrently starting instances from registering overlapping prefixes
+	_, err = tx.Exec("LOCK TABLE " + registry + " IN EXCLUSIVE MODE")
+	if err != nil { return err }
+	rows, err := tx.Query("SELECT prefix FROM " + registry)
+	if err != nil { return err }
+	registered := make([]string, 0)
+	for rows.Next() {
+		var prefix string
+		err = rows.Scan(&prefix)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		registered = append(registered, prefix)
+	}
+	rows.Close()
+	err = checkPrefix(ps.prefix, registered)
+	if err != nil { return err }
+	if !listContains(registered, ps.prefix) {
+		_, err = tx.Exec("INSERT INTO " + registry + " (prefix) VALUES ($1)", ps.prefix)
+		if err != nil { return err }
+	}
+	return tx.Commit()
+}
+
+//Return an error if `prefix` overlaps any other registered prefix, i.e.
+// either is a prefix of the other. The empty prefix overlaps every prefix.
+func checkPrefix(prefix string, registered []string) error {
+	for _, other := range registered {
+		if other == prefix { continue }
+		if strings.HasPrefix(other, prefix) || strings.HasPrefix(prefix, other) {
+			return errors.New("Table prefix '" + prefix + "' overlaps the prefix '" +
+				other + "' of another instance")
+		}
+	}
+	return nil
+}
+
+//The jsonb || operator, used to merge object fields in place, is
+// only available from postgres 9.5 onwards
+func (ps *PostgresDB) supportsJsonbMerge() bool {
+	return ps.versionNum >= 90500
+}
 
-	//Replace ?s with $1s, starting at $(len(values) + 1)
-	whereClauseSQL = questionToPositional(whereClauseSQL, len(values) + 1)
-	queryStr += " WHERE " + whereClauseSQL
+//Perform an update query on the postgres database
+func (postgresDB *PostgresDB) Update(schema map[string]Table, prefixes map[string]RelationPath, query UpdateQuery) (ModificationResult, error) {
+	var r PostgresModificationResult
+	queryStr, args, err := postgresDB.updateSQL(schema, prefixes, query)
+	if err != nil { return r, err }
+	if queryStr == "" {
+		//Either nothing to update, or object fields must be merged row by row
+		if len(query.Data) == 0 { return r, nil }
+		assignments, values, jsonValues := postgresDB.updateAssignments(schema, query)
+		if len(jsonValues) == 0 { return r, nil }
+		return postgresDB.updateObjectFieldsByRow(schema, prefixes, query, assignments, values, jsonValues)
+	}
 
 	log.Println(queryStr)
-	res, err := postgresDB.connection.Exec(queryStr, append(values, whereClause.Args...)...)
+	res, err := postgresDB.queryer().Exec(queryStr, args...)
 	if err != nil { return r, err }
 	rowsAffected, err := res.RowsAffected()
 	r.rowsAffected = rowsAffected
 	return r, err
 }
+
+//Split the data of an update into column assignments and object fields
+func (postgresDB *PostgresDB) updateAssignments(schema map[string]Table, query UpdateQuery) ([]string, []interface{}, map[string]interface{}) {
+	table := strings.ToLower(query.Table)
+	if _, ok := schema[table]; !ok {
+		table = "autoscope_unassigned"
+	}
+
+	assignments := make([]string, 0)
+	values := make([]interface{}, 0)
+	jsonValues := make(map[string]interface{})
+	for key, val := range query.Data {
+		if _, ok := schema[table].Columns[key]; ok {
+			values = append(values, val)
+			assignments = append(assignments, escapeSQLIdent(key) + " = $" + strconv.Itoa(len(values)))
+		} else {
+			jsonValues[key] = val
+		}
+	}
+	return assignments, values, jsonValues
+}
+
+//Generate the SQL and arguments for an UPDATE query. Returns an empty
+// query if there is nothing to update, or if object fields can't be merged
+// by the server and must be updated row by row instead.
+func (postgresDB *PostgresDB) updateSQL(schema map[string]Table, prefixes map[string]RelationPath, query UpdateQuery) (string, []interface{}, error) {
+	assignments, values, jsonValues := postgresDB.updateAssignments(schema, query)
+	if len(jsonValues) > 0 {
+		if !postgresDB.supportsJsonbMerge() {
+			return "", nil, nil
+		}
+		//Merge the new object fields into each row's existing object fields
+		s, err := json.Marshal(jsonValues)
+		if err != nil { return "", nil, err }
+		values = append(values, string(s))
+		assignments = append(assignments, "autoscope_objectfields = " +
+			"COALESCE(__root.autoscope_objectfields::jsonb, '{}'::jsonb) || $" + strconv.Itoa(len(values)) + "::jsonb")
+	}
+	if len(assignments) == 0 {
+		return "", nil, nil
+	}
+
+	table, joinSQL, whereClause, err := postgresDB.generateWhere(schema, prefixes, SelectQuery{
+		Table: query.Table,
+		Selection: query.Selection,
+	})
+	if err != nil { return "", nil, err }
+
+	//Placeholders in the WHERE clause start at $(len(values) + 1)
+	queryStr := "UPDATE " + postgresDB.tableName(table) + " __root SET " + strings.Join(assignments, ", ")
+	queryStr += postgresDB.modificationWhere(table, joinSQL, whereClause, len(values) + 1)
+	return queryStr, append(values, whereClause.Args...), nil
+}
+
+//Fallback for servers without jsonb merging: lock every matching row,
+// merge its object fields in Go and write each row back individually.
+// `assignments` and `values` hold the column portion of the update.
+func (postgresDB *PostgresDB) updateObjectFieldsByRow(schema map[string]Table, prefixes map[string]RelationPath, query UpdateQuery, assignments []string, values []interface{}, jsonValues map[string]interface{}) (ModificationResult, error) {
+	var r PostgresModificationResult
+	//Use the open transaction if there is one, otherwise start our own
+	var tx sqlQueryer = postgresDB.tx
+	var ownTx *sql.Tx
+	if postgresDB.tx == nil {
+		var err error
+		ownTx, err = postgresDB.connection.Begin()
+		if err != nil { return nil, err }
+		defer ownTx.Rollback()
+		tx = ownTx
+	}
+
+	//Select and lock the object fields of every matching row
+	table, joinSQL, whereClause, err := postgresDB.generateWhere(schema, prefixes, SelectQuery{
+		Table: query.Table,
+		Selection: query.Selection,
+	})
+	if err != nil { return nil, err }
+	queryStr := "SELECT __root.id, __root.autoscope_objectfields FROM " + postgresDB.tableName(table) + " __root\n" + joinSQL
+	whereClauseSQL := questionToPositional(replaceIdentifiers(whereClause.SQL, whereClause.Idents), 1)
+	if whereClauseSQL != "" {
+		queryStr += "WHERE " + whereClauseSQL
+	}
+	queryStr += " FOR UPDATE OF __root"
+	log.Println(queryStr)
+	rows, err := tx.Query(queryStr, whereClause.Args...)
+	if err != nil { return nil, err }
+
+	merged := make(map[int64]string, 0)
+	for rows.Next() {
+		var id int64
+		var jsonStr sql.NullString
+		err = rows.Scan(&id, &jsonStr)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		objectFields := make(map[string]interface{})
+		if jsonStr.Valid && jsonStr.String != "" {
+			err = json.Unmarshal([]byte(jsonStr.String), &objectFields)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+		}
+		for k, v := range jsonValues {
+			objectFields[k] = v
+		}
+		b, err := json.Marshal(objectFields)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		merged[id] = string(b)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil { return nil, err }
+
+	//Write each row back
+	assignments = append(assignments, "autoscope_objectfields = $" + strconv.Itoa(len(values) + 1))
+	queryStr = "UPDATE " + postgresDB.tableName(table) + " SET " + strings.Join(assignments, ", ")
+	queryStr += " WHERE id = $" + strconv.Itoa(len(values) + 2)
+	for id, objectFields := range merged {
+		args := append(append(make([]interface{}, 0), values...), objectFields, id)
+		_, err = tx.Exec(queryStr, args...)
+		if err != nil { return nil, err }
+	}
+
+	if ownTx != nil {
+		err = ownTx.Commit()
+		if err != nil { return nil, err }
+	}
+	r.rowsAffected = int64(len(merged))
+	return r, nil
+}
@@ -7,6 +7,9 @@ import (
 	"gopkg.in/yaml.v2"
 	"log"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -61,7 +64,7 @@ func TestMain(m *testing.M) {
 	//Clear out any existing tables
 	for n, _ := range currentSchema {
 		log.Println("Dropping table: "+n)
-		_, err := ps.connection.Exec("drop table "+n+"")
+		_, err := ps.connection.Exec("drop table "+ps.tableName(n))
 		if err != nil {
 			log.Println("Error dropping tables")
 			configured = false
@@ -101,6 +104,60 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+//Ensure connection strings are built correctly from config values
+func TestPostgresDSN(t *testing.T){
+	dsn, err := postgresDSN(&Config{
+		DB_USER: "autoscope",
+		DB_PASSWORD: "it's secret",
+		DB_NAME: "autoscope",
+		DB_HOST: "db.internal",
+		DB_PORT: "6432",
+		DB_CONNECT_TIMEOUT: 5,
+		DB_SEARCH_PATH: "tenant,public",
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	expected := "user=autoscope password='it\\'s secret' dbname=autoscope host=db.internal port=6432 sslmode=disable search_path=tenant,public connect_timeout=5"
+	if dsn != expected {
+		t.Fatal("Incorrect DSN: " + dsn)
+	}
+
+	//A full URL takes precedence over individual settings
+	url := "postgres://u:p@localhost:5432/db?sslmode=require"
+	dsn, err = postgresDSN(&Config{ DB_URL: url, DB_USER: "ignored" })
+	if err != nil { t.Fatal(err.Error()) }
+	if dsn != url { t.Fatal("DB_URL not used: " + dsn) }
+
+	_, err = postgresDSN(&Config{ DB_USER: "autoscope", DB_PASSWORD: "x" })
+	if err == nil { t.Fatal("Missing database name should be rejected") }
+}
+
+//Ensure table names are namespaced by DB_SCHEMA and DB_PREFIX
+func TestPostgresTableName(t *testing.T){
+	ps := PostgresDB{ schemaName: "tenant1", prefix: "app1_" }
+	if ps.tableName("Events") != "\"tenant1\".\"app1_events\"" {
+		t.Fatal("Incorrect table name: " + ps.tableName("Events"))
+	}
+	ps = PostgresDB{}
+	if ps.tableName("autoscope_users") != "\"public\".\"autoscope_users\"" {
+		t.Fatal("Incorrect table name: " + ps.tableName("autoscope_users"))
+	}
+}
+
+//Instances sharing a schema can't use overlapping prefixes
+func TestCheckPrefix(t *testing.T){
+	if checkPrefix("a_", []string{"a_", "b_"}) != nil {
+		t.Fatal("Registered prefix rejected")
+	}
+	if checkPrefix("c_", []string{"a_", "b_"}) != nil {
+		t.Fatal("Distinct prefix rejected")
+	}
+	for _, c := range [][2]string{ {"a_", "a_b_"}, {"a_b_", "a_"}, {"", "a_"}, {"a_", ""} } {
+		if checkPrefix(c[0], []string{ c[1] }) == nil {
+			t.Fatalf("Prefix '%s' allowed alongside '%s'", c[0], c[1])
+		}
+	}
+}
+
 //With this test, we ensure that the default autoscope tables are
 // created correctly
 func TestInitialPostgresMigration(t *testing.T){
@@ -471,3 +528,406 @@ func TestRelationalFiltering(t *testing.T){
 
 	//Test updating a field in a table that DNE
 }
+
+//Updating object fields of several rows at once must merge into each
+// row's own object fields rather than overwriting them with one blob
+func TestObjectFieldUpdate(t *testing.T){
+	var ps PostgresDB
+	err := ps.Connect(config)
+	if err != nil { t.Fatal(err.Error()) }
+
+	ofTable := Table{
+		Name: "oftest",
+		Columns: map[string]string{
+			"id": "serial",
+			"kind": "text",
+			"autoscope_objectfields": "jsonb",
+		},
+		Status: "created",
+	}
+	currentSchema, err := ps.CurrentSchema()
+	if err != nil { t.Fatal(err.Error()) }
+	steps, err := CreateMigration(config, currentSchema, map[string]Table{ "oftest": ofTable })
+	if err != nil { t.Fatal(err.Error()) }
+	err = ps.PerformMigration(steps)
+	if err != nil { t.Fatal(err.Error()) }
+	schema, err := ps.CurrentSchema()
+	if err != nil { t.Fatal(err.Error()) }
+
+	for _, name := range []string{"first", "second"} {
+		_, err = ps.Insert(schema, InsertQuery{
+			Table: "oftest",
+			Data: map[string]interface{}{ "kind": "shared", "name": name },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+	}
+
+	updRes, err := ps.Update(schema, make(map[string]RelationPath, 0), UpdateQuery{
+		Table: "oftest",
+		Selection: ValueSelection{ Attr: "kind", Value: "shared", Op: "=" },
+		Data: map[string]interface{}{ "flag": "set" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	updN, err := updRes.RowsAffected()
+	if err != nil { t.Fatal(err.Error()) }
+	if updN != 2 { t.Fatal("Incorrect number of rows affected: "+strconv.Itoa(int(updN))) }
+
+	res, err := ps.Select(schema, nil, SelectQuery{
+		Table: "oftest",
+		Selection: ValueSelection{ Attr: "kind", Value: "shared", Op: "=" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	names := make(map[string]bool, 0)
+	for res.Next() {
+		row, err := res.Get()
+		if err != nil { t.Fatal(err.Error()) }
+		if row["flag"] != "set" { t.Fatal("Object field not updated") }
+		names[row["name"].(string)] = true
+	}
+	if !names["first"] || !names["second"] {
+		t.Fatal("Existing object fields were overwritten")
+	}
+}
+
+//UPDATE and DELETE can't take joins directly, so relational restrictions
+// must be applied through a subquery on __root.id
+func TestRelationalModificationSQL(t *testing.T){
+	ps := PostgresDB{ versionNum: 90500 }
+	schema := map[string]Table{
+		"events": Table{ Name: "events", Columns: map[string]string{
+			"id": "serial", "venue": "int", "name": "string",
+			"autoscope_objectfields": "string",
+		}},
+		"venues": Table{ Name: "venues", Columns: map[string]string{
+			"id": "serial", "name": "string",
+		}},
+	}
+	prefixes := map[string]RelationPath{
+		"__venue": RelationPath{
+			Table: "venues", FromTable: "events",
+			FromTablePrefix: "__root", FromField: "venue",
+		},
+	}
+	selection := ValueSelection{ Attr: "venue__name", Value: "Hall", Op: "=" }
+
+	queryStr, args, err := ps.deleteSQL(schema, prefixes, SelectQuery{
+		Table: "events",
+		Selection: selection,
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if !strings.HasPrefix(queryStr, "DELETE FROM \"public\".\"events\" __root WHERE __root.id IN (SELECT __root.id FROM \"public\".\"events\" __root\nLEFT JOIN \"public\".\"venues\" __venue on __root.venue = __venue.id") {
+		t.Fatal("Incorrect DELETE: " + queryStr)
+	}
+	if !strings.Contains(queryStr, "$1)") || len(args) != 1 {
+		t.Fatal("Incorrect DELETE arguments: " + queryStr)
+	}
+
+	queryStr, args, err = ps.updateSQL(schema, prefixes, UpdateQuery{
+		Table: "events",
+		Selection: selection,
+		Data: map[string]interface{}{ "name": "Renamed" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if !strings.HasPrefix(queryStr, "UPDATE \"public\".\"events\" __root SET name = $1 WHERE __root.id IN (SELECT __root.id FROM \"public\".\"events\" __root\nLEFT JOIN") {
+		t.Fatal("Incorrect UPDATE: " + queryStr)
+	}
+	if !strings.Contains(queryStr, "$2)") || len(args) != 2 || args[0] != "Renamed" || args[1] != "Hall" {
+		t.Fatal("Incorrect UPDATE arguments: " + queryStr)
+	}
+
+	//Without relational restrictions no subquery is needed
+	queryStr, _, err = ps.deleteSQL(schema, map[string]RelationPath{}, SelectQuery{
+		Table: "events",
+		Selection: ValueSelection{ Attr: "name", Value: "Gala", Op: "=" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if strings.Contains(queryStr, "SELECT") {
+		t.Fatal("Unnecessary subquery: " + queryStr)
+	}
+}
+
+func TestInsertBatchSQL(t *testing.T){
+	ps := PostgresDB{}
+	schema := map[string]Table{
+		"events": Table{ Name: "events", Columns: map[string]string{
+			"id": "serial", "name": "string", "venue": "int",
+			"autoscope_objectfields": "string",
+		}},
+	}
+	queryStr, values, err := ps.insertBatchSQL(schema, "events", []map[string]interface{}{
+		map[string]interface{}{ "name": "a", "venue": 1 },
+		map[string]interface{}{ "name": "b", "extra": true },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	expected := "INSERT INTO \"public\".\"events\" (name, venue, autoscope_objectfields)" +
+		" VALUES ($1, $2, DEFAULT), ($3, DEFAULT, $4) RETURNING id"
+	if queryStr != expected {
+		t.Fatal("Incorrect batch INSERT: " + queryStr)
+	}
+	if len(values) != 4 || values[3] != "{\"extra\":true}" {
+		t.Fatal("Incorrect batch INSERT values")
+	}
+
+	if ps.insertTarget(schema, "missing", map[string]interface{}{}) != "autoscope_unassigned" {
+		t.Fatal("Rows for missing tables must go to autoscope_unassigned")
+	}
+}
+
+func TestUpsertSQL(t *testing.T){
+	ps := PostgresDB{ versionNum: 90500 }
+	schema := map[string]Table{
+		"counters": Table{ Name: "counters", Columns: map[string]string{
+			"id": "serial", "name": "string", "count": "bigint",
+			"autoscope_uid": "bigint",
+		}},
+	}
+	query := UpsertQuery{
+		Table: "counters",
+		Keys: []string{"name"},
+		Data: map[string]interface{}{ "name": "a", "autoscope_uid": 1 },
+		Increments: map[string]int64{ "count": 1 },
+		Restriction: ValueSelection{ Attr: "autoscope_uid", Value: 1, Op: "=" },
+	}
+	if !ps.canUpsertOnConflict(schema, query) {
+		t.Fatal("Upsert on real columns should use ON CONFLICT")
+	}
+	queryStr, values, err := ps.upsertSQL(schema, nil, query)
+	if err != nil { t.Fatal(err.Error()) }
+	if !strings.HasPrefix(queryStr, "INSERT INTO \"public\".\"counters\" AS __root (autoscope_uid, count, name) VALUES ($1, $2, $3)" +
+		" ON CONFLICT (name) DO UPDATE SET count = COALESCE(__root.count, 0) + EXCLUDED.count, name = EXCLUDED.name WHERE ") ||
+		!strings.HasSuffix(queryStr, "$4 RETURNING __root.id") {
+		t.Fatal("Incorrect upsert: " + queryStr)
+	}
+	if len(values) != 4 {
+		t.Fatal("Incorrect upsert values")
+	}
+
+	//Relational restrictions are joined as for updates
+	schema["counters"].Columns["venue"] = "bigint"
+	schema["venues"] = Table{ Name: "venues", Columns: map[string]string{
+		"id": "serial", "owner": "bigint",
+	}}
+	prefixes := map[string]RelationPath{
+		"__venue": RelationPath{
+			Table: "venues", FromTable: "counters",
+			FromTablePrefix: "__root", FromField: "venue",
+			Kind: RelationForward,
+		},
+	}
+	query.Restriction = ValueSelection{ Attr: "venue__owner", Value: 1, Op: "=" }
+	queryStr, values, err = ps.upsertSQL(schema, prefixes, query)
+	if err != nil { t.Fatal(err.Error()) }
+	if !strings.Contains(queryStr, " WHERE __root.id IN (SELECT __root.id FROM \"public\".\"counters\" __root\n") ||
+		!strings.Contains(queryStr, "JOIN \"public\".\"venues\" __venue") ||
+		!strings.HasSuffix(queryStr, "$4) RETURNING __root.id") {
+		t.Fatal("Incorrect relational upsert: " + queryStr)
+	}
+	if len(values) != 4 {
+		t.Fatal("Incorrect relational upsert values")
+	}
+
+	//Object field keys can't be backed by a unique index
+	query.Keys = []string{"nickname"}
+	query.Data["nickname"] = "b"
+	if ps.canUpsertOnConflict(schema, query) {
+		t.Fatal("Upsert on object fields must not use ON CONFLICT")
+	}
+}
+
+//Upserts keyed on object fields look the key up, then update the row
+// found in the same transaction
+func TestUpsertLocked(t *testing.T){
+	var ps PostgresDB
+	err := ps.Connect(config)
+	if err != nil { t.Fatal(err.Error()) }
+
+	upsertTable := Table{
+		Name: "upserttest",
+		Columns: map[string]string{
+			"id": "serial",
+			"count": "bigint",
+			"autoscope_objectfields": "jsonb",
+		},
+		Status: "created",
+	}
+	currentSchema, err := ps.CurrentSchema()
+	if err != nil { t.Fatal(err.Error()) }
+	steps, err := CreateMigration(config, currentSchema, map[string]Table{ "upserttest": upsertTable })
+	if err != nil { t.Fatal(err.Error()) }
+	err = ps.PerformMigration(steps)
+	if err != nil { t.Fatal(err.Error()) }
+	schema, err := ps.CurrentSchema()
+	if err != nil { t.Fatal(err.Error()) }
+
+	nickname := "n" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	upsert := func() int64 {
+		r, err := ps.Upsert(schema, nil, UpsertQuery{
+			Table: "upserttest",
+			Keys: []string{"nickname"},
+			Data: map[string]interface{}{ "nickname": nickname },
+			Increments: map[string]int64{ "count": 1 },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+		if n, _ := r.RowsAffected(); n != 1 { t.Fatal("Row not upserted") }
+		id, err := r.LastInsertId()
+		if err != nil { t.Fatal(err.Error()) }
+		return id
+	}
+	inserted := upsert()
+	if upsert() != inserted {
+		t.Fatal("Existing row not updated")
+	}
+	res, err := ps.Select(schema, nil, Filter("upserttest", map[string]interface{}{ "id": inserted }))
+	if err != nil { t.Fatal(err.Error()) }
+	row, ok, err := FirstRow(res)
+	if err != nil { t.Fatal(err.Error()) }
+	if !ok || row["count"] != int64(2) {
+		t.Fatalf("Incorrect upserted row: %v", row)
+	}
+}
+
+//Failing to create an upsert index isn't retried by every upsert
+func TestUniqueIndexFailure(t *testing.T){
+	ps := PostgresDB{ schemaName: "public", uniqueIndexes: &sync.Map{} }
+	ps.uniqueIndexes.Store(ps.uniqueIndexName("counters", []string{"name", "owner"}), false)
+	if ps.ensureUniqueIndex("counters", []string{"owner", "name"}) != errNoUniqueIndex {
+		t.Fatal("Failed index creation retried")
+	}
+}
+
+//Selections through many-to-many fields hold if any linked row matches,
+// so they must become EXISTS subqueries rather than joins
+func TestManyToManySQL(t *testing.T){
+	ps := PostgresDB{ versionNum: 90500 }
+	through := throughTableName("bands", "artists")
+	schema := map[string]Table{
+		"events": Table{ Name: "events", Columns: map[string]string{
+			"id": "serial", "band": "int", "name": "string",
+		}},
+		"bands": Table{ Name: "bands", Columns: map[string]string{
+			"id": "serial", "name": "string",
+		}},
+		"artists": Table{ Name: "artists", Columns: map[string]string{
+			"id": "serial", "name": "string",
+		}},
+		through: Table{ Name: through, Columns: map[string]string{
+			"id": "serial", "from_id": "bigint", "to_id": "bigint",
+		}},
+	}
+	prefixes := map[string]RelationPath{
+		"__band": RelationPath{
+			Table: "bands", FromTable: "events",
+			FromTablePrefix: "__root", FromField: "band",
+		},
+		"__band__artists": RelationPath{
+			Table: "artists", FromTable: "bands",
+			FromTablePrefix: "__band", FromField: "artists",
+			Kind: RelationThrough, ThroughTable: through,
+		},
+	}
+
+	queryStr, args, err := ps.deleteSQL(schema, prefixes, SelectQuery{
+		Table: "events",
+		Selection: And{
+			A: ValueSelection{ Attr: "band__artists__name", Value: "Ann", Op: "=" },
+			B: ValueSelection{ Attr: "name", Value: "Gig", Op: "=" },
+		},
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if strings.Contains(queryStr, "LEFT JOIN \"public\".\"artists\"") ||
+		!strings.Contains(queryStr, "LEFT JOIN \"public\".\"bands\" __band on __root.band = __band.id") {
+		t.Fatal("Incorrect joins: " + queryStr)
+	}
+	if !strings.Contains(queryStr, "EXISTS (SELECT 1 FROM \"public\".\"" + through + "\" __band__artists__m2m" +
+		" JOIN \"public\".\"artists\" __band__artists ON __band__artists__m2m.to_id = __band__artists.id" +
+		" WHERE __band__artists__m2m.from_id = __band.id AND (__band__artists.name = $1))") {
+		t.Fatal("Incorrect EXISTS subquery: " + queryStr)
+	}
+	if len(args) != 2 || args[0] != "Ann" || args[1] != "Gig" {
+		t.Fatal("Incorrect DELETE arguments: " + queryStr)
+	}
+
+	//Until the through table is created, links live in autoscope_unassigned
+	delete(schema, through)
+	queryStr, args, err = ps.deleteSQL(schema, prefixes, SelectQuery{
+		Table: "events",
+		Selection: ValueSelection{ Attr: "band__artists__name", Value: "Ann", Op: "=" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if !strings.Contains(queryStr, "(__band__artists__m2m.autoscope_objectfields->>'from_id')::int = __band.id" +
+		" AND __band__artists__m2m.table_name = $1 AND (") {
+		t.Fatal("Incorrect unassigned EXISTS subquery: " + queryStr)
+	}
+	if len(args) != 2 || args[0] != through || args[1] != "Ann" {
+		t.Fatal("Incorrect unassigned DELETE arguments: " + queryStr)
+	}
+}
+
+//Reverse relations select parents by their children without
+// multiplying rows, via EXISTS
+func TestReverseRelationSQL(t *testing.T){
+	ps := PostgresDB{ versionNum: 90500 }
+	schema := map[string]Table{
+		"venues": Table{ Name: "venues", Columns: map[string]string{
+			"id": "serial", "name": "string",
+		}},
+		"events": Table{ Name: "events", Columns: map[string]string{
+			"id": "serial", "venue": "int", "date": "int",
+		}},
+	}
+	prefixes := map[string]RelationPath{
+		"__events": RelationPath{
+			Table: "events", FromTable: "venues",
+			FromTablePrefix: "__root", FromField: "events",
+			Kind: RelationReverse, ReverseField: "venue",
+		},
+	}
+	queryStr, args, err := ps.deleteSQL(schema, prefixes, SelectQuery{
+		Table: "venues",
+		Selection: ValueSelection{ Attr: "events__date", Value: 10, Op: ">" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if strings.Contains(queryStr, "LEFT JOIN") ||
+		!strings.Contains(queryStr, "EXISTS (SELECT 1 FROM \"public\".\"events\" __events" +
+			" WHERE __events.venue = __root.id AND (__events.date > $1))") {
+		t.Fatal("Incorrect reverse relation: " + queryStr)
+	}
+	if len(args) != 1 || args[0] != 10 {
+		t.Fatal("Incorrect DELETE arguments: " + queryStr)
+	}
+
+	//Unassigned rows of other tables must not match
+	delete(schema, "events")
+	queryStr, args, err = ps.deleteSQL(schema, prefixes, SelectQuery{
+		Table: "venues",
+		Selection: ValueSelection{ Attr: "events__date", Value: 10, Op: ">" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if !strings.Contains(queryStr, "FROM \"public\".\"autoscope_unassigned\" __events" +
+		" WHERE (__events.autoscope_objectfields->>'venue')::int = __root.id AND __events.table_name = $1") {
+		t.Fatal("Incorrect unassigned reverse relation: " + queryStr)
+	}
+	if len(args) != 2 || args[0] != "events" {
+		t.Fatal("Incorrect unassigned DELETE arguments: " + queryStr)
+	}
+}
+
+func TestAddForeignKeySQL(t *testing.T){
+	ps := PostgresDB{}
+	queryStr, err := ps.addForeignKeySQL(MigrationStepAddForeignKey{
+		tableName: "events",
+		column: "venue",
+		foreignKey: ForeignKey{ Table: "venues", OnDelete: OnDeleteSetNull },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if !strings.HasPrefix(queryStr, "ALTER TABLE \"public\".\"events\" ADD CONSTRAINT autoscope_fk_") ||
+		!strings.HasSuffix(queryStr, " FOREIGN KEY (\"venue\") REFERENCES \"public\".\"venues\" (id) ON DELETE SET NULL NOT VALID") {
+		t.Fatal("Incorrect foreign key constraint: " + queryStr)
+	}
+	_, err = ps.addForeignKeySQL(MigrationStepAddForeignKey{
+		tableName: "events",
+		column: "venue",
+		foreignKey: ForeignKey{ Table: "venues", OnDelete: "explode" },
+	})
+	if err == nil { t.Fatal("Unknown on delete behaviour allowed") }
+}
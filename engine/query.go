@@ -1,5 +1,6 @@
 package engine
 import (
+	"errors"
 	"strings"
 )
 /* query.go
@@ -60,3 +61,65 @@ func Filter(table string, values map[string]interface{}) SelectQuery {
 		Selection: Restrictions(values),
 	}
 }
+
+//Returns a selection matching rows whose key fields equal those of an upsert
+func upsertKeySelection(query UpsertQuery) Formula {
+	restrictions := make([]Formula, 0)
+	for _, key := range query.Keys {
+		restrictions = append(restrictions, ValueSelection{
+			Attr: key,
+			Value: query.Data[key],
+			Op: "=",
+		})
+	}
+	return NestAnds(restrictions)
+}
+
+//Returns the row to insert when an upsert finds no existing row
+func upsertInsertData(query UpsertQuery) map[string]interface{} {
+	data := make(map[string]interface{}, len(query.Data) + len(query.Increments))
+	for k, v := range query.Data {
+		data[k] = v
+	}
+	for k, v := range query.Increments {
+		data[k] = v
+	}
+	return data
+}
+
+//Returns the values to update an existing row with. Ownership of the
+// row is left unchanged.
+func upsertUpdateData(existing map[string]interface{}, query UpsertQuery) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(query.Data) + len(query.Increments))
+	for k, v := range query.Data {
+		if k == "id" || k == "autoscope_uid" || k == "autoscope_gid" { continue }
+		data[k] = v
+	}
+	for k, quantity := range query.Increments {
+		current, ok := existing[k]
+		if !ok || current == nil {
+			data[k] = quantity
+			continue
+		}
+		switch current.(type) {
+		case int64:
+			data[k] = current.(int64) + quantity
+		default:
+			return nil, errors.New("Cannot increment column unless it's an integer ("+query.Table+"."+k+")")
+		}
+	}
+	return data, nil
+}
+
+//Ensure every key of an upsert has a value
+func validateUpsertKeys(query UpsertQuery) error {
+	if len(query.Keys) == 0 {
+		return errors.New("Upsert requires at least one key field")
+	}
+	for _, key := range query.Keys {
+		if _, ok := query.Data[key]; !ok {
+			return errors.New("Upsert key missing from data: " + key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package engine
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+)
+
+/* roles.go
+
+   Roles grant capabilities over the engine itself, as opposed to table
+   permissions, which govern the rows users can see and modify. Roles are
+   assigned to users (autoscope_user_roles) or to groups
+   (autoscope_group_roles), in which case every member of the group has them.
+
+   - admin: every capability
+   - reader: may view stats, and every application table in the schema
+
+   Further roles may be declared under `roles` in the config, mapping each
+   role to its capabilities. Users listed under `admin_users`, and members of
+   the admin group (Config.AdminGroup), always have the admin role.
+*/
+
+const (
+	RoleAdmin = "admin"
+	RoleReader = "reader"
+
+	//Create users and assign roles
+	CapManageUsers = "manage_users"
+	//Change table permissions and groups, and view the audit log
+	CapManagePermissions = "manage_permissions"
+	//Trigger migrations
+	CapManageMigrations = "manage_migrations"
+	CapViewStats = "view_stats"
+	//View every application table, rather than only those readable
+	CapViewSchema = "view_schema"
+)
+
+//Capabilities of the built-in roles
+func defaultRoles() map[string][]string {
+	return map[string][]string{
+		RoleAdmin: []string{ CapManageUsers, CapManagePermissions,
+			CapManageMigrations, CapViewStats, CapViewSchema },
+		RoleReader: []string{ CapViewStats, CapViewSchema },
+	}
+}
+
+//Return every role known to the engine, mapped to its capabilities.
+// Roles declared in the config extend the built-in roles, but the admin
+// role always has every capability.
+func (e *Engine) Roles() map[string][]string {
+	roles := defaultRoles()
+	if e.Config != nil {
+		for role, caps := range e.Config.Roles {
+			if role == RoleAdmin { continue }
+			roles[role] = caps
+		}
+	}
+	return roles
+}
+
+//Whether `role` is a known role
+func (e *Engine) validRole(role string) error {
+	if _, ok := e.Roles()[role]; !ok {
+		return errors.New("No such role: " + role)
+	}
+	return nil
+}
+
+//Assign a role to a user
+func AssignUserRole(e *Engine, userId int64, role string) error {
+	err := e.validRole(role)
+	if err != nil { return err }
+	e.SchemaLock.RLock()
+	_, err = e.DB.Upsert(e.Schema, nil, UpsertQuery{
+		Table: "autoscope_user_roles",
+		Keys: []string{"user_id", "role"},
+		Data: map[string]interface{}{ "user_id": userId, "role": role },
+		Restriction: Not{ A: Tautology{} },
+	})
+	e.SchemaLock.RUnlock()
+	return err
+}
+
+//Remove a role from a user
+func RemoveUserRole(e *Engine, userId int64, role string) error {
+	_, _, err := e.RawDelete(Filter("autoscope_user_roles", map[string]interface{}{
+		"user_id": userId,
+		"role": role,
+	}))
+	return err
+}
+
+//Assign a role to every member of a group
+func AssignGroupRole(e *Engine, groupId int64, role string) error {
+	err := e.validRole(role)
+	if err != nil { return err }
+	e.SchemaLock.RLock()
+	_, err = e.DB.Upsert(e.Schema, nil, UpsertQuery{
+		Table: "autoscope_group_roles",
+		Keys: []string{"group_id", "role"},
+		Data: map[string]interface{}{ "group_id": groupId, "role": role },
+		Restriction: Not{ A: Tautology{} },
+	})
+	e.SchemaLock.RUnlock()
+	return err
+}
+
+//Remove a role from a group
+func RemoveGroupRole(e *Engine, groupId int64, role string) error {
+	_, _, err := e.RawDelete(Filter("autoscope_group_roles", map[string]interface{}{
+		"group_id": groupId,
+		"role": role,
+	}))
+	return err
+}
+
+//Append the `role` column of every row matching `query` to `roles`
+func selectRoles(e *Engine, query SelectQuery, roles map[string]bool) error {
+	res, _, err := e.RawSelect(query)
+	if err != nil { return err }
+	for res.Next() {
+		m, err := res.Get()
+		if err != nil { return err }
+		if role, ok := m["role"].(string); ok {
+			roles[role] = true
+		}
+	}
+	return nil
+}
+
+//Return the roles of a user, whether assigned directly or through
+// their groups, sorted by name
+func UserRoles(e *Engine, userId int64) ([]string, error) {
+	roles := make(map[string]bool, 0)
+	err := selectRoles(e, Filter("autoscope_user_roles",
+		map[string]interface{}{ "user_id": userId }), roles)
+	if err != nil { return nil, err }
+
+	groups, err := UserGroups(e, userId)
+	if err != nil { return nil, err }
+	for _, gid := range groups {
+		err = selectRoles(e, Filter("autoscope_group_roles",
+			map[string]interface{}{ "group_id": gid }), roles)
+		if err != nil { return nil, err }
+	}
+
+	if !roles[RoleAdmin] {
+		admin, err := bootstrapAdmin(e, userId, groups)
+		if err != nil { return nil, err }
+		roles[RoleAdmin] = admin
+	}
+
+	res := make([]string, 0, len(roles))
+	for role, ok := range roles {
+		if ok { res = append(res, role) }
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+//Whether a user is an admin by configuration, i.e. listed in
+// Config.AdminUsers or a member of Config.AdminGroup
+func bootstrapAdmin(e *Engine, userId int64, groups []int64) (bool, error) {
+	name := "admin"
+	if e.Config != nil && e.Config.AdminGroup != "" {
+		name = e.Config.AdminGroup
+	}
+	//Without an admin group, there are no admins by membership
+	if gid, err := GetGroupId(e, name); err == nil && listContainsInt64(groups, gid) {
+		return true, nil
+	}
+	if e.Config == nil || len(e.Config.AdminUsers) == 0 { return false, nil }
+	username, err := GetUsername(e, userId)
+	if err != nil { return false, nil }
+	for _, admin := range e.Config.AdminUsers {
+		if admin == username { return true, nil }
+	}
+	return false, nil
+}
+
+//Test whether a user has a given role
+func HasRole(e *Engine, userId int64, role string) (bool, error) {
+	roles, err := UserRoles(e, userId)
+	if err != nil { return false, err }
+	for _, r := range roles {
+		if r == role { return true, nil }
+	}
+	return false, nil
+}
+
+//Test whether any of a user's roles grants a capability
+func HasCapability(e *Engine, userId int64, capability string) (bool, error) {
+	roles, err := UserRoles(e, userId)
+	if err != nil { return false, err }
+	defined := e.Roles()
+	for _, role := range roles {
+		for _, c := range defined[role] {
+			if c == capability { return true, nil }
+		}
+	}
+	return false, nil
+}
+
+//Assign a role to a user on behalf of `adminId`, recording the change
+func (e *Engine) AdminAssignUserRole(adminId int64, userId int64, role string) error {
+	err := AssignUserRole(e, userId, role)
+	if err != nil { return err }
+	return AuditPermissions(e, adminId, "", "assign_role", role + " to user " + strconv.FormatInt(userId, 10))
+}
+
+//Remove a role from a user on behalf of `adminId`, recording the change
+func (e *Engine) AdminRemoveUserRole(adminId int64, userId int64, role string) error {
+	err := RemoveUserRole(e, userId, role)
+	if err != nil { return err }
+	return AuditPermissions(e, adminId, "", "remove_role", role + " from user " + strconv.FormatInt(userId, 10))
+}
+
+//Assign a role to a group on behalf of `adminId`, recording the change
+func (e *Engine) AdminAssignGroupRole(adminId int64, groupId int64, role string) error {
+	err := AssignGroupRole(e, groupId, role)
+	if err != nil { return err }
+	return AuditPermissions(e, adminId, "", "assign_role", role + " to group " + strconv.FormatInt(groupId, 10))
+}
+
+//Remove a role from a group on behalf of `adminId`, recording the change
+func (e *Engine) AdminRemoveGroupRole(adminId int64, groupId int64, role string) error {
+	err := RemoveGroupRole(e, groupId, role)
+	if err != nil { return err }
+	return AuditPermissions(e, adminId, "", "remove_role", role + " from group " + strconv.FormatInt(groupId, 10))
+}
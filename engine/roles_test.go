@@ -0,0 +1,84 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoles(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{
+		DatabaseType: "memdb",
+		AdminUsers: []string{ "bootstrap_admin" },
+		Roles: map[string][]string{ "auditor": []string{ CapManagePermissions } },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "role_user", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	adminUID, err := CreateUser(&e, "bootstrap_admin", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	//Users have no roles by default
+	can, err := HasCapability(&e, uid, CapViewSchema)
+	if err != nil { t.Fatal(err.Error()) }
+	if can { t.Fatal("Capability granted without roles") }
+
+	//Configured admins have every capability
+	for _, capability := range []string{ CapManageUsers, CapManagePermissions,
+		CapManageMigrations, CapViewStats, CapViewSchema } {
+		can, err := HasCapability(&e, adminUID, capability)
+		if err != nil { t.Fatal(err.Error()) }
+		if !can { t.Fatal("Admin lacks capability " + capability) }
+	}
+
+	//Roles may be assigned directly
+	err = e.AdminAssignUserRole(adminUID, uid, RoleReader)
+	if err != nil { t.Fatal(err.Error()) }
+	can, err = HasCapability(&e, uid, CapViewStats)
+	if err != nil { t.Fatal(err.Error()) }
+	if !can { t.Fatal("Reader can't view stats") }
+	can, err = HasCapability(&e, uid, CapManageUsers)
+	if err != nil { t.Fatal(err.Error()) }
+	if can { t.Fatal("Reader can manage users") }
+
+	//Or through groups, including configured roles
+	gid, err := CreateGroup(&e, "auditors")
+	if err != nil { t.Fatal(err.Error()) }
+	err = AddUserToGroup(&e, uid, gid)
+	if err != nil { t.Fatal(err.Error()) }
+	err = e.AdminAssignGroupRole(adminUID, gid, "auditor")
+	if err != nil { t.Fatal(err.Error()) }
+	roles, err := UserRoles(&e, uid)
+	if err != nil { t.Fatal(err.Error()) }
+	if !reflect.DeepEqual(roles, []string{ "auditor", RoleReader }) {
+		t.Fatalf("Incorrect roles: %v", roles)
+	}
+	can, err = HasCapability(&e, uid, CapManagePermissions)
+	if err != nil { t.Fatal(err.Error()) }
+	if !can { t.Fatal("Group role not granted") }
+
+	//Removed roles no longer apply
+	err = e.AdminRemoveUserRole(adminUID, uid, RoleReader)
+	if err != nil { t.Fatal(err.Error()) }
+	err = e.AdminRemoveGroupRole(adminUID, gid, "auditor")
+	if err != nil { t.Fatal(err.Error()) }
+	roles, err = UserRoles(&e, uid)
+	if err != nil { t.Fatal(err.Error()) }
+	if len(roles) != 0 { t.Fatalf("Roles not removed: %v", roles) }
+
+	//Unknown roles can't be assigned
+	err = AssignUserRole(&e, uid, "superuser")
+	if err == nil { t.Fatal("Unknown role assigned") }
+
+	//Role changes are recorded
+	changes, err := PermissionsAudit(&e, "")
+	if err != nil { t.Fatal(err.Error()) }
+	if len(changes) != 4 { t.Fatalf("Incorrect number of recorded changes: %d", len(changes)) }
+
+	//Admins may be made by assigning the admin role
+	err = AssignUserRole(&e, uid, RoleAdmin)
+	if err != nil { t.Fatal(err.Error()) }
+	admin, err := IsAdmin(&e, uid)
+	if err != nil { t.Fatal(err.Error()) }
+	if !admin { t.Fatal("Admin role not granted") }
+}
@@ -41,8 +41,24 @@ type Table struct {
 	Aliases []string `yaml:"aliases,omitempty" json:"aliases,omitempty"`
 	//Status of the table: live, migrating or blank (doesn't yet exist)
 	Status string `yaml:"status,omitempty" json:"status,omitempty"`
+	//Column name -> declared foreign key
+	ForeignKeys map[string]ForeignKey `yaml:"foreign_keys,omitempty" json:"foreign_keys,omitempty"`
 }
 
+//A declared foreign key: the column holds the id of a row in Table
+type ForeignKey struct {
+	Table string `yaml:"table" json:"table"`
+	//What happens to referencing rows when the referenced row is deleted:
+	// OnDeleteCascade, OnDeleteSetNull or OnDeleteRestrict (the default)
+	OnDelete string `yaml:"on_delete,omitempty" json:"on_delete,omitempty"`
+}
+
+const (
+	OnDeleteRestrict = "restrict"
+	OnDeleteCascade = "cascade"
+	OnDeleteSetNull = "set null"
+)
+
 
 //MigrationStep Types include:
 // CreateTable  - Create a new table
@@ -50,6 +66,7 @@ type Table struct {
 //                (during migration, the field will count as both column & OF,
 //                 and nodes will use the column for INSERT but col+OF for WHERE)
 // IndexColumn  - Create a new index on a column
+// AddForeignKey - Declare a column as a foreign key
 
 type MigrationStep interface {
 	TableName() string
@@ -94,6 +111,18 @@ func (pf MigrationStepPromoteField) ToString() string {
 	return "Promote object field '" + pf.column + "' for table " + pf.tableName
 }
 
+//Migration step to declare a column as a foreign key
+type MigrationStepAddForeignKey struct {
+	tableName string
+	column string
+	foreignKey ForeignKey
+}
+func (fk MigrationStepAddForeignKey) TableName() string {
+	return fk.tableName
+}
+func (fk MigrationStepAddForeignKey) ToString() string {
+	return "Add foreign key '" + fk.column + "' referencing " + fk.foreignKey.Table + " for table " + fk.tableName
+}
 
 //Returns a map of type associations
 // Internally, autoscope only stores several basic types:
@@ -251,6 +280,38 @@ func NewTableSchemas(config *Config, currentSchema map[string]Table, globalTable
 	return newTables
 }
 
+//Returns the steps declaring foreign keys which are configured in
+// config.Relations, or which have been used in at least
+// config.ForeignKeyThreshhold inserts. Only existing integer columns
+// referencing existing tables are declared.
+func ForeignKeyMigrationSteps(config *Config, schema map[string]Table, globalTableStats map[string]TableQueryStats) []MigrationStep {
+	steps := make([]MigrationStep, 0)
+	for tableName, table := range schema {
+		for column, ty := range table.Columns {
+			if _, ok := table.ForeignKeys[column]; ok { continue }
+			if !listContains(typeArrs()["int"], ty) { continue }
+
+			fk, ok := config.Relations[tableName][column]
+			if !ok && config.ForeignKeyThreshhold > 0 {
+				counts := globalTableStats[tableName].ForeignKeyCount[column]
+				target := maxKey(counts)
+				if target != "" && counts[target] >= config.ForeignKeyThreshhold {
+					fk = ForeignKey{ Table: target, OnDelete: config.ForeignKeyOnDelete }
+					ok = true
+				}
+			}
+			if !ok { continue }
+			if _, exists := schema[fk.Table]; !exists { continue }
+			steps = append(steps, MigrationStepAddForeignKey{
+				tableName: tableName,
+				column: column,
+				foreignKey: fk,
+			})
+		}
+	}
+	return steps
+}
+
 // Take two table schemas and produce migration steps to migrate between them
 // For now this will only create new columns, indices
 func TableDiffMigrationSteps(oldSchema Table, newSchema Table) []MigrationStep {
@@ -11,3 +11,62 @@ func TestTableFromConfig(t *testing.T){
 	}
 	t.Log(tables)
 }
+
+func TestForeignKeyMigrationSteps(t *testing.T){
+	schema := map[string]Table{
+		"events": Table{ Name: "events", Columns: map[string]string{
+			"id": "serial", "venue": "bigint", "host": "bigint", "name": "string",
+		}},
+		"venues": Table{ Name: "venues", Columns: map[string]string{ "id": "serial" } },
+		"people": Table{ Name: "people", Columns: map[string]string{ "id": "serial" } },
+	}
+	stats := map[string]TableQueryStats{
+		"events": TableQueryStats{
+			ForeignKeyCount: map[string]map[string]int64{
+				"venue": map[string]int64{ "venues": 5, "people": 1 },
+				"host": map[string]int64{ "people": 2 },
+				"name": map[string]int64{ "people": 9 },
+			},
+		},
+	}
+	config := &Config{ ForeignKeyThreshhold: 3, ForeignKeyOnDelete: OnDeleteSetNull }
+	steps := ForeignKeyMigrationSteps(config, schema, stats)
+	if len(steps) != 1 {
+		t.Fatal("Incorrect number of steps")
+	}
+	fk := steps[0].(MigrationStepAddForeignKey)
+	if fk.column != "venue" || fk.foreignKey.Table != "venues" || fk.foreignKey.OnDelete != OnDeleteSetNull {
+		t.Fatal("Incorrect step: " + fk.ToString())
+	}
+
+	//Configured relations don't depend on stats
+	config.Relations = map[string]map[string]ForeignKey{
+		"events": map[string]ForeignKey{ "host": ForeignKey{ Table: "people", OnDelete: OnDeleteCascade } },
+	}
+	if len(ForeignKeyMigrationSteps(config, schema, stats)) != 2 {
+		t.Fatal("Configured relation not declared")
+	}
+
+	//Declared keys aren't declared again
+	events := schema["events"]
+	events.ForeignKeys = map[string]ForeignKey{ "venue": ForeignKey{ Table: "venues" } }
+	schema["events"] = events
+	if len(ForeignKeyMigrationSteps(config, schema, stats)) != 1 {
+		t.Fatal("Declared foreign key declared again")
+	}
+
+	//Declared keys take precedence over stats in relational queries
+	events.ForeignKeys["venue"] = ForeignKey{ Table: "people" }
+	prefixes, err := genPrefixes(schema, stats, "events", ValueSelection{ Attr: "venue__name", Value: "Hall", Op: "=" })
+	if err != nil { t.Fatal(err.Error()) }
+	if prefixes["__venue"].Table != "people" {
+		t.Fatal("Declared foreign key not used")
+	}
+
+	//Reverse relations may be declared only, without stats
+	prefixes, err = genPrefixes(schema, map[string]TableQueryStats{}, "people", ValueSelection{ Attr: "events__date", Value: int64(10), Op: ">" })
+	if err != nil { t.Fatal(err.Error()) }
+	if p := prefixes["__events"]; p.Kind != RelationReverse || p.ReverseField != "venue" || p.Table != "events" {
+		t.Fatalf("Declared reverse relation not used: %+v", p)
+	}
+}
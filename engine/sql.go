@@ -34,9 +34,20 @@ type SQLPart struct {
 	Args []interface{}
 }
 
-//Structure representing the current official database schema
+//Structure representing the current official database schema, against
+// which formulas are validated. See validation.go.
 type SchemaInfo struct {
-
+	//Table the formula restricts
+	Table string
+	Schema map[string]Table
+	Stats map[string]TableQueryStats
+	//Relations of the formula's relational attributes, by prefix
+	Prefixes map[string]RelationPath
+	//If true, unknown fields and relations and type mismatches are errors.
+	// Otherwise only invalid operators are.
+	Strict bool
+	//Problems found during validation
+	Errors []SemanticError
 }
 
 //Since we don't have Sum-types, we'll use an interface
@@ -107,9 +118,16 @@ func (as AttrSelection) toSQL() (SQLPart, error) {
 	return SQLPart{SQL: cast("%s", as.CastA) + " " + as.Op + " "+cast("%s", as.CastB), Idents:[]string{as.AttrA, as.AttrB}}, nil
 }
 func (as AttrSelection) validateSemantics(t *SchemaInfo) bool {
-	//TODO: Ensure AttrA and AttrB are present in table info (if production mode)
-	//TODO: Ensure that if AttrA or AttrB are attributes of other tables,
-	//  that they are present in their schemas (if production mode)
+	if !ValidOp(as.Op) {
+		return t.addError(as.AttrA, SemanticInvalidOperator, "Invalid operator " + as.Op)
+	}
+	tyA, okA := t.fieldType(as.AttrA)
+	tyB, okB := t.fieldType(as.AttrB)
+	if !okA || !okB { return false }
+	if t.Strict && !comparableTypes(tyA, tyB, as.Op) {
+		return t.addError(as.AttrA, SemanticTypeMismatch,
+			"Cannot compare " + as.AttrA + " (" + tyA + ") with " + as.AttrB + " (" + tyB + ") using " + as.Op)
+	}
 	return true
 }
 func (as AttrSelection) MarshalJSON() (b []byte, err error) {
@@ -144,7 +162,17 @@ func (vs ValueSelection) toSQL() (SQLPart, error) {
 		Args:[]interface{}{vs.Value}}, nil
 }
 func (vs ValueSelection) validateSemantics(t *SchemaInfo) bool {
-	//TODO: Ensure Attr is present in table info (if production mode)
+	if !ValidOp(vs.Op) {
+		return t.addError(vs.Attr, SemanticInvalidOperator, "Invalid operator " + vs.Op)
+	}
+	ty, ok := t.fieldType(vs.Attr)
+	if !ok { return false }
+	if vs.Value == nil { return true }
+	valueTy := valueType(vs.Value)
+	if t.Strict && !comparableTypes(ty, valueTy, vs.Op) {
+		return t.addError(vs.Attr, SemanticTypeMismatch,
+			"Cannot compare " + vs.Attr + " (" + ty + ") with a " + valueTy + " value using " + vs.Op)
+	}
 	return true
 }
 func (vs ValueSelection) MarshalJSON() (b []byte, err error) {
@@ -208,7 +236,9 @@ func (o Or) toSQL() (SQLPart, error) {
 		Args:append(aSQL.Args, bSQL.Args...)}, err
 }
 func (o Or) validateSemantics(t *SchemaInfo) bool {
-	return o.A.validateSemantics(t) && o.B.validateSemantics(t)
+	//Validate both sides, so every error is reported
+	a := o.A.validateSemantics(t)
+	return o.B.validateSemantics(t) && a
 }
 func (o *Or) FromJSON(b []byte) (err error){
 	args, err := extractArgs(b)
@@ -253,7 +283,9 @@ func (a And) toSQL() (SQLPart, error) {
 		Args:append(aSQL.Args, bSQL.Args...)}, err
 }
 func (a And) validateSemantics(t *SchemaInfo) bool {
-	return a.A.validateSemantics(t) && a.B.validateSemantics(t)
+	//Validate both sides, so every error is reported
+	valid := a.A.validateSemantics(t)
+	return a.B.validateSemantics(t) && valid
 }
 func (a *And) FromJSON(b []byte) (err error){
 	args, err := extractArgs(b)
@@ -333,6 +365,9 @@ type SelectQuery struct {
 	Table string `json:"table"`
 	Selection Formula `json:"selection"`
 	//Columns []string //Not yet used
+	//Relation paths (e.g. venue, venue__owner) whose referenced rows are
+	// embedded in each result, see expand.go
+	Expand []string `json:"expand"`
 }
 
 //Structure representing an INSERT SQL query
@@ -346,6 +381,42 @@ type InsertQuery struct {
 	//Map of fields to the autoscope types contained within them
 	// Always optional, this simply provides additional control over the stored type
 	Types map[string]string `json:"types"`
+	//Map of fields holding nested objects to the fields used to look up an
+	// existing related object. If one matches, it is referenced instead of
+	// inserting a new object.
+	LookupKeys map[string][]string `json:"lookup_keys"`
+	//Group the row belongs to, which the user must be a member of.
+	// Defaults to the table's default group.
+	Group *int64 `json:"group"`
+}
+
+//Query to insert a row, or update the existing row whose key fields
+// (columns or object fields) are equal to those in Data
+type UpsertQuery struct {
+	Table string `json:"table"`
+	//Fields identifying a row. Each must be present in Data.
+	Keys []string `json:"keys"`
+	Data map[string]interface{} `json:"data"`
+	//Integer fields which are incremented by the given amount when the row
+	// exists, and initialized to it otherwise
+	Increments map[string]int64 `json:"increments"`
+	ForeignKeys map[string]string `json:"foreign_keys"`
+	Types map[string]string `json:"types"`
+	//Restriction the existing row must satisfy to be updated. The engine
+	// adds update permissions to it.
+	Restriction Formula `json:"-"`
+	//As for InsertQuery. Only applies to inserted rows.
+	Group *int64 `json:"group"`
+}
+
+//Query to insert many rows into the same table at once
+type BatchInsertQuery struct {
+	Table string `json:"table"`
+	Data []map[string]interface{} `json:"data"`
+	//As for InsertQuery, shared by all rows
+	ForeignKeys map[string]string `json:"foreign_keys"`
+	Types map[string]string `json:"types"`
+	Group *int64 `json:"group"`
 }
 
 //Structure representing an UPDATE SQL query
@@ -357,6 +428,16 @@ type UpdateQuery struct {
 	Types map[string]string `json:"types"`
 }
 
+//Query to change the owner and/or group of the rows matching Selection
+type ChownQuery struct {
+	Table string `json:"table"`
+	Selection Formula `json:"selection"`
+	//New owner of the rows, or nil to leave it unchanged
+	Owner *int64 `json:"owner"`
+	//New group of the rows, or nil to leave it unchanged
+	Group *int64 `json:"group"`
+}
+
 
 //Helper function to recursively transform formula attributes
 func ModifyLeaves(fn func(Formula)Formula, formula Formula) Formula {
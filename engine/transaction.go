@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"errors"
+)
+
+/* transaction.go
+
+   Transactions group several engine operations so that they are applied
+   either completely or not at all. Permissions and stats are handled exactly
+   as for the equivalent non-transactional methods on Engine, except that
+   stats and newly claimed tables only count once the transaction commits.
+*/
+
+type Transaction struct {
+	e *Engine
+	tx *engineTx
+	done bool
+}
+
+//A database transaction along with changes to the engine's in-memory
+// state which must only apply if it commits
+type engineTx struct {
+	AutoscopeTx
+	//Permissions and owners of tables claimed within the transaction
+	claimed map[string]ObjectPermissions
+	owners map[string]int64
+	//Stats of queries within the transaction, counted once it commits
+	stats map[string]TableQueryStats
+}
+
+//Begin a new transaction. It must be finished with Commit or Rollback.
+func (e *Engine) Begin() (*Transaction, error) {
+	tx, err := e.DB.Begin()
+	if err != nil { return nil, err }
+	return &Transaction{ e: e, tx: &engineTx{
+		AutoscopeTx: tx,
+		claimed: make(map[string]ObjectPermissions, 0),
+		owners: make(map[string]int64, 0),
+		stats: make(map[string]TableQueryStats, 0),
+	}}, nil
+}
+
+//Perform a Select query within the transaction
+func (t *Transaction) Select(userId int64, query SelectQuery) (RetrievalResult, error){
+	if t.done { return nil, errors.New("Transaction already finished") }
+	return t.e.selectOn(t.tx, userId, query)
+}
+
+//Perform an Insert query within the transaction
+func (t *Transaction) Insert(userId int64, query InsertQuery) (ModificationResult, error){
+	if t.done { return nil, errors.New("Transaction already finished") }
+	return t.e.insertOn(t.tx, userId, query)
+}
+
+//Insert many rows within the transaction
+func (t *Transaction) InsertBatch(userId int64, query BatchInsertQuery) ([]int64, error){
+	if t.done { return nil, errors.New("Transaction already finished") }
+	return t.e.insertBatchOn(t.tx, userId, query)
+}
+
+//Perform an upsert within the transaction
+func (t *Transaction) Upsert(userId int64, query UpsertQuery) (ModificationResult, error){
+	if t.done { return nil, errors.New("Transaction already finished") }
+	return t.e.upsertOn(t.tx, userId, query)
+}
+
+//Perform an Update query within the transaction
+func (t *Transaction) Update(userId int64, query UpdateQuery) (ModificationResult, error){
+	if t.done { return nil, errors.New("Transaction already finished") }
+	return t.e.updateOn(t.tx, userId, query)
+}
+
+//Change the owner and/or group of rows within the transaction
+func (t *Transaction) Chown(userId int64, query ChownQuery) (ModificationResult, error){
+	if t.done { return nil, errors.New("Transaction already finished") }
+	return t.e.chownOn(t.tx, userId, query)
+}
+
+//Perform a Delete query within the transaction
+func (t *Transaction) Delete(userId int64, query SelectQuery) (ModificationResult, error){
+	if t.done { return nil, errors.New("Transaction already finished") }
+	return t.e.deleteOn(t.tx, userId, query)
+}
+
+//Perform a select query within the transaction without checking
+// permissions or logging stats
+func (t *Transaction) RawSelect(query SelectQuery) (RetrievalResult, map[string]RelationPath, error){
+	if t.done { return nil, nil, errors.New("Transaction already finished") }
+	return t.e.rawSelectOn(t.tx, query)
+}
+
+//Perform an insertion within the transaction without checking
+// permissions or logging stats
+func (t *Transaction) RawInsert(query InsertQuery) (ModificationResult, error){
+	if t.done { return nil, errors.New("Transaction already finished") }
+	return t.tx.Insert(t.e.Schema, query)
+}
+
+func (t *Transaction) Commit() error {
+	if t.done { return errors.New("Transaction already finished") }
+	t.done = true
+	err := t.tx.Commit()
+	if err != nil { return err }
+	t.e.publishClaims(t.tx)
+	t.e.mergeStats(t.tx)
+	return nil
+}
+
+//Abandon the transaction. Calling Rollback after Commit has no effect,
+// so it may be deferred.
+func (t *Transaction) Rollback() error {
+	if t.done { return nil }
+	t.done = true
+	return t.tx.Rollback()
+}
@@ -0,0 +1,229 @@
+package engine
+
+import (
+	"testing"
+)
+
+func countRows(t *testing.T, res RetrievalResult, err error) int {
+	if err != nil { t.Fatal(err.Error()) }
+	n := 0
+	for res.Next() { n += 1 }
+	return n
+}
+
+func TestTransactions(t *testing.T){
+	var e Engine
+	config := Config{
+		DatabaseType: "memdb",
+	}
+	err := e.Init(&config)
+	if err != nil { t.Fatal(err.Error()) }
+
+	uid, err := CreateUser(&e, "txUser", "password")
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = CreateUser(&e, "txUser", "password")
+	if err == nil { t.Fatal("Duplicate user created") }
+
+	query := SelectQuery{ Table: "tx_table", Selection: Tautology{} }
+
+	//Rolled back changes must never become visible
+	tx, err := e.Begin()
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = tx.Insert(uid, InsertQuery{
+		Table: "tx_table",
+		Data: map[string]interface{}{ "name": "rolled back" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	res, err := tx.Select(uid, query)
+	if countRows(t, res, err) != 1 {
+		t.Fatal("Insert not visible within transaction")
+	}
+	err = tx.Rollback()
+	if err != nil { t.Fatal(err.Error()) }
+	res, err = e.Select(uid, query)
+	if countRows(t, res, err) != 0 {
+		t.Fatal("Rolled back insert is visible")
+	}
+
+	//Committed changes all apply at once
+	tx, err = e.Begin()
+	if err != nil { t.Fatal(err.Error()) }
+	for _, name := range []string{"a", "b"} {
+		_, err = tx.Insert(uid, InsertQuery{
+			Table: "tx_table",
+			Data: map[string]interface{}{ "name": name },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+	}
+	_, err = tx.Delete(uid, SelectQuery{
+		Table: "tx_table",
+		Selection: ValueSelection{ Attr: "name", Value: "a", Op: "=" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	err = tx.Commit()
+	if err != nil { t.Fatal(err.Error()) }
+	res, err = e.Select(uid, query)
+	if countRows(t, res, err) != 1 {
+		t.Fatal("Committed changes not visible")
+	}
+	_, err = tx.Insert(uid, InsertQuery{ Table: "tx_table", Data: map[string]interface{}{} })
+	if err == nil { t.Fatal("Insert allowed after commit") }
+
+	//Stats are recorded as for non-transactional queries, but only
+	// for the committed transaction
+	stats := e.LocalStats["tx_table"]
+	if stats.InsertQueries != 2 || stats.DeleteQueries != 1 {
+		t.Fatal("Incorrect stats for transactional queries")
+	}
+}
+
+//Tables created within a transaction are only claimed if it commits
+func TestTransactionClaims(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "txClaimer", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	insert := func(tx *Transaction, table string) {
+		_, err := tx.Insert(uid, InsertQuery{
+			Table: table,
+			Data: map[string]interface{}{ "name": "a" },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+	}
+	claimed := func(table string) bool {
+		stored, _, err := e.storedPermissions()
+		if err != nil { t.Fatal(err.Error()) }
+		_, inDB := stored[table]
+		owner, owned := e.TableOwner(table)
+		if owned && owner != uid { t.Fatal("Incorrect owner of " + table) }
+		if inDB != owned { t.Fatal("Stored and cached claims of " + table + " differ") }
+		return owned
+	}
+
+	tx, err := e.Begin()
+	if err != nil { t.Fatal(err.Error()) }
+	insert(tx, "tx_rolled_back")
+	//The claim applies within the transaction, so further inserts succeed
+	insert(tx, "tx_rolled_back")
+	err = tx.Rollback()
+	if err != nil { t.Fatal(err.Error()) }
+	if claimed("tx_rolled_back") { t.Fatal("Rolled back claim applied") }
+
+	//The table may still be claimed afterwards
+	_, err = e.Insert(uid, InsertQuery{
+		Table: "tx_rolled_back",
+		Data: map[string]interface{}{ "name": "b" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+	if !claimed("tx_rolled_back") { t.Fatal("Table not claimed after rollback") }
+
+	tx, err = e.Begin()
+	if err != nil { t.Fatal(err.Error()) }
+	insert(tx, "tx_committed")
+	if _, owned := e.TableOwner("tx_committed"); owned {
+		t.Fatal("Claim applied before commit")
+	}
+	err = tx.Commit()
+	if err != nil { t.Fatal(err.Error()) }
+	if !claimed("tx_committed") { t.Fatal("Committed claim not applied") }
+}
+
+//Stats of queries in a transaction only count once it commits
+func TestTransactionStats(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "txStats", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	inserts := func(commit bool) {
+		tx, err := e.Begin()
+		if err != nil { t.Fatal(err.Error()) }
+		_, err = tx.Insert(uid, InsertQuery{
+			Table: "tx_stats",
+			Data: map[string]interface{}{ "name": "a" },
+		})
+		if err != nil { t.Fatal(err.Error()) }
+		res, err := tx.Select(uid, Filter("tx_stats", map[string]interface{}{ "name": "a" }))
+		countRows(t, res, err)
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil { t.Fatal(err.Error()) }
+	}
+	localStats := func() TableQueryStats {
+		e.LocalStatsLock.Lock()
+		defer e.LocalStatsLock.Unlock()
+		return tableStats(e.LocalStats, "tx_stats")
+	}
+
+	inserts(false)
+	stats := localStats()
+	if stats.InsertQueries != 0 || stats.SelectQueries != 0 || len(stats.ObjectFieldCount) != 0 {
+		t.Fatalf("Stats of rolled back transaction recorded: %+v", stats)
+	}
+
+	inserts(true)
+	stats = localStats()
+	if stats.InsertQueries != 1 || stats.SelectQueries != 1 ||
+		stats.ObjectFieldCount["name"]["string"] != 1 {
+		t.Fatalf("Stats of committed transaction not recorded: %+v", stats)
+	}
+}
+
+//Many-to-many fields may be inserted within a transaction once their
+// through table exists
+func TestTransactionManyToMany(t *testing.T){
+	var e Engine
+	err := e.Init(&Config{ DatabaseType: "memdb" })
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "txLinker", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	query := func(name string) InsertQuery {
+		return InsertQuery{
+			Table: "tx_bands",
+			Data: map[string]interface{}{
+				"name": name,
+				"artists": []interface{}{ map[string]interface{}{ "name": name } },
+			},
+			ForeignKeys: map[string]string{ "artists": "tx_artists" },
+		}
+	}
+	through := throughTableName("tx_bands", "artists")
+	links := func() int {
+		res, _, err := e.RawSelect(SelectQuery{ Table: through, Selection: Tautology{} })
+		return countRows(t, res, err)
+	}
+
+	//The through table can't be created within a transaction
+	tx, err := e.Begin()
+	if err != nil { t.Fatal(err.Error()) }
+	_, err = tx.Insert(uid, query("first"))
+	if err == nil { t.Fatal("Many-to-many insert without through table allowed") }
+	err = tx.Rollback()
+	if err != nil { t.Fatal(err.Error()) }
+	if _, ok := e.Schema[through]; ok { t.Fatal("Through table created") }
+
+	_, err = e.Insert(uid, query("first"))
+	if err != nil { t.Fatal(err.Error()) }
+
+	//Links are only inserted if the transaction commits
+	for _, commit := range []bool{ false, true } {
+		tx, err = e.Begin()
+		if err != nil { t.Fatal(err.Error()) }
+		_, err = tx.Insert(uid, query("second"))
+		if err != nil { t.Fatal(err.Error()) }
+		if commit {
+			err = tx.Commit()
+		} else {
+			err = tx.Rollback()
+		}
+		if err != nil { t.Fatal(err.Error()) }
+	}
+	if links() != 2 { t.Fatal("Incorrect number of links") }
+}
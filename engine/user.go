@@ -7,6 +7,7 @@ import (
 	"errors"
 	_ "log"
 	"math/rand"
+	"sort"
 )
 
 //Perform a login attempt for user `username`. Returns true on success
@@ -28,27 +29,29 @@ func Login(e *Engine, username string, password string) (bool, error) {
 
 // Create a new user with given password
 func CreateUser(e *Engine, username string, password string) (int64, error) {
-	//First ensure no such user exists.
-	sres, _, err := e.RawSelect(Filter("autoscope_users", map[string]interface{}{
-			"username": username,
-	}))
-	if sres.Next() {
-		return -1, errors.New("User with given username already exists")
-	}
-
 	salt := rand.Int31()
 	salted := password + strconv.FormatInt(int64(salt), 10)
 	passhash, err := bcrypt.GenerateFromPassword([]byte(salted), 10)
 	if err != nil { return -1, err }
-	res, err := e.RawInsert(InsertQuery{
+
+	//Upsert on the username without ever updating, so that the user is
+	// only created if no user with that name exists
+	e.SchemaLock.RLock()
+	res, err := e.DB.Upsert(e.Schema, nil, UpsertQuery{
 		Table: "autoscope_users",
+		Keys: []string{"username"},
 		Data: map[string]interface{}{
 			"username": username,
 			"passhash": string(passhash),
 			"salt": salt,
 		},
+		Restriction: Not{ A: Tautology{} },
 	})
+	e.SchemaLock.RUnlock()
 	if err != nil { return -2, err }
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return -1, errors.New("User with given username already exists")
+	}
 	insertId, err := res.LastInsertId()
 	return insertId, err
 }
@@ -66,6 +69,40 @@ func GetUserId(e *Engine, username string) (userId int64, err error){
 	return -1, errors.New("No such user found")
 }
 
+//Get a user's username from their ID
+func GetUsername(e *Engine, userId int64) (string, error){
+	res, _, err := e.RawSelect(Filter("autoscope_users", map[string]interface{}{
+		"id": userId,
+	}))
+	if err != nil { return "", err }
+	m, ok, err := FirstRow(res)
+	if err != nil { return "", err }
+	if !ok { return "", errors.New("No such user found") }
+	username, _ := m["username"].(string)
+	return username, nil
+}
+
+//Return the ID and username of every user, ordered by ID
+func ListUsers(e *Engine) ([]map[string]interface{}, error){
+	res, _, err := e.RawSelect(SelectQuery{ Table: "autoscope_users" })
+	if err != nil { return nil, err }
+	users := make([]map[string]interface{}, 0)
+	for res.Next(){
+		m, err := res.Get()
+		if err != nil { return nil, err }
+		users = append(users, map[string]interface{}{
+			"id": m["id"],
+			"username": m["username"],
+		})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		a, _ := idValue(users[i]["id"])
+		b, _ := idValue(users[j]["id"])
+		return a < b
+	})
+	return users, nil
+}
+
 //Authorize a request for the given user. 
 func Authorize(e *Engine, username string, session_id string, expiry_time int64) (bool, error){
 	t := time.Now().Unix()
@@ -121,11 +158,51 @@ func AddUserToGroup(e *Engine, userId int64, groupId int64) error {
 			"group_id": groupId,
 		},
 	})
-	return err
+	if err != nil { return err }
+	return e.invalidateGroupCache()
+}
+
+//Remove a user from a group
+func RemoveUserFromGroup(e *Engine, userId int64, groupId int64) error {
+	_, _, err := e.RawDelete(Filter("autoscope_user_groups", map[string]interface{}{
+		"user_id": userId,
+		"group_id": groupId,
+	}))
+	if err != nil { return err }
+	return e.invalidateGroupCache()
+}
+
+//Delete a group, removing its members and its association with
+// tables and roles
+func DeleteGroup(e *Engine, groupId int64) error {
+	_, _, err := e.RawDelete(Filter("autoscope_groups", map[string]interface{}{
+		"id": groupId,
+	}))
+	if err != nil { return err }
+	for _, table := range []string{"autoscope_user_groups", "autoscope_table_groups", "autoscope_group_roles"} {
+		_, _, err = e.RawDelete(Filter(table, map[string]interface{}{
+			"group_id": groupId,
+		}))
+		if err != nil { return err }
+	}
+	return e.invalidateGroupCache()
 }
 
-//Return a list of the IDs of all the groups a user is member of 
+//Return a list of the IDs of all the groups a user is member of.
+// Groups are cached; see group_cache.go.
 func UserGroups(e *Engine, userId int64) ([]int64, error){
+	return e.cachedGroups(func(c *GroupCache) ([]int64, bool) {
+		groups, ok := c.users[userId]
+		return groups, ok
+	}, func(c *GroupCache, groups []int64) {
+		c.users[userId] = groups
+	}, func() ([]int64, error) {
+		return storedUserGroups(e, userId)
+	})
+}
+
+//Select the groups a user is member of, sorted by id
+func storedUserGroups(e *Engine, userId int64) ([]int64, error){
 	res, _, err := e.RawSelect(Filter("autoscope_user_groups",
 			map[string]interface{}{"user_id": userId,},
 		))
@@ -136,18 +213,15 @@ func UserGroups(e *Engine, userId int64) ([]int64, error){
 		if err != nil { return nil, err }
 		groups = append(groups, m["group_id"].(int64))
 	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
 	return groups, nil
 }
 
 //Test whether a user is in a given group
-// TODO: Cache an in-memory user->groups map for logged-in users
 func UserInGroup(e *Engine, userId int64, groupId int64) (bool, error) {
-	res, _, err := e.RawSelect(Filter("autoscope_user_groups", map[string]interface{}{
-		"user_id": userId,
-		"group_id": groupId,
-	}))
+	groups, err := UserGroups(e, userId)
 	if err != nil { return false, err }
-	return res.Next(), nil
+	return listContainsInt64(groups, groupId), nil
 }
 
 //Return a group's ID given its name
@@ -165,3 +239,9 @@ func GetGroupId(e *Engine, groupName string) (int64, error){
 	
 	return -1, errors.New("No group found")
 }
+
+//Test whether a user has the admin role, and so may administer
+// permissions, users and migrations. See roles.go.
+func IsAdmin(e *Engine, userId int64) (bool, error) {
+	return HasRole(e, userId, RoleAdmin)
+}
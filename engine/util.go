@@ -38,6 +38,25 @@ func incrementCountMap(m map[string]map[string]int64, k1 string, k2 string) map[
 	return m
 }
 
+//Add every count in `src` to `dst`
+func addCountMap(dst map[string]map[string]int64, src map[string]map[string]int64) {
+	for k1, m := range src {
+		if _, ok := dst[k1]; !ok {
+			dst[k1] = make(map[string]int64, 0)
+		}
+		for k2, v := range m {
+			dst[k1][k2] += v
+		}
+	}
+}
+
+//Return a copy of a list, so that cached lists can't be modified
+func copyInt64s(list []int64) []int64 {
+	res := make([]int64, len(list))
+	copy(res, list)
+	return res
+}
+
 //Returns true if `needle` is an element of `haystack`
 func listContains(haystack []string, needle string) bool {
 	for _, val := range(haystack) {
@@ -46,6 +65,13 @@ func listContains(haystack []string, needle string) bool {
 	return false
 }
 
+func listContainsInt64(haystack []int64, needle int64) bool {
+	for _, val := range(haystack) {
+		if val == needle { return true }
+	}
+	return false
+}
+
 //Type alias and functions to allow us to sort an array of strings by length
 type ByLength []string
 func (s ByLength) Len() int {
@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"strings"
+)
+
+/* validation.go
+
+   Formulas are validated against the schema and stats before any SQL is
+   generated. Invalid operators are always rejected. In production mode
+   (Config.ProductionMode), selections on unknown fields, relations which
+   can't be resolved, and comparisons between incompatible types are
+   rejected too; otherwise they are allowed, since the schema is still
+   being inferred from usage.
+*/
+
+//Codes identifying the kind of a SemanticError
+const (
+	SemanticInvalidOperator = "invalid_operator"
+	SemanticUnknownField = "unknown_field"
+	SemanticUnknownRelation = "unknown_relation"
+	SemanticTypeMismatch = "type_mismatch"
+)
+
+//A single problem with a formula
+type SemanticError struct {
+	//Attribute the problem concerns
+	Attr string `json:"attr"`
+	Code string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e SemanticError) Error() string {
+	return e.Message
+}
+
+//Error returned for a formula which fails validation, listing every problem
+type ValidationError struct {
+	Errors []SemanticError `json:"errors"`
+}
+
+func (e ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, err.Message)
+	}
+	return "Invalid selection: " + strings.Join(messages, "; ")
+}
+
+//Record a problem. Always returns false, for convenience.
+func (t *SchemaInfo) addError(attr string, code string, message string) bool {
+	t.Errors = append(t.Errors, SemanticError{ Attr: attr, Code: code, Message: message })
+	return false
+}
+
+//Determine the type of an attribute, as one of int, float, decimal,
+// string, bool, json or unknown. Returns false if the attribute is invalid.
+func (t *SchemaInfo) fieldType(attr string) (string, bool) {
+	parts := strings.Split(attr, "__")
+	table := t.Table
+	prefix := ""
+	for _, field := range parts[0:len(parts) - 1] {
+		prefix += "__" + field
+		path, ok := t.Prefixes[prefix]
+		if !ok || path.Table == "" {
+			if !t.Strict { return "unknown", true }
+			return "unknown", t.addError(attr, SemanticUnknownRelation,
+				"Unknown relation " + strings.TrimPrefix(prefix, "__") + " of " + table)
+		}
+		table = path.Table
+	}
+
+	field := parts[len(parts) - 1]
+	switch field {
+	case "id", "autoscope_uid", "autoscope_gid":
+		return "int", true
+	}
+	if ty, ok := t.Schema[table].Columns[field]; ok {
+		return columnTypeCategory(ty), true
+	}
+	if counts := t.Stats[table].ObjectFieldCount[field]; len(counts) > 0 {
+		return columnTypeCategory(maxKey(counts)), true
+	}
+	if !t.Strict { return "unknown", true }
+	return "unknown", t.addError(attr, SemanticUnknownField, "Unknown field " + field + " of " + table)
+}
+
+//Reduce a column type (e.g. varchar(20)) to the kind of values it holds
+func columnTypeCategory(ty string) string {
+	ty = strings.ToLower(strings.Split(ty, "(")[0])
+	types := typeArrs()
+	categories := []struct{ name string; types []string }{
+		{ "int", types["int"] },
+		{ "float", types["float"] },
+		{ "decimal", types["decimal"] },
+		{ "string", types["str"] },
+		{ "json", types["json"] },
+		{ "bool", []string{"bool", "boolean"} },
+	}
+	for _, c := range categories {
+		if listContains(c.types, ty) { return c.name }
+	}
+	return "unknown"
+}
+
+//Return the type of a value compared against in a selection
+func valueType(v interface{}) string {
+	if _, ok := v.(bool); ok { return "bool" }
+	return columnTypeCategory(TypeFromValue(v))
+}
+
+//Whether values of types `a` and `b` may be compared using `op`
+func comparableTypes(a string, b string, op string) bool {
+	for _, ty := range []string{a, b} {
+		if ty == "unknown" || ty == "json" { return true }
+	}
+	if op == "LIKE" {
+		return a == "string" && b == "string"
+	}
+	numeric := []string{"int", "float", "decimal"}
+	if listContains(numeric, a) && listContains(numeric, b) {
+		return true
+	}
+	return a == b
+}
+
+//Validate a selection on `table` against the current schema and stats.
+// Returns a ValidationError describing every problem found.
+func (e *Engine) ValidateSelection(table string, selection Formula) error {
+	if selection == nil { return nil }
+	e.SchemaLock.RLock()
+	defer e.SchemaLock.RUnlock()
+	e.GlobalStatsLock.RLock()
+	defer e.GlobalStatsLock.RUnlock()
+
+	//Selections with invalid operators can't be converted to SQL, so their
+	// relations can't be determined. They are reported by validation below.
+	prefixes, prefixErr := genPrefixes(e.Schema, e.GlobalStats, table, selection)
+	if prefixErr != nil {
+		prefixes = make(map[string]RelationPath, 0)
+	}
+	info := SchemaInfo{
+		Table: table,
+		Schema: e.Schema,
+		Stats: e.GlobalStats,
+		Prefixes: prefixes,
+		Strict: e.Config != nil && e.Config.ProductionMode,
+	}
+	if !selection.validateSemantics(&info) && len(info.Errors) > 0 {
+		return ValidationError{ Errors: info.Errors }
+	}
+	return prefixErr
+}
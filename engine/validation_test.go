@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"testing"
+)
+
+func TestValidateSemantics(t *testing.T){
+	schema := map[string]Table{
+		"events": Table{ Name: "events", Columns: map[string]string{
+			"id": "serial", "name": "varchar(20)", "price": "float", "venue": "int",
+		}},
+		"venues": Table{ Name: "venues", Columns: map[string]string{
+			"id": "serial", "name": "string",
+		}},
+	}
+	stats := map[string]TableQueryStats{
+		"events": TableQueryStats{
+			ObjectFieldCount: map[string]map[string]int64{
+				"rating": map[string]int64{ "int": 4, "string": 1 },
+			},
+		},
+	}
+	prefixes := map[string]RelationPath{
+		"__venue": RelationPath{ Table: "venues", FromTable: "events", FromTablePrefix: "__root", FromField: "venue" },
+		"__organizer": RelationPath{ Table: "", FromTable: "events", FromTablePrefix: "__root", FromField: "organizer" },
+	}
+	info := func(strict bool) *SchemaInfo {
+		return &SchemaInfo{ Table: "events", Schema: schema, Stats: stats, Prefixes: prefixes, Strict: strict }
+	}
+
+	valid := []Formula{
+		ValueSelection{ Attr: "name", Op: "LIKE", Value: "Gala%" },
+		ValueSelection{ Attr: "price", Op: "<", Value: int64(10) },
+		ValueSelection{ Attr: "rating", Op: ">=", Value: 2.5 },
+		ValueSelection{ Attr: "venue__name", Op: "=", Value: "Hall" },
+		ValueSelection{ Attr: "autoscope_uid", Op: "=", Value: int64(1) },
+		AttrSelection{ AttrA: "id", Op: "<", AttrB: "price" },
+		Not{ A: Tautology{} },
+	}
+	for _, f := range valid {
+		if !f.validateSemantics(info(true)) {
+			t.Fatalf("Valid formula rejected: %#v", f)
+		}
+	}
+
+	invalid := map[string]Formula{
+		SemanticInvalidOperator: ValueSelection{ Attr: "name", Op: "~", Value: "x" },
+		SemanticUnknownField: ValueSelection{ Attr: "venue__capacity", Op: ">", Value: int64(1) },
+		SemanticUnknownRelation: ValueSelection{ Attr: "organizer__name", Op: "=", Value: "Jim" },
+		SemanticTypeMismatch: AttrSelection{ AttrA: "name", Op: ">", AttrB: "price" },
+	}
+	for code, f := range invalid {
+		i := info(true)
+		if f.validateSemantics(i) || len(i.Errors) != 1 || i.Errors[0].Code != code {
+			t.Fatalf("Expected %s for %#v, found %v", code, f, i.Errors)
+		}
+	}
+
+	//Outside of strict mode only invalid operators are rejected
+	i := info(false)
+	if !(And{ A: invalid[SemanticUnknownField], B: invalid[SemanticTypeMismatch] }).validateSemantics(i) {
+		t.Fatal(ValidationError{ Errors: i.Errors }.Error())
+	}
+	if invalid[SemanticInvalidOperator].validateSemantics(info(false)) {
+		t.Fatal("Invalid operator allowed")
+	}
+
+	//Every problem is reported
+	i = info(true)
+	Or{ A: invalid[SemanticUnknownField], B: ValueSelection{ Attr: "price", Op: "=", Value: "free" } }.validateSemantics(i)
+	if len(i.Errors) != 2 || i.Errors[1].Code != SemanticTypeMismatch {
+		t.Fatalf("Incorrect errors: %v", i.Errors)
+	}
+}
+
+func TestProductionModeValidation(t *testing.T){
+	var e Engine
+	config := Config{
+		DatabaseType: "memdb",
+		ProductionMode: true,
+	}
+	err := e.Init(&config)
+	if err != nil { t.Fatal(err.Error()) }
+	uid, err := CreateUser(&e, "strictUser", "password")
+	if err != nil { t.Fatal(err.Error()) }
+
+	_, err = e.Select(uid, SelectQuery{
+		Table: "autoscope_users",
+		Selection: ValueSelection{ Attr: "no_such_field", Op: "=", Value: "x" },
+	})
+	verr, ok := err.(ValidationError)
+	if !ok || len(verr.Errors) != 1 || verr.Errors[0].Code != SemanticUnknownField {
+		t.Fatalf("Unknown field not rejected: %v", err)
+	}
+	_, err = e.Select(uid, SelectQuery{
+		Table: "autoscope_users",
+		Selection: ValueSelection{ Attr: "username", Op: "=", Value: "strictUser" },
+	})
+	if err != nil { t.Fatal(err.Error()) }
+}
@@ -178,3 +178,21 @@ func TestInsertSelectUpdate(t *testing.T){
 		t.Fatal("Incorrect number of rows retrieved")
 	}
 }
+
+func TestBatchInsert(t *testing.T){
+	var res IStrMap
+	data := []map[string]interface{}{
+		map[string]interface{}{ "AttributeA": 100 },
+		map[string]interface{}{ "AttributeA": 101 },
+	}
+	b, err := json.Marshal(data)
+	if err != nil { t.Fatalf("JSON conversion failed: %v", err) }
+	err = APICall("http://localhost:4210/api/choon/", "PUT", map[string]string{ "data": string(b) }, &res)
+	if err != nil {
+		t.Fatalf("API Insert Error: %v", err)
+	}
+	ids, ok := res["inserted_ids"].([]interface{})
+	if !ok || len(ids) != 2 {
+		t.Fatal("Incorrect inserted ids returned")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"strconv"
+	"strings"
 	engine "github.com/mmcdermo/autoscope/engine"
 )
 
@@ -24,6 +25,18 @@ var (
 
 func report_api_error_code(w http.ResponseWriter, err error, user_error string, code int){
 	w.Header().Set("Content-Type", "text/json")
+	//Invalid selections list each of their problems
+	if verr, ok := err.(engine.ValidationError); ok {
+		b, merr := json.Marshal(map[string]interface{}{
+			"error": user_error + "--" + err.Error(),
+			"errors": verr.Errors,
+		})
+		if merr == nil {
+			http.Error(w, string(b), code)
+			log.Printf(err.Error())
+			return
+		}
+	}
 	http.Error(w, "{\"error\": \"" + user_error + "--" + err.Error() + "\"}", code)
 	log.Printf(err.Error())
 }
@@ -32,6 +45,15 @@ func report_api_error(w http.ResponseWriter, err error, user_error string){
 	report_api_error_code(w, err, user_error, 400);
 }
 
+//Parse an optional integer parameter, returning nil if it's absent
+func optional_int_param(r *http.Request, name string) (*int64, error){
+	str := r.FormValue(name)
+	if str == "" { return nil, nil }
+	i, err := strconv.ParseInt(str, 10, 64)
+	if err != nil { return nil, err }
+	return &i, nil
+}
+
 func InsertHandler(uid int64, w http.ResponseWriter, r *http.Request){
 	vars := mux.Vars(r)
 	obj, ok := vars["object"]
@@ -41,17 +63,50 @@ func InsertHandler(uid int64, w http.ResponseWriter, r *http.Request){
 	}
 
 	queryStr := r.FormValue("data")
+
+	//Optionally give the group the rows belong to
+	group, err := optional_int_param(r, "group")
+	if err != nil {
+		report_api_error(w, err, "Invalid group ID")
+		return
+	}
+
+	//A JSON array inserts every object it contains at once
+	if strings.HasPrefix(strings.TrimSpace(queryStr), "[") {
+		InsertBatchHandler(uid, obj, queryStr, group, w)
+		return
+	}
+
 	var mapA map[string]interface{}
-	err := json.Unmarshal([]byte(queryStr), &mapA)
+	err = json.Unmarshal([]byte(queryStr), &mapA)
 	if err != nil {
 		report_api_error(w, err, "Unable to parse data "+string(queryStr))
 		return
 	}
 
-	res, err := e.Insert(uid, engine.InsertQuery{
+	iq := engine.InsertQuery{
 		Table: obj,
 		Data: mapA,
-	})
+		Group: group,
+	}
+	//Optionally declare the tables nested objects belong in, and the
+	// fields used to look up existing nested objects
+	if fkStr := r.FormValue("foreign_keys"); fkStr != "" {
+		err = json.Unmarshal([]byte(fkStr), &iq.ForeignKeys)
+		if err != nil {
+			report_api_error(w, err, "Unable to parse foreign keys "+fkStr)
+			return
+		}
+	}
+	if lkStr := r.FormValue("lookup_keys"); lkStr != "" {
+		err = json.Unmarshal([]byte(lkStr), &iq.LookupKeys)
+		if err != nil {
+			report_api_error(w, err, "Unable to parse lookup keys "+lkStr)
+			return
+		}
+	}
+
+	res, err := e.Insert(uid, iq)
 	if err != nil {
 		report_api_error(w, err, "Error performing query")
 		return
@@ -70,6 +125,92 @@ func InsertHandler(uid int64, w http.ResponseWriter, r *http.Request){
 	fmt.Fprintf(w, "%s", z)
 }
 
+//Insert a row, or update the row with the same values in the fields
+// given by the comma separated `keys` parameter
+func UpsertHandler(uid int64, w http.ResponseWriter, r *http.Request){
+	vars := mux.Vars(r)
+	obj, ok := vars["object"]
+	if !ok {
+		report_api_error(w, errors.New("No object provided"), "No object provided")
+		return
+	}
+
+	queryStr := r.FormValue("data")
+	var data map[string]interface{}
+	err := json.Unmarshal([]byte(queryStr), &data)
+	if err != nil {
+		report_api_error(w, err, "Unable to parse data "+string(queryStr))
+		return
+	}
+
+	uq := engine.UpsertQuery{ Table: obj, Data: data }
+	uq.Group, err = optional_int_param(r, "group")
+	if err != nil {
+		report_api_error(w, err, "Invalid group ID")
+		return
+	}
+	for _, key := range strings.Split(r.FormValue("keys"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			uq.Keys = append(uq.Keys, key)
+		}
+	}
+	if incrementsStr := r.FormValue("increments"); incrementsStr != "" {
+		err = json.Unmarshal([]byte(incrementsStr), &uq.Increments)
+		if err != nil {
+			report_api_error(w, err, "Unable to parse increments "+incrementsStr)
+			return
+		}
+	}
+
+	res, err := e.Upsert(uid, uq)
+	if err != nil {
+		report_api_error(w, err, "UPSERT Query Error")
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		report_api_error(w, err, "UPSERT Query Error")
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		report_api_error(w, err, "UPSERT Query Error")
+		return
+	}
+
+	z, err := json.Marshal(map[string]interface{}{"status": "success",
+		"id": id,
+		"rows_affected": rowsAffected,
+	})
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", z)
+}
+
+func InsertBatchHandler(uid int64, obj string, queryStr string, group *int64, w http.ResponseWriter){
+	var rows []map[string]interface{}
+	err := json.Unmarshal([]byte(queryStr), &rows)
+	if err != nil {
+		report_api_error(w, err, "Unable to parse data "+string(queryStr))
+		return
+	}
+
+	ids, err := e.InsertBatch(uid, engine.BatchInsertQuery{
+		Table: obj,
+		Data: rows,
+		Group: group,
+	})
+	if err != nil {
+		report_api_error(w, err, "Error performing query")
+		return
+	}
+
+	z, err := json.Marshal(map[string]interface{}{"status": "success",
+		"inserted_ids": ids,
+	})
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", z)
+}
+
 func UpdateHandler(uid int64, w http.ResponseWriter, r *http.Request){
 	vars := mux.Vars(r)
 
@@ -93,7 +234,7 @@ func UpdateHandler(uid int64, w http.ResponseWriter, r *http.Request){
 	selectionStr := r.FormValue("selection")
 	fmt.Println(selectionStr)	
 	uq := engine.UpdateQuery{ Table: obj, Data: data }
-	uq.Selection, err = engine.FormulaFromJSON([]byte(selectionStr))
+	uq.Selection, err = engine.FormulaFromString(selectionStr)
 	if err != nil {
 		report_api_error(w, err, "Unable to parse query object "+selectionStr)
 		return
@@ -121,6 +262,53 @@ func UpdateHandler(uid int64, w http.ResponseWriter, r *http.Request){
 	fmt.Fprintf(w, "%s", z)
 }
 
+//Change the owner and/or group of the rows matching `selection`
+// to the user given by `owner` and the group given by `group`
+func ChownHandler(uid int64, w http.ResponseWriter, r *http.Request){
+	vars := mux.Vars(r)
+	obj, ok := vars["object"]
+	if !ok {
+		report_api_error(w, errors.New("No object provided"), "No object provided")
+		return
+	}
+
+	cq := engine.ChownQuery{ Table: obj }
+	var err error
+	cq.Owner, err = optional_int_param(r, "owner")
+	if err != nil {
+		report_api_error(w, err, "Invalid owner ID")
+		return
+	}
+	cq.Group, err = optional_int_param(r, "group")
+	if err != nil {
+		report_api_error(w, err, "Invalid group ID")
+		return
+	}
+	selectionStr := r.FormValue("selection")
+	cq.Selection, err = engine.FormulaFromString(selectionStr)
+	if err != nil {
+		report_api_error(w, err, "Unable to parse query object "+selectionStr)
+		return
+	}
+
+	res, err := e.Chown(uid, cq)
+	if err != nil {
+		report_api_error(w, err, "CHOWN Query Error")
+		return
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		report_api_error(w, err, "Error performing query")
+		return
+	}
+
+	z, err := json.Marshal(map[string]interface{}{"status": "success",
+		"rows_affected": rowsAffected,
+	})
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", z)
+}
+
 func DeleteHandler(uid int64, w http.ResponseWriter, r *http.Request){
 	vars := mux.Vars(r)
 	obj, ok := vars["object"]
@@ -134,7 +322,7 @@ func DeleteHandler(uid int64, w http.ResponseWriter, r *http.Request){
 	sq := engine.SelectQuery{ Table: obj }
 
 	var err error
-	sq.Selection, err = engine.FormulaFromJSON([]byte(selectionStr))
+	sq.Selection, err = engine.FormulaFromString(selectionStr)
 	if err != nil {
 		report_api_error(w, err, "Unable to parse query object "+selectionStr)
 		return
@@ -171,9 +359,14 @@ func SelectHandler(uid int64, w http.ResponseWriter, r *http.Request){
 	selectionStr := r.FormValue("selection")
 	sq := engine.SelectQuery{ Table: obj }
 
+	//Relations to embed in each row, comma separated
+	if expandStr := r.FormValue("expand"); expandStr != "" {
+		sq.Expand = strings.Split(expandStr, ",")
+	}
+
 
 	var err error
-	sq.Selection, err = engine.FormulaFromJSON([]byte(selectionStr))
+	sq.Selection, err = engine.FormulaFromString(selectionStr)
 	if err != nil {
 		report_api_error(w, err, "Unable to parse query object "+selectionStr)
 		return
@@ -231,6 +424,10 @@ func RESTHandler(w http.ResponseWriter, r *http.Request){
 			SelectHandler(uid, w, r)
 		} else if "UPDATE" == queryType {
 			UpdateHandler(uid, w, r)
+		} else if "UPSERT" == queryType {
+			UpsertHandler(uid, w, r)
+		} else if "CHOWN" == queryType {
+			ChownHandler(uid, w, r)
 		}
 	} else if r.Method == "PUT" {
 		InsertHandler(uid, w, r)
@@ -260,50 +457,288 @@ func LoginHandler(w http.ResponseWriter, r *http.Request){
 	fmt.Fprintf(w, "%s", s)
 }
 
+//Returns the tables and fields the user can read (see
+// engine.VisibleSchema). With object_fields=true, fields stored outside
+// columns are included along with their most common type.
 func SchemaHandler(w http.ResponseWriter, r *http.Request){
 	var maxSessionLength int64 // (seconds)
 	maxSessionLength = 60 * 60
 
-	_, err := engine.RequireAuth(&e, r, maxSessionLength)
+	uids, err := engine.RequireAuth(&e, r, maxSessionLength)
 	if err != nil {
 		report_api_error_code(w, err, "User not logged in or session expired.", 403)
 		return
 	}
+	uid, err := strconv.ParseInt(uids, 10, 64)
+	if err != nil {
+		report_api_error(w, err, "Invalid User ID")
+		return
+	}
 
-	if &e == nil {
-		report_api_error_code(w, err, "No engine configured.", 500)
+	schema, err := e.VisibleSchema(uid, r.FormValue("object_fields") == "true")
+	if err != nil {
+		report_api_error_code(w, err, "Error retrieving schema", 500)
+		return
+	}
+	s, err := json.Marshal(schema)
+	if err != nil {
+		report_api_error_code(w, err, "Error converting result to JSON", 500)
 		return
 	}
-	
-	//TODO: SECURITY
-	schema := e.Schema
-	s,_ := json.Marshal(schema)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "%s", s)
 }
 
 func StatsHandler(w http.ResponseWriter, r *http.Request){
+	_, ok := requireCapability(w, r, engine.CapViewStats)
+	if !ok { return }
+
+	e.GlobalStatsLock.RLock()
+	s, err := json.Marshal(e.GlobalStats)
+	e.GlobalStatsLock.RUnlock()
+	if err != nil {
+		report_api_error_code(w, err, "Error converting result to JSON", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "%s", s)
+}
+
+//Returns the hits, misses and invalidations of the group cache
+func CacheStatsHandler(w http.ResponseWriter, r *http.Request){
+	_, ok := requireCapability(w, r, engine.CapViewStats)
+	if !ok { return }
+	write_json(w, e.GroupCacheStats())
+}
+
+//Require that the request is made by a logged in user with a role
+// granting `capability` (see engine/roles.go).
+// On failure, an error is reported and false returned.
+func requireCapability(w http.ResponseWriter, r *http.Request, capability string) (int64, bool){
 	var maxSessionLength int64 // (seconds)
 	maxSessionLength = 60 * 60
 
-	_, err := engine.RequireAuth(&e, r, maxSessionLength)
+	uids, err := engine.RequireAuth(&e, r, maxSessionLength)
 	if err != nil {
 		report_api_error_code(w, err, "User not logged in or session expired.", 403)
-		return
+		return -1, false
+	}
+	uid, err := strconv.ParseInt(uids, 10, 64)
+	if err != nil {
+		report_api_error(w, err, "Invalid User ID")
+		return -1, false
+	}
+	allowed, err := engine.HasCapability(&e, uid, capability)
+	if err != nil {
+		report_api_error_code(w, err, "Error checking permissions", 500)
+		return -1, false
+	}
+	if !allowed {
+		report_api_error_code(w, errors.New("Missing capability " + capability), "Permission denied", 403)
+		return -1, false
 	}
+	return uid, true
+}
 
-	if &e == nil {
-		report_api_error_code(w, err, "No engine configured.", 500)
+func write_json(w http.ResponseWriter, obj interface{}){
+	b, err := json.Marshal(obj)
+	if err != nil {
+		report_api_error_code(w, err, "Error converting result to JSON", 500)
 		return
 	}
-
-	//TODO: SECURITY
-	stats := e.GlobalStats
-	s,_ := json.Marshal(stats)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "%s", s)
+	fmt.Fprintf(w, "%s", b)
+}
+
+//GET returns the permissions of `table`, or of every table if absent.
+//POST sets the permissions of `table` given any of `owner`, `group`
+// and `everyone`, e.g. owner=read,write
+func PermissionsHandler(w http.ResponseWriter, r *http.Request){
+	uid, ok := requireCapability(w, r, engine.CapManagePermissions)
+	if !ok { return }
+
+	table := r.FormValue("table")
+	if r.Method == "POST" {
+		if table == "" {
+			report_api_error(w, errors.New("No table specified"), "Invalid request")
+			return
+		}
+		changes := make(map[string]string, 0)
+		for _, entity := range []string{"owner", "group", "everyone"} {
+			if vals, ok := r.Form[entity]; ok && len(vals) > 0 {
+				changes[entity] = vals[0]
+			}
+		}
+		perms, err := e.AdminSetTablePermissions(uid, table, changes)
+		if err != nil {
+			report_api_error(w, err, "Error setting permissions")
+			return
+		}
+		write_json(w, engine.PermissionsMap(perms))
+		return
+	}
+
+	if table != "" {
+		perms, ok := e.GetTablePermissions(table)
+		if !ok { perms = engine.DefaultPermissions() }
+		write_json(w, engine.PermissionsMap(perms))
+		return
+	}
+	e.PermissionsLock.RLock()
+	all := make(map[string]map[string]string, len(e.Permissions))
+	for name, perms := range e.Permissions {
+		all[name] = engine.PermissionsMap(perms)
+	}
+	e.PermissionsLock.RUnlock()
+	write_json(w, all)
+}
+
+//GET returns the groups associated with `table`.
+//PUT associates group `group_id` with `table`, and DELETE removes it.
+// With default=true, PUT also makes it the table's default group.
+func TableGroupsHandler(w http.ResponseWriter, r *http.Request){
+	uid, ok := requireCapability(w, r, engine.CapManagePermissions)
+	if !ok { return }
+
+	table := r.FormValue("table")
+	if table == "" {
+		report_api_error(w, errors.New("No table specified"), "Invalid request")
+		return
+	}
+	if r.Method == "PUT" || r.Method == "DELETE" {
+		gid, err := strconv.ParseInt(r.FormValue("group_id"), 10, 64)
+		if err != nil {
+			report_api_error(w, err, "Invalid group ID")
+			return
+		}
+		if r.Method == "PUT" && r.FormValue("default") == "true" {
+			err = e.AdminSetDefaultTableGroup(uid, table, gid)
+		} else if r.Method == "PUT" {
+			err = e.AdminAddTableGroup(uid, table, gid)
+		} else {
+			err = e.AdminRemoveTableGroup(uid, table, gid)
+		}
+		if err != nil {
+			report_api_error(w, err, "Error changing table groups")
+			return
+		}
+	}
+
+	groups, err := engine.GetTableGroups(&e, table)
+	if err != nil {
+		report_api_error(w, err, "Error retrieving table groups")
+		return
+	}
+	write_json(w, map[string]interface{}{ "groups": groups })
+}
+
+//Returns recorded changes to the permissions of `table`,
+// or of every table if absent
+func PermissionsAuditHandler(w http.ResponseWriter, r *http.Request){
+	_, ok := requireCapability(w, r, engine.CapManagePermissions)
+	if !ok { return }
+
+	rows, err := engine.PermissionsAudit(&e, r.FormValue("table"))
+	if err != nil {
+		report_api_error(w, err, "Error retrieving audit log")
+		return
+	}
+	write_json(w, map[string]interface{}{ "changes": rows })
+}
+
+//GET returns every user along with their roles.
+//POST creates a user given `username` and `password`.
+func UsersHandler(w http.ResponseWriter, r *http.Request){
+	uid, ok := requireCapability(w, r, engine.CapManageUsers)
+	if !ok { return }
+
+	if r.Method == "POST" {
+		id, err := engine.CreateUser(&e, r.FormValue("username"), r.FormValue("password"))
+		if err != nil {
+			report_api_error(w, err, "Error creating user")
+			return
+		}
+		err = engine.AuditPermissions(&e, uid, "", "create_user", r.FormValue("username"))
+		if err != nil {
+			report_api_error_code(w, err, "Error recording change", 500)
+			return
+		}
+		write_json(w, map[string]interface{}{ "id": id })
+		return
+	}
+
+	users, err := engine.ListUsers(&e)
+	if err != nil {
+		report_api_error(w, err, "Error retrieving users")
+		return
+	}
+	for _, user := range users {
+		roles, err := engine.UserRoles(&e, user["id"].(int64))
+		if err != nil {
+			report_api_error(w, err, "Error retrieving roles")
+			return
+		}
+		user["roles"] = roles
+	}
+	write_json(w, map[string]interface{}{ "users": users })
+}
+
+//GET returns every role along with its capabilities.
+//PUT assigns `role` to `user_id` or `group_id`, and DELETE removes it.
+func RolesHandler(w http.ResponseWriter, r *http.Request){
+	uid, ok := requireCapability(w, r, engine.CapManageUsers)
+	if !ok { return }
+
+	if r.Method == "PUT" || r.Method == "DELETE" {
+		role := r.FormValue("role")
+		userId, err := optional_int_param(r, "user_id")
+		if err != nil {
+			report_api_error(w, err, "Invalid user ID")
+			return
+		}
+		groupId, err := optional_int_param(r, "group_id")
+		if err != nil {
+			report_api_error(w, err, "Invalid group ID")
+			return
+		}
+		switch {
+		case userId != nil && r.Method == "PUT":
+			err = e.AdminAssignUserRole(uid, *userId, role)
+		case userId != nil:
+			err = e.AdminRemoveUserRole(uid, *userId, role)
+		case groupId != nil && r.Method == "PUT":
+			err = e.AdminAssignGroupRole(uid, *groupId, role)
+		case groupId != nil:
+			err = e.AdminRemoveGroupRole(uid, *groupId, role)
+		default:
+			err = errors.New("No user_id or group_id specified")
+		}
+		if err != nil {
+			report_api_error(w, err, "Error changing roles")
+			return
+		}
+	}
+	write_json(w, map[string]interface{}{ "roles": e.Roles() })
+}
+
+//POST immediately performs the migration suggested by current stats,
+// returning the steps performed
+func MigrateHandler(w http.ResponseWriter, r *http.Request){
+	_, ok := requireCapability(w, r, engine.CapManageMigrations)
+	if !ok { return }
+	if r.Method != "POST" {
+		report_api_error_code(w, errors.New("Method " + r.Method), "Migrations must be POSTed", 405)
+		return
+	}
+	steps, err := e.Migrate()
+	if err != nil {
+		report_api_error_code(w, err, "Error performing migration", 500)
+		return
+	}
+	write_json(w, map[string]interface{}{ "steps": steps })
 }
 
 func RunHTTPServer(port string, router *mux.Router) error{
@@ -316,7 +751,14 @@ func RunHTTPServer(port string, router *mux.Router) error{
 
 	r.HandleFunc("/asapi/schema/", SchemaHandler)
 	r.HandleFunc("/asapi/stats/", StatsHandler)
+	r.HandleFunc("/asapi/stats/cache/", CacheStatsHandler)
 	r.HandleFunc("/asapi/login/", LoginHandler)
+	r.HandleFunc("/asapi/permissions/", PermissionsHandler)
+	r.HandleFunc("/asapi/permissions/groups/", TableGroupsHandler)
+	r.HandleFunc("/asapi/permissions/audit/", PermissionsAuditHandler)
+	r.HandleFunc("/asapi/users/", UsersHandler)
+	r.HandleFunc("/asapi/roles/", RolesHandler)
+	r.HandleFunc("/asapi/migrate/", MigrateHandler)
 	r.HandleFunc("/api/{object}/", RESTHandler)
 	//http.Handle("/", r)
 	log.Println("Running Autoscope HTTP API on port " + port)